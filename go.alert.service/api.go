@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPIAddr    = ":8081"
+	localAPIAddr      = "127.0.0.1:8081"
+	defaultEventLimit = 500
+	maxEventLimit     = 5000
+)
+
+// apiListenAddr resolves the address of the alert history API from
+// ALERT_API_ADDR. Without a token the API is only served on the loopback
+// interface, so alert history is never open to the network.
+func apiListenAddr(addr, token string) (string, error) {
+	if addr == "" {
+		if token == "" {
+			return localAPIAddr, nil
+		}
+		return defaultAPIAddr, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid ALERT_API_ADDR %q: %v", addr, err)
+	}
+	if token != "" || host == "localhost" {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("ALERT_API_TOKEN is required to serve the alert API on %s; set it, or ALERT_API_ADDR=off", addr)
+	}
+	return addr, nil
+}
+
+// eventLister lists the recorded alert events
+type eventLister interface {
+	listEvents(ctx context.Context, filter eventFilter) ([]AlertEvent, error)
+}
+
+// newAPIHandler routes the alert history API. When token is set, requests
+// must send it as "Authorization: Bearer <token>".
+func newAPIHandler(events eventLister, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/alerts", handleAlerts(events))
+	return requireToken(token, mux)
+}
+
+// serveAPI serves the alert history on addr until ctx is done
+func (s *alertService) serveAPI(ctx context.Context, addr, token string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newAPIHandler(s, token),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Alert API listening on %s", addr)
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go.alert.service"`)
+			writeError(w, "Invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAlerts lists alert events, newest first. Query parameters: location,
+// user_id, from and to (RFC3339; from is inclusive, to exclusive) and limit.
+func handleAlerts(lister eventLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		filter := eventFilter{
+			UserId:   q.Get("user_id"),
+			Location: q.Get("location"),
+			Limit:    defaultEventLimit,
+		}
+		var err error
+		if v := q.Get("from"); v != "" {
+			if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, "from must be an RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("to"); v != "" {
+			if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+				writeError(w, "to must be an RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxEventLimit {
+				writeError(w, "limit must be an integer from 1 to "+strconv.Itoa(maxEventLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := lister.listEvents(r.Context(), filter)
+		if err != nil {
+			log.Printf("Failed to list alert events: %v", err)
+			writeError(w, "Failed to list alert events", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+func writeError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
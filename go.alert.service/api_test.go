@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIListenAddr(t *testing.T) {
+	tests := []struct {
+		addr, token string
+		want        string
+		wantErr     bool
+	}{
+		{"", "", localAPIAddr, false},
+		{"", "secret", defaultAPIAddr, false},
+		{"127.0.0.1:9000", "", "127.0.0.1:9000", false},
+		{"[::1]:9000", "", "[::1]:9000", false},
+		{"localhost:9000", "", "localhost:9000", false},
+		{":9000", "", "", true},
+		{"0.0.0.0:9000", "", "", true},
+		{"192.168.1.10:9000", "", "", true},
+		{"alerts.local:9000", "", "", true},
+		{":9000", "secret", ":9000", false},
+		{"0.0.0.0:9000", "secret", "0.0.0.0:9000", false},
+		{"9000", "", "", true},
+		{"9000", "secret", "", true},
+	}
+	for _, tt := range tests {
+		got, err := apiListenAddr(tt.addr, tt.token)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("apiListenAddr(%q, %q) = %q, %v; want %q, error %v", tt.addr, tt.token, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"no token configured, header ignored", "", "Bearer anything", http.StatusOK},
+		{"bearer token", "secret", "Bearer secret", http.StatusOK},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer secreT", http.StatusUnauthorized},
+		{"token prefix", "secret", "Bearer secre", http.StatusUnauthorized},
+		{"token without scheme", "secret", "secret", http.StatusUnauthorized},
+		{"other scheme", "secret", "Basic secret", http.StatusUnauthorized},
+		{"empty bearer", "secret", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			requireToken(tt.token, ok).ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if tt.want == http.StatusUnauthorized && challenge == "" {
+				t.Error("got no WWW-Authenticate header on a 401")
+			}
+			if tt.want == http.StatusOK && challenge != "" {
+				t.Errorf("got WWW-Authenticate %q on success", challenge)
+			}
+		})
+	}
+}
+
+// fakeEventLister returns events and records the filters it was asked for
+type fakeEventLister struct {
+	events  []AlertEvent
+	err     error
+	filters []eventFilter
+}
+
+func (f *fakeEventLister) listEvents(_ context.Context, filter eventFilter) ([]AlertEvent, error) {
+	f.filters = append(f.filters, filter)
+	return f.events, f.err
+}
+
+func TestHandleAlerts(t *testing.T) {
+	from := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 1, 3, 0, 0, 0, 0, time.FixedZone("", -5*3600))
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		err        error
+		wantStatus int
+		wantFilter eventFilter // checked when wantStatus is 200
+	}{
+		{name: "defaults", query: "", wantStatus: http.StatusOK, wantFilter: eventFilter{Limit: defaultEventLimit}},
+		{name: "user and location", query: "?user_id=u1&location=freezer", wantStatus: http.StatusOK,
+			wantFilter: eventFilter{UserId: "u1", Location: "freezer", Limit: defaultEventLimit}},
+		{name: "from and to", query: "?from=2024-01-02T03:00:00Z&to=2024-01-03T00:00:00-05:00", wantStatus: http.StatusOK,
+			wantFilter: eventFilter{From: from, To: to, Limit: defaultEventLimit}},
+		{name: "smallest limit", query: "?limit=1", wantStatus: http.StatusOK, wantFilter: eventFilter{Limit: 1}},
+		{name: "largest limit", query: "?limit=5000", wantStatus: http.StatusOK, wantFilter: eventFilter{Limit: maxEventLimit}},
+		{name: "limit zero", query: "?limit=0", wantStatus: http.StatusBadRequest},
+		{name: "limit negative", query: "?limit=-1", wantStatus: http.StatusBadRequest},
+		{name: "limit too large", query: "?limit=5001", wantStatus: http.StatusBadRequest},
+		{name: "limit not a number", query: "?limit=ten", wantStatus: http.StatusBadRequest},
+		{name: "from not RFC3339", query: "?from=2024-01-02", wantStatus: http.StatusBadRequest},
+		{name: "to not RFC3339", query: "?to=yesterday", wantStatus: http.StatusBadRequest},
+		{name: "listing fails", err: errors.New("db down"), wantStatus: http.StatusInternalServerError},
+		{name: "wrong method", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lister := &fakeEventLister{
+				events: []AlertEvent{{ID: 2, UserId: "u1", Location: "freezer"}, {ID: 1, UserId: "u1", Location: "freezer"}},
+				err:    tt.err,
+			}
+			srv := httptest.NewServer(newAPIHandler(lister, ""))
+			defer srv.Close()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, _ := http.NewRequest(method, srv.URL+"/alerts"+tt.query, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got content type %q, want application/json", ct)
+			}
+			if tt.wantStatus != http.StatusOK {
+				var body map[string]string
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body["error"] == "" {
+					t.Errorf("got error body %v (%v), want an error message", body, err)
+				}
+				if tt.wantStatus == http.StatusBadRequest && len(lister.filters) != 0 {
+					t.Errorf("listed events for a bad request")
+				}
+				return
+			}
+
+			if len(lister.filters) != 1 {
+				t.Fatalf("got %d listings, want 1", len(lister.filters))
+			}
+			got := lister.filters[0]
+			if got.UserId != tt.wantFilter.UserId || got.Location != tt.wantFilter.Location || got.Limit != tt.wantFilter.Limit ||
+				!got.From.Equal(tt.wantFilter.From) || !got.To.Equal(tt.wantFilter.To) {
+				t.Errorf("got filter %+v, want %+v", got, tt.wantFilter)
+			}
+			var events []AlertEvent
+			if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 2 || events[0].ID != 2 || events[1].ID != 1 {
+				t.Errorf("got events %+v, want ids 2 and 1", events)
+			}
+		})
+	}
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	lister := &fakeEventLister{events: []AlertEvent{}}
+	srv := httptest.NewServer(newAPIHandler(lister, "secret"))
+	defer srv.Close()
+
+	for auth, want := range map[string]int{"": http.StatusUnauthorized, "Bearer nope": http.StatusUnauthorized, "Bearer secret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/alerts", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Authorization %q: got status %d, want %d", auth, resp.StatusCode, want)
+		}
+	}
+	if len(lister.filters) != 1 {
+		t.Errorf("got %d listings, want only the authorized one", len(lister.filters))
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	pumpLocation = "wellpump"        // the preference location of the well pump
+	alertWindow  = 120 * time.Minute // how far back threshold violations are looked for
+)
+
+const alertPrefQuery = `select "User"."gotifyToken","User"."slackWebhookUrl","User"."webhookUrl","User"."phone","AlertPreference".* from "User" join "AlertPreference" on "AlertPreference"."userId" = "User".id`
+
+// alertService evaluates the alert checks. Its database pools stay open
+// between runs.
+type alertService struct {
+	gohomeDB    *sqlx.DB
+	homeiotaDB  *sqlx.DB
+	homeiotaURL string
+	notifiers   map[string]Notifier // by channel
+
+	renotifyInterval time.Duration // how often a firing alert is sent again; 0 sends it once
+
+	prefsMaxAge time.Duration // how long loaded preferences are reused
+	prefsMu     sync.Mutex
+	prefs       []AlertPreference
+	prefsLoaded time.Time
+
+	smsMu sync.Mutex // held while a text is sent and recorded
+}
+
+// checks lists the alert checks in the order --once runs them
+func (s *alertService) checks() []check {
+	return []check{
+		{name: "offline", run: s.checkOffline},
+		{name: "temperature", run: s.checkTemperature},
+		{name: "humidity", run: s.checkHumidity},
+		{name: "pump", run: s.checkPump},
+	}
+}
+
+// preferences returns the alert preferences of all users, read again once the
+// loaded ones are older than prefsMaxAge. If reading them fails, the previous
+// ones are used.
+func (s *alertService) preferences(ctx context.Context) ([]AlertPreference, error) {
+	s.prefsMu.Lock()
+	defer s.prefsMu.Unlock()
+	if s.prefs != nil && time.Since(s.prefsLoaded) < s.prefsMaxAge {
+		return s.prefs, nil
+	}
+
+	prefs := []AlertPreference{}
+	if err := s.homeiotaDB.SelectContext(ctx, &prefs, alertPrefQuery); err != nil {
+		if s.prefs == nil {
+			return nil, err
+		}
+		log.Printf("Failed to fetch alert preferences, using those from %s: %v", s.prefsLoaded.Format(time.RFC3339), err)
+		return s.prefs, nil
+	}
+	s.prefs, s.prefsLoaded = prefs, time.Now()
+	return prefs, nil
+}
+
+// checkOffline alerts when a location has sent no heartbeat (the pump) or
+// reading (temperature sensors) within its offline threshold. As before, a
+// preference without an offline threshold is reported offline.
+func (s *alertService) checkOffline(ctx context.Context, pref AlertPreference, now time.Time) (*alert, error) {
+	online := false
+	if pref.OfflineThreshold.Valid {
+		since := now.Add(-time.Duration(pref.OfflineThreshold.Float64) * time.Minute)
+		if pref.Location == pumpLocation {
+			heartbeatRows := []DeviceHeartbeat{}
+			heartbeatQuery := `SELECT timestamp FROM device_heartbeats WHERE pump = true AND timestamp > $1 LIMIT 1`
+			if err := s.gohomeDB.SelectContext(ctx, &heartbeatRows, heartbeatQuery, since); err != nil {
+				return nil, fmt.Errorf("heartbeat query: %w", err)
+			}
+			online = len(heartbeatRows) > 0
+		} else {
+			offlineRows := []Temperature{}
+			offlineQuery := `SELECT value, timestamp FROM temperatures WHERE location = $1 AND timestamp > $2 LIMIT 1`
+			if err := s.gohomeDB.SelectContext(ctx, &offlineRows, offlineQuery, pref.Location, since); err != nil {
+				return nil, fmt.Errorf("offline temp query: %w", err)
+			}
+			online = len(offlineRows) > 0
+		}
+	}
+	if online {
+		return &alert{
+			threshold: pref.OfflineThreshold,
+			title:     fmt.Sprintf("Device Online: %s", pref.Location),
+			message:   fmt.Sprintf("'%s' is reporting again.\n\nView details: %s", pref.Location, s.homeiotaURL),
+		}, nil
+	}
+	return &alert{
+		firing:    true,
+		threshold: pref.OfflineThreshold,
+		title:     fmt.Sprintf("Device Offline: %s", pref.Location),
+		message:   fmt.Sprintf("No heartbeat/reading for '%s' in the last offline threshold window. Device may be offline.\n\nView details: %s", pref.Location, s.homeiotaURL),
+		priority:  7,
+		summary:   fmt.Sprintf("Device Offline: %s", pref.Location),
+	}, nil
+}
+
+// checkTemperature alerts when the latest temperature of a location is over
+// its threshold, and resolves when it is not. Without a reading in the alert
+// window it cannot tell and returns nil, so the alert keeps its state; the
+// offline check reports the silent sensor.
+func (s *alertService) checkTemperature(ctx context.Context, pref AlertPreference, now time.Time) (*alert, error) {
+	if pref.Location == pumpLocation {
+		return nil, nil
+	}
+	rows := []ThresholdTemperature{}
+	tempQuery := `
+	SELECT
+	  t1.value as threshold_exceeded_value,
+	  t1.timestamp as threshold_exceeded_timestamp,
+	  t2.value as latest_value,
+	  t2.timestamp as latest_timestamp
+	FROM
+	  (SELECT * FROM temperatures WHERE location = $1 AND timestamp > $3 ORDER BY timestamp DESC LIMIT 1) t2
+	LEFT JOIN
+	  (SELECT * FROM temperatures WHERE location = $1 AND value > $2 AND timestamp > $3 ORDER BY timestamp DESC LIMIT 1) t1 ON true;`
+	if err := s.gohomeDB.SelectContext(ctx, &rows, tempQuery, pref.Location, pref.Threshold, now.Add(-alertWindow)); err != nil {
+		return nil, fmt.Errorf("temp query: %w", err)
+	}
+	if len(rows) == 0 || !rows[0].LatestValue.Valid {
+		return nil, nil
+	}
+	row := rows[0]
+
+	latestTemp := row.LatestValue.Float64
+	if latestTemp > pref.Threshold {
+		return &alert{
+			firing:    true,
+			value:     row.LatestValue,
+			threshold: sql.NullFloat64{Float64: pref.Threshold, Valid: true},
+			title:     fmt.Sprintf("TempAlert: %s : %.2f°F", pref.Location, latestTemp),
+			message:   fmt.Sprintf("'%s' over %.2f°F for %s.\n\nView details: %s", pref.Location, pref.Threshold, row.exceededFor(), s.homeiotaURL),
+			priority:  10,
+			summary:   fmt.Sprintf("Temperature Alert: %s: %.2f", pref.Location, latestTemp),
+		}, nil
+	}
+	return &alert{
+		value:     row.LatestValue,
+		threshold: sql.NullFloat64{Float64: pref.Threshold, Valid: true},
+		title:     fmt.Sprintf("TempAlert Resolved: %s", pref.Location),
+		message:   fmt.Sprintf("'%s' is back under %.2f°F.\n\nView details: %s", pref.Location, pref.Threshold, s.homeiotaURL),
+	}, nil
+}
+
+// checkHumidity alerts when the latest relative humidity of a location is
+// over its humidity threshold, for preferences that have one. Like
+// checkTemperature it returns nil without a humidity reading in the alert
+// window.
+func (s *alertService) checkHumidity(ctx context.Context, pref AlertPreference, now time.Time) (*alert, error) {
+	if pref.Location == pumpLocation || !pref.HumidityThreshold.Valid {
+		return nil, nil
+	}
+	threshold := pref.HumidityThreshold.Float64
+	rows := []ThresholdTemperature{}
+	humidityQuery := `
+	SELECT
+	  t1.humidity as threshold_exceeded_value,
+	  t1.timestamp as threshold_exceeded_timestamp,
+	  t2.humidity as latest_value,
+	  t2.timestamp as latest_timestamp
+	FROM
+	  (SELECT * FROM temperatures WHERE location = $1 AND humidity IS NOT NULL AND timestamp > $3 ORDER BY timestamp DESC LIMIT 1) t2
+	LEFT JOIN
+	  (SELECT * FROM temperatures WHERE location = $1 AND humidity > $2 AND timestamp > $3 ORDER BY timestamp DESC LIMIT 1) t1 ON true;`
+	if err := s.gohomeDB.SelectContext(ctx, &rows, humidityQuery, pref.Location, threshold, now.Add(-alertWindow)); err != nil {
+		return nil, fmt.Errorf("humidity query: %w", err)
+	}
+	if len(rows) == 0 || !rows[0].LatestValue.Valid {
+		return nil, nil
+	}
+	row := rows[0]
+
+	latestHumidity := row.LatestValue.Float64
+	if latestHumidity > threshold {
+		return &alert{
+			firing:    true,
+			value:     row.LatestValue,
+			threshold: pref.HumidityThreshold,
+			title:     fmt.Sprintf("HumidityAlert: %s : %.1f%%", pref.Location, latestHumidity),
+			message:   fmt.Sprintf("'%s' over %.1f%% relative humidity for %s.\n\nView details: %s", pref.Location, threshold, row.exceededFor(), s.homeiotaURL),
+			priority:  7,
+			summary:   fmt.Sprintf("Humidity Alert: %s: %.1f", pref.Location, latestHumidity),
+		}, nil
+	}
+	return &alert{
+		value:     row.LatestValue,
+		threshold: pref.HumidityThreshold,
+		title:     fmt.Sprintf("HumidityAlert Resolved: %s", pref.Location),
+		message:   fmt.Sprintf("'%s' is back under %.1f%% relative humidity.\n\nView details: %s", pref.Location, threshold, s.homeiotaURL),
+	}, nil
+}
+
+// checkPump alerts when the pump has been drawing a low current, which
+// happens when the well is low or dry. The threshold is in amps.
+func (s *alertService) checkPump(ctx context.Context, pref AlertPreference, now time.Time) (*alert, error) {
+	if pref.Location != pumpLocation {
+		return nil, nil
+	}
+	rows := []PumpRunTime{}
+	pumpQuery := `SELECT current, timestamp
+		FROM (
+		  SELECT
+			current,
+			timestamp,
+			LAG(current) OVER (ORDER BY timestamp) AS prev_current,
+			LAG(timestamp) OVER (ORDER BY timestamp) AS prev_timestamp
+		  FROM pump_run_times
+		  WHERE timestamp > $2
+		) t
+		WHERE
+		  current > 1 AND current < $1
+		  AND prev_current > 1 AND prev_current < $1
+		  AND current <> prev_current
+		  AND timestamp <> prev_timestamp`
+	if err := s.gohomeDB.SelectContext(ctx, &rows, pumpQuery, pref.Threshold, now.Add(-alertWindow)); err != nil {
+		return nil, fmt.Errorf("pump query: %w", err)
+	}
+	if len(rows) == 0 {
+		return &alert{
+			threshold: sql.NullFloat64{Float64: pref.Threshold, Valid: true},
+			title:     fmt.Sprintf("Pump Alert Resolved: %s", pref.Location),
+			message:   fmt.Sprintf("'%s' has not run at a low current in the last %.0f hours.\n\nView details: %s", pref.Location, alertWindow.Hours(), s.homeiotaURL),
+		}, nil
+	}
+	return &alert{
+		firing:    true,
+		value:     sql.NullFloat64{Float64: rows[0].Current, Valid: true},
+		threshold: sql.NullFloat64{Float64: pref.Threshold, Valid: true},
+		title:     fmt.Sprintf("Pump Alert: %s", pref.Location),
+		message:   fmt.Sprintf("Well may be low or dry. '%s' is running at %.2f Amps at %s.\n\nView details: %s", pref.Location, rows[0].Current, rows[0].Timestamp.Format(time.RFC3339), s.homeiotaURL),
+		priority:  7,
+		summary:   fmt.Sprintf("Pump Alert: %s: %.2f", pref.Location, rows[0].Current),
+	}, nil
+}
+
+// exceededFor is how long the value has been over the threshold, as far as
+// the alert window shows
+func (row ThresholdTemperature) exceededFor() string {
+	if row.ThresholdExceededTimestamp.Valid && row.LatestTimestamp.Valid {
+		return row.LatestTimestamp.Time.Sub(row.ThresholdExceededTimestamp.Time).String()
+	}
+	return "N/A"
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Delivery statuses of alert events
+const (
+	statusSent    = "sent"
+	statusFailed  = "failed"
+	statusSkipped = "skipped" // the user has nowhere to send it, or the channel does not send it
+)
+
+// AlertEvent is one notification sent (or attempted) by the service, stored
+// in alert_events
+type AlertEvent struct {
+	ID          int64      `db:"id" json:"id"`
+	UserId      string     `db:"userId" json:"user_id"`
+	Location    string     `db:"location" json:"location"`
+	Kind        string     `db:"kind" json:"kind"`   // offline, temperature, humidity or pump
+	State       string     `db:"state" json:"state"` // firing, or resolved for recovery notifications
+	Value       *float64   `db:"value" json:"value,omitempty"`
+	Threshold   *float64   `db:"threshold" json:"threshold,omitempty"`
+	Title       string     `db:"title" json:"title"`
+	Message     string     `db:"message" json:"message"`
+	Channel     string     `db:"channel" json:"channel"`
+	Status      string     `db:"status" json:"status"` // sent, failed or skipped
+	Error       *string    `db:"error" json:"error,omitempty"`
+	CreatedAt   time.Time  `db:"createdAt" json:"created_at"`
+	DeliveredAt *time.Time `db:"deliveredAt" json:"delivered_at,omitempty"`
+}
+
+// deliver sends a notification for an alert on each channel the preference
+// selects and records each delivery in alert_events. It returns an error when
+// a channel failed and none sent it; channels that skip it count as neither.
+func (s *alertService) deliver(ctx context.Context, pref AlertPreference, kind, state string, a alert, now time.Time) error {
+	n := Notification{
+		UserId:    pref.UserId,
+		Location:  pref.Location,
+		Kind:      kind,
+		State:     state,
+		Value:     floatPtr(a.value),
+		Threshold: floatPtr(a.threshold),
+		Title:     a.title,
+		Message:   a.message,
+		Priority:  a.priority,
+		Time:      now,
+	}
+	channels := []string(pref.Channels)
+	if len(channels) == 0 {
+		channels = []string{channelGotify}
+	}
+	sent := false
+	var failures []error
+	for _, channel := range channels {
+		switch status, err := s.deliverOn(ctx, pref, channel, n, a); status {
+		case statusSent:
+			sent = true
+		case statusFailed:
+			failures = append(failures, err)
+		}
+	}
+	if !sent && len(failures) > 0 {
+		return fmt.Errorf("no channel delivered the %s alert: %w", kind, errors.Join(failures...))
+	}
+	return nil
+}
+
+// deliverOn sends n on one channel, records the event and returns its status
+// along with the error of a failed or skipped send
+func (s *alertService) deliverOn(ctx context.Context, pref AlertPreference, channel string, n Notification, a alert) (string, error) {
+	if channel == channelSMS {
+		// The SMS limits count the sent texts in alert_events, so each text
+		// is recorded before the next one is counted
+		s.smsMu.Lock()
+		defer s.smsMu.Unlock()
+	}
+
+	var err error
+	if notifier, ok := s.notifiers[channel]; ok {
+		err = notifier.Send(ctx, pref, n)
+	} else {
+		err = fmt.Errorf("unknown channel %q", channel)
+	}
+
+	ev := AlertEvent{
+		UserId:    n.UserId,
+		Location:  n.Location,
+		Kind:      n.Kind,
+		State:     n.State,
+		Value:     n.Value,
+		Threshold: n.Threshold,
+		Title:     n.Title,
+		Message:   n.Message,
+		Channel:   channel,
+		Status:    statusSent,
+		CreatedAt: n.Time,
+	}
+	switch {
+	case err == nil:
+		log.Printf("%s Sent %s alert: %s.", time.Now().Format(time.RFC3339), channel, a.summary)
+		deliveredAt := time.Now().UTC()
+		ev.DeliveredAt = &deliveredAt
+	case errors.Is(err, errNoRecipient):
+		log.Printf("No %s recipient for user %s, skipping alert: %s - %s", channel, pref.UserId, a.title, a.message)
+		ev.Status = statusSkipped
+	case errors.Is(err, errNotCritical):
+		ev.Status = statusSkipped
+		message := err.Error()
+		ev.Error = &message
+	case errors.Is(err, errRateLimited):
+		log.Printf("%s rate limit reached for user %s, skipping alert: %s", channel, pref.UserId, a.summary)
+		ev.Status = statusSkipped
+		message := err.Error()
+		ev.Error = &message
+	default:
+		log.Printf("Failed to send %s alert: %s: %v", channel, a.summary, err)
+		ev.Status = statusFailed
+		message := err.Error()
+		ev.Error = &message
+	}
+	if err := s.recordEvent(ctx, &ev); err != nil {
+		log.Printf("Failed to record %s alert event of %s for user %s: %v", n.Kind, pref.Location, pref.UserId, err)
+	}
+	return ev.Status, err
+}
+
+// countSentSMS counts the texts recorded as sent to the users with phone since
+// numberSince, and to anyone since totalSince
+func (s *alertService) countSentSMS(ctx context.Context, phone string, numberSince, totalSince time.Time) (toNumber, total int, err error) {
+	err = s.homeiotaDB.QueryRowxContext(ctx, `SELECT
+		  COUNT(*) FILTER (WHERE e."createdAt" > $2 AND u.phone = $1),
+		  COUNT(*)
+		FROM alert_events e
+		LEFT JOIN "User" u ON u.id = e."userId"
+		WHERE e.channel = $4 AND e.status = $5 AND e."createdAt" > $3`,
+		phone, numberSince.UTC(), totalSince.UTC(), channelSMS, statusSent).Scan(&toNumber, &total)
+	return toNumber, total, err
+}
+
+func floatPtr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+func (s *alertService) recordEvent(ctx context.Context, ev *AlertEvent) error {
+	rows, err := s.homeiotaDB.NamedQueryContext(ctx, `INSERT INTO alert_events ("userId", location, kind, state, value, threshold, title, message, channel, status, error, "createdAt", "deliveredAt")
+		VALUES (:userId, :location, :kind, :state, :value, :threshold, :title, :message, :channel, :status, :error, :createdAt, :deliveredAt)
+		RETURNING id`, ev)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&ev.ID); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// eventFilter narrows a list of alert events; empty fields match everything
+type eventFilter struct {
+	UserId   string
+	Location string
+	From     time.Time // inclusive
+	To       time.Time // exclusive
+	Limit    int
+}
+
+// listEvents returns the matching alert events, newest first
+func (s *alertService) listEvents(ctx context.Context, filter eventFilter) ([]AlertEvent, error) {
+	query := `SELECT id, "userId", location, kind, state, value, threshold, title, message, channel, status, error, "createdAt", "deliveredAt" FROM alert_events`
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.UserId != "" {
+		add(`"userId" = $%d`, filter.UserId)
+	}
+	if filter.Location != "" {
+		add(`location = $%d`, filter.Location)
+	}
+	if !filter.From.IsZero() {
+		add(`"createdAt" >= $%d`, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		add(`"createdAt" < $%d`, filter.To.UTC())
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(` ORDER BY "createdAt" DESC, id DESC LIMIT $%d`, len(args))
+
+	events := []AlertEvent{}
+	err := s.homeiotaDB.SelectContext(ctx, &events, query, args...)
+	return events, err
+}
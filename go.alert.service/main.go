@@ -1,28 +1,47 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
-	"os"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type AlertPreference struct {
-	GotifyToken      sql.NullString 	`db:"gotifyToken"`
-	UserId           string         	`db:"userId"`
-	Location         string         	`db:"location"`
-	Threshold        float64        	`db:"threshold"`
-	Enabled          bool           	`db:"enabled"`
-	OfflineThreshold sql.NullFloat64 	`db:"offlineThreshold"`
+	GotifyToken       sql.NullString  `db:"gotifyToken"`
+	SlackWebhookURL   sql.NullString  `db:"slackWebhookUrl"`
+	WebhookURL        sql.NullString  `db:"webhookUrl"`
+	Phone             sql.NullString  `db:"phone"`
+	UserId            string          `db:"userId"`
+	Location          string          `db:"location"`
+	Threshold         float64         `db:"threshold"`
+	Enabled           bool            `db:"enabled"`
+	OfflineThreshold  sql.NullFloat64 `db:"offlineThreshold"`
+	HumidityThreshold sql.NullFloat64 `db:"humidityThreshold"`
+	Channels          pq.StringArray  `db:"channels"` // notifier channels; gotify if empty
 }
 
+const (
+	defaultCheckInterval = 5 * time.Minute
+	defaultCheckJitter   = 0.1         // fraction of the interval runs are moved by at random
+	defaultPrefsMaxAge   = time.Minute // how long alert preferences are cached in daemon mode
+	defaultRenotify      = time.Hour   // how often an alert that keeps firing is sent again
+	maxOpenConns         = 4           // per database; one for each check running at a time
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
 type PumpRunTime struct {
 	Current   float64   `db:"current"`
 	Timestamp time.Time `db:"timestamp"`
@@ -34,212 +53,146 @@ type Temperature struct {
 }
 
 type ThresholdTemperature struct {
-	ThresholdExceededValue   		sql.NullFloat64 `db:"threshold_exceeded_value"`
-	ThresholdExceededTimestamp 	sql.NullTime   	`db:"threshold_exceeded_timestamp"`
-	LatestValue              		sql.NullFloat64 `db:"latest_value"`
-	LatestTimestamp          		sql.NullTime    `db:"latest_timestamp"`
+	ThresholdExceededValue     sql.NullFloat64 `db:"threshold_exceeded_value"`
+	ThresholdExceededTimestamp sql.NullTime    `db:"threshold_exceeded_timestamp"`
+	LatestValue                sql.NullFloat64 `db:"latest_value"`
+	LatestTimestamp            sql.NullTime    `db:"latest_timestamp"`
 }
 
 type DeviceHeartbeat struct {
 	Timestamp time.Time `db:"timestamp"`
 }
 
-func sendGotifyAlert(token, title, message string, priority int, logShort ...string) {
-	if token == "" {
-		log.Printf("No Gotify token provided, skipping alert: %s - %s", title, message)
-		return
-	}
-	gotifyURL := os.Getenv("GOTIFY_URL")
-
-	url := fmt.Sprintf("%s/message?token=%s", gotifyURL, token)
-	payload := map[string]interface{}{
-		"title":    title,
-		"message":  message,
-		"priority": priority,
-	}
-	jsonPayload, _ := json.Marshal(payload)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		log.Printf("Failed to send Gotify alert: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-	if len(logShort) > 0 && logShort[0] != "" {
-		log.Printf("%s", logShort[0])
-	} else {
-		log.Printf("Sent Gotify alert: %s - %s (status %d)", title, message, resp.StatusCode)
-	}
-}
-
 func main() {
+	once := flag.Bool("once", false, "run every check once and exit instead of running as a daemon")
+	flag.Parse()
 
-	log.Printf("Go alert script triggered at %s", time.Now().Format(time.RFC3339))
-
+	// SIGTERM (docker stop) and Ctrl-C cancel the running checks and stop the daemon
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	HOMEIOTA_URL := os.Getenv("HOMEIOTA_URL")
 	GOHOME_DB_URL := os.Getenv("GOHOME_DB_URL")
 	HOMEIOTA_DB_URL := os.Getenv("HOMEIOTA_DB_URL")
 
+	defaultInterval, err := durationEnv("CHECK_INTERVAL", defaultCheckInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prefsMaxAge, err := durationEnv("PREFERENCES_REFRESH_INTERVAL", defaultPrefsMaxAge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renotifyInterval := defaultRenotify
+	if v := os.Getenv("RENOTIFY_INTERVAL"); v == "0" {
+		renotifyInterval = 0
+	} else if renotifyInterval, err = durationEnv("RENOTIFY_INTERVAL", defaultRenotify); err != nil {
+		log.Fatal(err)
+	}
+	jitter := defaultCheckJitter
+	if v := os.Getenv("CHECK_JITTER"); v != "" {
+		if jitter, err = strconv.ParseFloat(v, 64); err != nil || jitter < 0 || jitter >= 1 {
+			log.Fatalf("Invalid CHECK_JITTER %q: must be a fraction from 0 to below 1", v)
+		}
+	}
+
+	// The pools are opened lazily and kept for the life of the process
 	gohomeDBConn, err := sqlx.Open("postgres", GOHOME_DB_URL)
 	if err != nil {
 		log.Fatalf("Failed to connect to gohome db: %v", err)
 	}
 	defer gohomeDBConn.Close()
+	gohomeDBConn.SetMaxOpenConns(maxOpenConns)
 
 	homeiotaDBConn, err := sqlx.Open("postgres", HOMEIOTA_DB_URL)
 	if err != nil {
 		log.Fatalf("Failed to connect to homeiota db: %v", err)
 	}
 	defer homeiotaDBConn.Close()
+	homeiotaDBConn.SetMaxOpenConns(maxOpenConns)
 
-	alertPreferences := []AlertPreference{}
-	alertPrefQuery := `select "User"."gotifyToken","AlertPreference".* from "User" join "AlertPreference" on "AlertPreference"."userId" = "User".id`
-	err = homeiotaDBConn.Select(&alertPreferences, alertPrefQuery)
-	if err != nil {
-		log.Fatalf("Failed to fetch alert preferences: %v", err)
-	}
-
-	now := time.Now().UTC()
-	timeDeltaAgo := now.Add(-120 * time.Minute)
-
-	pumpResults := make(map[string][]PumpRunTime)
-	tempResults := make(map[string][]ThresholdTemperature)
-	heartbeatResults := make(map[string]bool)
-	gotifyTokens := make(map[string]string)
-	enabledMap := make(map[string]bool)
-	thresholdMap := make(map[string]float64)
-	offlineThresholdMap := make(map[string]float64)
+	svc := &alertService{
+		gohomeDB:    gohomeDBConn,
+		homeiotaDB:  homeiotaDBConn,
+		homeiotaURL: HOMEIOTA_URL,
 
-	for _, pref := range alertPreferences {
-		location := pref.Location
-		gotifyToken := ""
-		if pref.GotifyToken.Valid {
-			gotifyToken = pref.GotifyToken.String
-		}
-		gotifyTokens[location] = gotifyToken
-		enabledMap[location] = pref.Enabled
-		thresholdMap[location] = pref.Threshold
-		if pref.OfflineThreshold.Valid {
-			offlineThresholdMap[location] = pref.OfflineThreshold.Float64
-		}
+		renotifyInterval: renotifyInterval,
+		prefsMaxAge:      prefsMaxAge,
+	}
+	// The SMS limits count the texts recorded in alert_events
+	if svc.notifiers, err = notifiersFromEnv(svc); err != nil {
+		log.Fatal(err)
+	}
+	checks := svc.checks()
+	if err := setCheckIntervals(checks, defaultInterval); err != nil {
+		log.Fatal(err)
+	}
 
-		if location == "wellpump" {
-			pumpRows := []PumpRunTime{}
-			pumpQuery := `SELECT current, timestamp
-				FROM (
-				  SELECT
-					current,
-					timestamp,
-					LAG(current) OVER (ORDER BY timestamp) AS prev_current,
-					LAG(timestamp) OVER (ORDER BY timestamp) AS prev_timestamp
-				  FROM pump_run_times
-				  WHERE timestamp > $2
-				) t
-				WHERE
-				  current > 1 AND current < $1
-				  AND prev_current > 1 AND prev_current < $1
-				  AND current <> prev_current
-				  AND timestamp <> prev_timestamp`
-			err := gohomeDBConn.Select(&pumpRows, pumpQuery, pref.Threshold, timeDeltaAgo)
-			if err != nil {
-				log.Printf("Pump query error: %v", err)
-			}
-			pumpResults[location] = pumpRows
-
-			if val, ok := offlineThresholdMap[location]; ok {
-				heartbeatRows := []DeviceHeartbeat{}
-				heartbeatTimeAgo := now.Add(-time.Duration(val) * time.Minute)
-				heartbeatQuery := `SELECT timestamp FROM device_heartbeats WHERE pump = true AND timestamp > $1 LIMIT 1`
-				err := gohomeDBConn.Select(&heartbeatRows, heartbeatQuery, heartbeatTimeAgo)
-				if err != nil {
-					log.Printf("Heartbeat query error: %v", err)
-				}
-				heartbeatResults[location] = len(heartbeatRows) > 0
-			} else {
-				heartbeatResults[location] = false
-			}
-		} else {
-			tempRows := []ThresholdTemperature{}
-			tempQuery := `
-			SELECT
-			  t1.value as threshold_exceeded_value,
-			  t1.timestamp as threshold_exceeded_timestamp,
-			  t2.value as latest_value,
-			  t2.timestamp as latest_timestamp
-			FROM
-			  (SELECT * FROM temperatures WHERE location = $1 AND value > $2 AND timestamp > $3 ORDER BY timestamp DESC LIMIT 1) t1
-			CROSS JOIN
-			  (SELECT * FROM temperatures WHERE location = $1 ORDER BY timestamp DESC LIMIT 1) t2;`
-			err := gohomeDBConn.Select(&tempRows, tempQuery, location, pref.Threshold, timeDeltaAgo)
-			if err != nil {
-				log.Printf("Temp query error: %v", err)
-			}
-			tempResults[location] = tempRows
-
-			if val, ok := offlineThresholdMap[location]; ok {
-				offlineRows := []Temperature{}
-				offlineTimeAgo := now.Add(-time.Duration(val) * time.Minute)
-				offlineQuery := `SELECT value, timestamp FROM temperatures WHERE location = $1 AND timestamp > $2 LIMIT 1`
-				err := gohomeDBConn.Select(&offlineRows, offlineQuery, location, offlineTimeAgo)
-				if err != nil {
-					log.Printf("Offline temp query error: %v", err)
-				}
-				heartbeatResults[location] = len(offlineRows) > 0
-			} else {
-				heartbeatResults[location] = false
-			}
-		}
+	if *once {
+		log.Printf("Go alert script triggered at %s", time.Now().Format(time.RFC3339))
+		svc.runOnce(ctx, checks)
+		log.Printf("Go alert script completed at %s", time.Now().Format(time.RFC3339))
+		return
 	}
 
-	// Send Gotify alert for each heartbeat result with no rows
-	for location, hasHeartbeat := range heartbeatResults {
-		if !hasHeartbeat && enabledMap[location] {
-			token := gotifyTokens[location]
-			title := fmt.Sprintf("Device Offline: %s", location)
-			message := fmt.Sprintf("No heartbeat/reading for '%s' in the last offline threshold window. Device may be offline.\n\nView details: %s", location, HOMEIOTA_URL)
-			shortLog := fmt.Sprintf("%s Sent Gotify alert: Device Offline: %s.", time.Now().Format(time.RFC3339), location)
-			sendGotifyAlert(token, title, message, 7, shortLog)
+	// The alert history API; ALERT_API_ADDR=off disables it
+	apiAddr, apiToken := os.Getenv("ALERT_API_ADDR"), os.Getenv("ALERT_API_TOKEN")
+	if apiAddr != "off" {
+		if apiAddr, err = apiListenAddr(apiAddr, apiToken); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	// Send Gotify alert for each temperature result with rows
-	for location, rows := range tempResults {
-		if len(rows) > 0 && enabledMap[location] {
-			row := rows[0]
-			latestTemp := row.LatestValue.Float64
-			thresholdValue := thresholdMap[location]
-			thresholdExceeded := row.ThresholdExceededValue.Valid && row.ThresholdExceededValue.Float64 > thresholdValue
-			latestTempExceeded := row.LatestValue.Valid && latestTemp > thresholdValue
-
-			// fmt.Printf("Location: %s, Latest Temp: %.2f, Threshold: %.2f, latest Exceeded: %t, Threshold Exceeded: %t\n", location, latestTemp, thresholdValue, latestTempExceeded, thresholdExceeded)
-
-			var temperatureExceededTimeDelta string
-			if row.ThresholdExceededTimestamp.Valid && row.LatestTimestamp.Valid {
-				temperatureExceededTimeDelta = row.LatestTimestamp.Time.Sub(row.ThresholdExceededTimestamp.Time).String()
-			} else {
-				temperatureExceededTimeDelta = "N/A"
-			}
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		log.Printf("Running the %s check every %s", c.name, c.interval)
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+			schedule(ctx, c, jitter, systemClock{}, svc.runCheck)
+		}(c)
+	}
 
-			if latestTempExceeded && thresholdExceeded {
-				token := gotifyTokens[location]
-				title := fmt.Sprintf("TempAlert: %s : %.2f°F", location, latestTemp)
-				message := fmt.Sprintf("'%s' over %.2f°F for %s.\n\nView details: %s", location, thresholdValue, temperatureExceededTimeDelta, HOMEIOTA_URL)
-				shortLog := fmt.Sprintf("%s Sent Gotify alert: Temperature Alert: %s: %.2f.", time.Now().Format(time.RFC3339), location, latestTemp)
-				sendGotifyAlert(token, title, message, 10, shortLog)
+	if apiAddr != "off" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := svc.serveAPI(ctx, apiAddr, apiToken); err != nil {
+				log.Printf("Alert API stopped: %v", err)
 			}
-		}
+		}()
 	}
 
-	// Send Gotify alert for each pump result with rows
-	for location, rows := range pumpResults {
-		if len(rows) > 0 && enabledMap[location] {
-			token := gotifyTokens[location]
-			title := fmt.Sprintf("Pump Alert: %s", location)
-			message := fmt.Sprintf("Well may be low or dry. '%s' is running at %.2f Amps at %s.\n\nView details: %s", location, rows[0].Current, rows[0].Timestamp.Format(time.RFC3339), HOMEIOTA_URL)
-			shortLog := fmt.Sprintf("%s Sent Gotify alert: Pump Alert: %s: %.2f.", time.Now().Format(time.RFC3339), location, rows[0].Current)
-			sendGotifyAlert(token, title, message, 7, shortLog)
-		}
+	<-ctx.Done()
+	log.Printf("Shutting down")
+	wg.Wait()
+	log.Printf("Go alert service stopped at %s", time.Now().Format(time.RFC3339))
+}
+
+// durationEnv parses the environment variable name as a duration such as 5m,
+// returning def when it is not set
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration such as 5m", name, v)
 	}
+	return d, nil
+}
 
-	log.Printf("Go alert script completed at %s", time.Now().Format(time.RFC3339))
-}
\ No newline at end of file
+// intEnv parses the environment variable name as a non-negative integer,
+// returning def when it is not set
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notification channels, as listed in AlertPreference.channels
+const (
+	channelGotify  = "gotify"
+	channelSlack   = "slack"
+	channelWebhook = "webhook"
+	channelSMS     = "sms"
+)
+
+// Errors notifiers return for notifications they skip
+var (
+	errNoRecipient = errors.New("no recipient configured") // the user has not set up the channel
+	errNotCritical = errors.New("not a critical alert")    // the channel only sends critical alerts
+	errRateLimited = errors.New("rate limit reached")
+)
+
+// Notification is an alert, or its resolution, as handed to notifiers
+type Notification struct {
+	UserId    string    `json:"user_id"`
+	Location  string    `json:"location"`
+	Kind      string    `json:"kind"`  // offline, temperature, humidity or pump
+	State     string    `json:"state"` // firing or resolved
+	Value     *float64  `json:"value,omitempty"`
+	Threshold *float64  `json:"threshold,omitempty"`
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Priority  int       `json:"priority"` // Gotify priority: 10 for critical alerts, 5 for resolutions
+	Time      time.Time `json:"time"`
+}
+
+// Notifier delivers notifications over one channel
+type Notifier interface {
+	// Channel is the name users select the notifier by
+	Channel() string
+	// Send delivers n to the user of pref, returning errNoRecipient when the
+	// user has not set up the channel
+	Send(ctx context.Context, pref AlertPreference, n Notification) error
+}
+
+// notifiersFromEnv sets up the notifiers of every channel
+func notifiersFromEnv(sent smsCounter) (map[string]Notifier, error) {
+	webhook, err := newWebhookNotifier(os.Getenv("WEBHOOK_TEMPLATE"), os.Getenv("WEBHOOK_TEMPLATE_FILE"), os.Getenv("WEBHOOK_CONTENT_TYPE"))
+	if err != nil {
+		return nil, err
+	}
+	sms, err := newSMSNotifierFromEnv(sent)
+	if err != nil {
+		return nil, err
+	}
+	notifiers := map[string]Notifier{}
+	for _, n := range []Notifier{
+		&gotifyNotifier{url: os.Getenv("GOTIFY_URL")},
+		&slackNotifier{},
+		webhook,
+		sms,
+	} {
+		notifiers[n.Channel()] = n
+	}
+	return notifiers, nil
+}
+
+// post sends body to url and fails on non-2xx responses
+func post(ctx context.Context, url, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(req)
+}
+
+// do sends req and fails on non-2xx responses
+func do(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// gotifyNotifier sends to the Gotify server at GOTIFY_URL with the user's
+// Gotify token
+type gotifyNotifier struct {
+	url string
+}
+
+func (g *gotifyNotifier) Channel() string { return channelGotify }
+
+func (g *gotifyNotifier) Send(ctx context.Context, pref AlertPreference, n Notification) error {
+	if !pref.GotifyToken.Valid || pref.GotifyToken.String == "" {
+		return errNoRecipient
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": n.Priority,
+	})
+	target := fmt.Sprintf("%s/message?token=%s", g.url, url.QueryEscape(pref.GotifyToken.String))
+	if err := post(ctx, target, "application/json", payload); err != nil {
+		return fmt.Errorf("gotify: %w", err)
+	}
+	return nil
+}
+
+// slackNotifier posts to the user's Slack incoming webhook, like the devices
+// do with their startup messages
+type slackNotifier struct{}
+
+func (s *slackNotifier) Channel() string { return channelSlack }
+
+func (s *slackNotifier) Send(ctx context.Context, pref AlertPreference, n Notification) error {
+	if !pref.SlackWebhookURL.Valid || pref.SlackWebhookURL.String == "" {
+		return errNoRecipient
+	}
+	payload, _ := json.Marshal(map[string]string{"text": "*" + n.Title + "*\n" + n.Message})
+	if err := post(ctx, pref.SlackWebhookURL.String, "application/json", payload); err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	return nil
+}
+
+// defaultWebhookTemplate renders the whole Notification as JSON
+const defaultWebhookTemplate = `{{json .}}`
+
+// webhookNotifier posts the notification, rendered with a text/template, to
+// the user's webhook URL. Templates get the Notification as data and a json
+// function that encodes a value as JSON.
+type webhookNotifier struct {
+	tmpl        *template.Template
+	contentType string
+}
+
+// newWebhookNotifier parses the template given inline or, failing that, in a
+// file. Without either, notifications are sent as JSON objects.
+func newWebhookNotifier(text, file, contentType string) (*webhookNotifier, error) {
+	if text == "" && file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read WEBHOOK_TEMPLATE_FILE: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse webhook template: %w", err)
+	}
+	return &webhookNotifier{tmpl: tmpl, contentType: contentType}, nil
+}
+
+func (wh *webhookNotifier) Channel() string { return channelWebhook }
+
+func (wh *webhookNotifier) Send(ctx context.Context, pref AlertPreference, n Notification) error {
+	if !pref.WebhookURL.Valid || pref.WebhookURL.String == "" {
+		return errNoRecipient
+	}
+	var body bytes.Buffer
+	if err := wh.tmpl.Execute(&body, n); err != nil {
+		return fmt.Errorf("webhook template: %w", err)
+	}
+	if strings.Contains(wh.contentType, "json") && !json.Valid(body.Bytes()) {
+		return errors.New("webhook template did not produce valid JSON")
+	}
+	if err := post(ctx, pref.WebhookURL.String, wh.contentType, body.Bytes()); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	return nil
+}
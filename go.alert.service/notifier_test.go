@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received is a request as seen by a recordingServer
+type received struct {
+	path, query, contentType, body string
+}
+
+// recordingServer answers every request with status and records it
+func recordingServer(t *testing.T, status int) (*httptest.Server, *[]received) {
+	t.Helper()
+	var got []received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got = append(got, received{r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"), string(b)})
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &got
+}
+
+// testNotification is a firing temperature alert with every field set
+func testNotification() Notification {
+	value, threshold := 12.5, 10.0
+	return Notification{
+		UserId:    "u1",
+		Location:  "freezer",
+		Kind:      "temperature",
+		State:     stateFiring,
+		Value:     &value,
+		Threshold: &threshold,
+		Title:     "Freezer too warm",
+		Message:   "freezer is at 12.5°F, above 10.0°F",
+		Priority:  10,
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestGotifySend(t *testing.T) {
+	srv, got := recordingServer(t, http.StatusOK)
+	g := &gotifyNotifier{url: srv.URL}
+	pref := AlertPreference{GotifyToken: sql.NullString{String: "a&b", Valid: true}}
+
+	if err := g.Send(context.Background(), pref, testNotification()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(*got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*got))
+	}
+	req := (*got)[0]
+	if req.path != "/message" || req.query != "token=a%26b" {
+		t.Errorf("got %s?%s, want /message?token=a%%26b", req.path, req.query)
+	}
+	if req.contentType != "application/json" {
+		t.Errorf("got content type %q, want application/json", req.contentType)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(req.body), &payload); err != nil {
+		t.Fatalf("payload %q: %v", req.body, err)
+	}
+	want := map[string]interface{}{"title": "Freezer too warm", "message": "freezer is at 12.5°F, above 10.0°F", "priority": 10.0}
+	if len(payload) != len(want) {
+		t.Errorf("got payload %v, want %v", payload, want)
+	}
+	for k, v := range want {
+		if payload[k] != v {
+			t.Errorf("got %s = %v, want %v", k, payload[k], v)
+		}
+	}
+}
+
+func TestSlackSend(t *testing.T) {
+	srv, got := recordingServer(t, http.StatusOK)
+	pref := AlertPreference{SlackWebhookURL: sql.NullString{String: srv.URL + "/services/T0/B0/x", Valid: true}}
+
+	if err := (&slackNotifier{}).Send(context.Background(), pref, testNotification()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(*got) != 1 {
+		t.Fatalf("got %d requests, want 1", len(*got))
+	}
+	req := (*got)[0]
+	if req.path != "/services/T0/B0/x" {
+		t.Errorf("got path %s, want /services/T0/B0/x", req.path)
+	}
+	want := `{"text":"*Freezer too warm*\nfreezer is at 12.5°F, above 10.0°F"}`
+	if req.body != want {
+		t.Errorf("got payload %s, want %s", req.body, want)
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "webhook.tmpl")
+	if err := os.WriteFile(file, []byte(`{{.Location}}: {{.Title}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n := testNotification()
+	defaultBody, _ := json.Marshal(n)
+
+	tests := []struct {
+		name              string
+		text, file, ctype string
+		wantType          string
+		wantBody          string
+		wantErr           bool
+	}{
+		{name: "default", wantType: "application/json", wantBody: string(defaultBody)},
+		{name: "inline template", text: `{"alert":{{json .Title}},"value":{{.Value}}}`, wantType: "application/json", wantBody: `{"alert":"Freezer too warm","value":12.5}`},
+		{name: "template file", file: file, ctype: "text/plain", wantType: "text/plain", wantBody: "freezer: Freezer too warm"},
+		{name: "inline wins over file", text: `{{json .Kind}}`, file: file, wantType: "application/json", wantBody: `"temperature"`},
+		{name: "invalid JSON", text: `{"alert": {{.Title}}}`, wantErr: true},
+		{name: "invalid JSON in a +json type", text: `{{.Title}}`, ctype: "application/vnd.alert+json", wantErr: true},
+		{name: "template fails", text: `{{.Nope}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, got := recordingServer(t, http.StatusNoContent)
+			wh, err := newWebhookNotifier(tt.text, tt.file, tt.ctype)
+			if err != nil {
+				t.Fatalf("newWebhookNotifier: %v", err)
+			}
+			pref := AlertPreference{WebhookURL: sql.NullString{String: srv.URL + "/hook", Valid: true}}
+
+			err = wh.Send(context.Background(), pref, n)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Send succeeded, want an error")
+				}
+				if len(*got) != 0 {
+					t.Errorf("got %d requests, want none", len(*got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if len(*got) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*got))
+			}
+			req := (*got)[0]
+			if req.path != "/hook" || req.contentType != tt.wantType || req.body != tt.wantBody {
+				t.Errorf("got %s %q %s, want /hook %q %s", req.path, req.contentType, req.body, tt.wantType, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestNewWebhookNotifierErrors(t *testing.T) {
+	if _, err := newWebhookNotifier("", filepath.Join(t.TempDir(), "missing.tmpl"), ""); err == nil {
+		t.Error("missing template file: got no error")
+	}
+	if _, err := newWebhookNotifier("{{.Title", "", ""); err == nil {
+		t.Error("unparsable template: got no error")
+	}
+}
+
+func TestNotifierErrors(t *testing.T) {
+	srv, got := recordingServer(t, http.StatusBadGateway)
+	wh, err := newWebhookNotifier("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured := AlertPreference{
+		GotifyToken:     sql.NullString{String: "token", Valid: true},
+		SlackWebhookURL: sql.NullString{String: srv.URL, Valid: true},
+		WebhookURL:      sql.NullString{String: srv.URL, Valid: true},
+	}
+	blank := AlertPreference{
+		GotifyToken:     sql.NullString{Valid: true},
+		SlackWebhookURL: sql.NullString{Valid: true},
+		WebhookURL:      sql.NullString{Valid: true},
+	}
+
+	for _, n := range []Notifier{&gotifyNotifier{url: srv.URL}, &slackNotifier{}, wh} {
+		t.Run(n.Channel(), func(t *testing.T) {
+			*got = nil
+			for name, pref := range map[string]AlertPreference{"unset": {}, "empty": blank} {
+				if err := n.Send(context.Background(), pref, testNotification()); !errors.Is(err, errNoRecipient) {
+					t.Errorf("%s recipient: got %v, want %v", name, err, errNoRecipient)
+				}
+			}
+			if len(*got) != 0 {
+				t.Fatalf("got %d requests without a recipient, want none", len(*got))
+			}
+
+			err := n.Send(context.Background(), configured, testNotification())
+			if err == nil || !strings.Contains(err.Error(), "status 502") || !strings.HasPrefix(err.Error(), n.Channel()+":") {
+				t.Errorf("got %v, want a %s error with status 502", err, n.Channel())
+			}
+			if len(*got) != 1 {
+				t.Errorf("got %d requests, want 1", len(*got))
+			}
+		})
+	}
+}
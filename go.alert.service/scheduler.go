@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// check is one kind of alert, evaluated for every enabled preference. run
+// returns nil for preferences the check does not apply to, or when it has no
+// data to decide on, which leaves the alert in its current state.
+type check struct {
+	name     string
+	interval time.Duration // time between runs in daemon mode
+	run      func(ctx context.Context, pref AlertPreference, now time.Time) (*alert, error)
+}
+
+// setCheckIntervals reads the interval of each check from
+// <NAME>_CHECK_INTERVAL, e.g. PUMP_CHECK_INTERVAL, falling back to def
+func setCheckIntervals(checks []check, def time.Duration) error {
+	for i := range checks {
+		env := strings.ToUpper(checks[i].name) + "_CHECK_INTERVAL"
+		interval, err := durationEnv(env, def)
+		if err != nil {
+			return err
+		}
+		checks[i].interval = interval
+	}
+	return nil
+}
+
+// runOnce runs every check one after the other, as --once does
+func (s *alertService) runOnce(ctx context.Context, checks []check) {
+	for _, c := range checks {
+		s.runCheck(ctx, c)
+	}
+}
+
+// runCheck evaluates c once for every enabled preference and sends the
+// notifications that are due. Errors are logged so one failing location does
+// not hold up the others.
+func (s *alertService) runCheck(ctx context.Context, c check) {
+	prefs, err := s.preferences(ctx)
+	if err != nil {
+		log.Printf("Skipping %s check, failed to fetch alert preferences: %v", c.name, err)
+		return
+	}
+	now := time.Now().UTC()
+	for _, pref := range prefs {
+		if !pref.Enabled {
+			continue
+		}
+		a, err := c.run(ctx, pref, now)
+		if err == nil && a != nil {
+			err = s.notify(ctx, pref, c.name, *a, now)
+		}
+		if err != nil {
+			log.Printf("%s check of %s for user %s failed: %v", c.name, pref.Location, pref.UserId, err)
+		}
+	}
+}
+
+// clock is the time source of the scheduler, replaced in tests
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the clock the service runs on
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// schedule calls run with c every interval, moved by up to jitter (a fraction
+// of the interval) either way, until ctx is done. Runs are sequential, so a
+// slow run delays the next one instead of overlapping it, and a run still
+// going after a whole interval is cancelled.
+func schedule(ctx context.Context, c check, jitter float64, clk clock, run func(context.Context, check)) {
+	// Spread the first runs so the checks do not all query at once
+	wait := time.Duration(rand.Float64() * jitter * float64(c.interval))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(wait):
+		}
+		// select picks either when both are ready
+		if ctx.Err() != nil {
+			return
+		}
+
+		start := clk.Now()
+		runCtx, cancel := context.WithDeadline(ctx, start.Add(c.interval))
+		run(runCtx, c)
+		cancel()
+
+		elapsed := clk.Now().Sub(start)
+		wait = c.interval + time.Duration((2*rand.Float64()-1)*jitter*float64(c.interval)) - elapsed
+		if wait < 0 {
+			log.Printf("%s check took %s, longer than its %s interval", c.name, elapsed.Round(time.Millisecond), c.interval)
+			wait = 0
+		}
+	}
+}
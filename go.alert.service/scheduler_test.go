@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock moves time forward by each wait as soon as it is asked for, so
+// schedule runs without sleeping
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.waits = append(f.waits, d)
+	f.now = f.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- f.now
+	return ch
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestScheduleCadence(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		interval time.Duration
+		runTime  time.Duration // how long each run takes
+		want     []time.Duration
+	}{
+		{"fast runs", time.Minute, 0, []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute}},
+		{"slow runs keep the cadence", 5 * time.Minute, 2 * time.Minute, []time.Duration{0, 5 * time.Minute, 10 * time.Minute}},
+		{"overrunning runs follow on", time.Minute, 90 * time.Second, []time.Duration{0, 90 * time.Second, 3 * time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			clk := &fakeClock{now: start}
+
+			var got []time.Duration
+			run := func(runCtx context.Context, c check) {
+				now := clk.Now()
+				got = append(got, now.Sub(start))
+				if deadline, ok := runCtx.Deadline(); !ok || !deadline.Equal(now.Add(tt.interval)) {
+					t.Errorf("run %d: got deadline %v, want %v", len(got), deadline, now.Add(tt.interval))
+				}
+				clk.advance(tt.runTime)
+				if len(got) == len(tt.want) {
+					cancel()
+				}
+			}
+			schedule(ctx, check{name: "test", interval: tt.interval}, 0, clk, run)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got runs at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := &fakeClock{now: time.Now()}
+	interval, jitter := time.Minute, 0.5
+
+	runs := 0
+	schedule(ctx, check{name: "test", interval: interval}, jitter, clk, func(context.Context, check) {
+		if runs++; runs == 100 {
+			cancel()
+		}
+	})
+
+	if len(clk.waits) != 101 {
+		t.Fatalf("got %d waits, want 101", len(clk.waits))
+	}
+	if first := clk.waits[0]; first < 0 || first >= 30*time.Second {
+		t.Errorf("got first wait %s, want up to 30s", first)
+	}
+	for i, wait := range clk.waits[1:] {
+		if wait < 30*time.Second || wait > 90*time.Second {
+			t.Errorf("wait %d: got %s, want 30s to 90s", i+1, wait)
+		}
+	}
+}
+
+func TestScheduleCancelsSlowRuns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var errs []error
+	schedule(ctx, check{name: "test", interval: 20 * time.Millisecond}, 0, systemClock{}, func(runCtx context.Context, c check) {
+		<-runCtx.Done()
+		if errs = append(errs, runCtx.Err()); len(errs) == 2 {
+			cancel()
+		}
+	})
+
+	for i, err := range errs {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("run %d: got %v, want %v", i+1, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestScheduleStopsOnCancel(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		block bool // whether the run waits for its context
+	}{
+		{"while waiting", false},
+		{"while running", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			started := make(chan struct{}, 10)
+			var runErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				schedule(ctx, check{name: "test", interval: time.Hour}, 0, systemClock{}, func(runCtx context.Context, c check) {
+					started <- struct{}{}
+					if tt.block {
+						<-runCtx.Done()
+						runErr = runCtx.Err()
+					}
+				})
+			}()
+
+			<-started
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("schedule did not return after cancel")
+			}
+			if len(started) != 0 {
+				t.Errorf("got %d more runs after cancel, want none", len(started))
+			}
+			if tt.block && !errors.Is(runErr, context.Canceled) {
+				t.Errorf("got run error %v, want %v", runErr, context.Canceled)
+			}
+		})
+	}
+}
+
+func TestSetCheckIntervals(t *testing.T) {
+	t.Setenv("PUMP_CHECK_INTERVAL", "30s")
+	t.Setenv("OFFLINE_CHECK_INTERVAL", "")
+	checks := []check{{name: "offline"}, {name: "temperature"}, {name: "pump"}}
+	if err := setCheckIntervals(checks, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []time.Duration{5 * time.Minute, 5 * time.Minute, 30 * time.Second} {
+		if checks[i].interval != want {
+			t.Errorf("%s: got interval %s, want %s", checks[i].name, checks[i].interval, want)
+		}
+	}
+
+	t.Setenv("TEMPERATURE_CHECK_INTERVAL", "often")
+	if err := setCheckIntervals(checks, 5*time.Minute); err == nil {
+		t.Error("invalid TEMPERATURE_CHECK_INTERVAL: got no error")
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	s := &alertService{
+		prefs: []AlertPreference{
+			{UserId: "u1", Location: "freezer", Enabled: true},
+			{UserId: "u1", Location: "fridge", Enabled: false},
+			{UserId: "u2", Location: "pump", Enabled: true},
+		},
+		prefsLoaded: time.Now(),
+		prefsMaxAge: time.Hour,
+	}
+
+	var got []string
+	record := func(name string, fail string) check {
+		return check{name: name, run: func(_ context.Context, pref AlertPreference, _ time.Time) (*alert, error) {
+			got = append(got, name+" "+pref.Location)
+			if pref.Location == fail {
+				return nil, errors.New("no data")
+			}
+			return nil, nil
+		}}
+	}
+	s.runOnce(context.Background(), []check{record("offline", "freezer"), record("temperature", "")})
+
+	want := []string{"offline freezer", "offline pump", "temperature freezer", "temperature pump"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got runs %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSMSAPIURL      = "https://api.twilio.com"
+	defaultSMSMaxLength   = 160 // one GSM-7 segment
+	defaultSMSKinds       = "temperature,pump"
+	defaultSMSNumberLimit = 5  // per number per hour
+	defaultSMSTotalLimit  = 50 // across all numbers per day
+	minSMSMaxLength       = 20
+)
+
+// smsNotifier texts critical alerts to the user's phone through a gateway
+// with Twilio's Messages API, so a local stand-in can take its place. Only
+// firing alerts of the kinds in SMS_KINDS are sent, cut to the segments of
+// SMS_MAX_LENGTH characters and rate limited to keep costs bounded.
+type smsNotifier struct {
+	apiURL     string
+	accountSID string
+	authToken  string
+	from       string
+	maxLength  int
+	kinds      map[string]bool
+	sent       smsCounter
+	perNumber  int // texts per number per hour, 0 for no limit
+	total      int // texts across all numbers per day, 0 for no limit
+}
+
+// smsCounter counts the texts recorded as sent, so the rate limits hold
+// across restarts and --once runs
+type smsCounter interface {
+	// countSentSMS returns the texts sent to phone since numberSince and
+	// the texts sent to any number since totalSince
+	countSentSMS(ctx context.Context, phone string, numberSince, totalSince time.Time) (toNumber, total int, err error)
+}
+
+// newSMSNotifierFromEnv reads the SMS_* settings. Without SMS_ACCOUNT_SID the
+// notifier is still registered, but every send fails.
+func newSMSNotifierFromEnv(sent smsCounter) (*smsNotifier, error) {
+	sms := &smsNotifier{
+		apiURL:     strings.TrimSuffix(os.Getenv("SMS_API_URL"), "/"),
+		accountSID: os.Getenv("SMS_ACCOUNT_SID"),
+		authToken:  os.Getenv("SMS_AUTH_TOKEN"),
+		from:       os.Getenv("SMS_FROM"),
+		kinds:      map[string]bool{},
+		sent:       sent,
+	}
+	if sms.apiURL == "" {
+		sms.apiURL = defaultSMSAPIURL
+	}
+	var err error
+	if sms.maxLength, err = intEnv("SMS_MAX_LENGTH", defaultSMSMaxLength); err != nil {
+		return nil, err
+	}
+	if sms.maxLength < minSMSMaxLength {
+		return nil, fmt.Errorf("invalid SMS_MAX_LENGTH %d: must be at least %d", sms.maxLength, minSMSMaxLength)
+	}
+	kinds := os.Getenv("SMS_KINDS")
+	if kinds == "" {
+		kinds = defaultSMSKinds
+	}
+	for _, kind := range strings.Split(kinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			sms.kinds[kind] = true
+		}
+	}
+	if sms.perNumber, err = intEnv("SMS_RATE_LIMIT", defaultSMSNumberLimit); err != nil {
+		return nil, err
+	}
+	if sms.total, err = intEnv("SMS_DAILY_LIMIT", defaultSMSTotalLimit); err != nil {
+		return nil, err
+	}
+	return sms, nil
+}
+
+func (sms *smsNotifier) Channel() string { return channelSMS }
+
+func (sms *smsNotifier) Send(ctx context.Context, pref AlertPreference, n Notification) error {
+	if n.State != stateFiring || !sms.kinds[n.Kind] {
+		return errNotCritical
+	}
+	if !pref.Phone.Valid || pref.Phone.String == "" {
+		return errNoRecipient
+	}
+	if sms.accountSID == "" {
+		return errors.New("sms: SMS_ACCOUNT_SID is not set")
+	}
+	if sms.perNumber > 0 || sms.total > 0 {
+		now := time.Now()
+		toNumber, total, err := sms.sent.countSentSMS(ctx, pref.Phone.String, now.Add(-time.Hour), now.Add(-24*time.Hour))
+		if err != nil {
+			return fmt.Errorf("sms: counting sent texts: %w", err)
+		}
+		if (sms.perNumber > 0 && toNumber >= sms.perNumber) || (sms.total > 0 && total >= sms.total) {
+			return errRateLimited
+		}
+	}
+
+	form := url.Values{
+		"To":   {pref.Phone.String},
+		"From": {sms.from},
+		"Body": {fitSMS(n.Title+"\n"+n.Message, sms.maxLength)},
+	}
+	target := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", sms.apiURL, url.PathEscape(sms.accountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("sms: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(sms.accountSID, sms.authToken)
+	if err := do(req); err != nil {
+		return fmt.Errorf("sms: %w", err)
+	}
+	return nil
+}
+
+// gsm7Basic and gsm7Extended are the GSM 03.38 default alphabet and its
+// extension table, whose characters take two septets. Text using any other
+// character is sent as UCS-2.
+const (
+	gsm7Basic    = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsm7Extended = "\f^{}\\[~]|€"
+)
+
+// Characters per segment of a single text and of each part of a longer one
+const (
+	gsm7Single = 160
+	gsm7Part   = 153
+	ucs2Single = 70
+	ucs2Part   = 67
+)
+
+// gsm7Units returns the septets r takes in GSM-7, or 0 if it needs UCS-2
+func gsm7Units(r rune) int {
+	switch {
+	case strings.ContainsRune(gsm7Basic, r):
+		return 1
+	case strings.ContainsRune(gsm7Extended, r):
+		return 2
+	}
+	return 0
+}
+
+// ucs2Units returns the UTF-16 code units r takes in UCS-2
+func ucs2Units(r rune) int {
+	if r > 0xFFFF {
+		return 2
+	}
+	return 1
+}
+
+// fitSMS cuts s to the segments that maxLength GSM-7 characters take, marking
+// the cut with "...". Text that needs UCS-2, such as one with "°", gets the
+// 70 characters of a UCS-2 segment instead of 160, or 67 per part when
+// maxLength spans several segments.
+func fitSMS(s string, maxLength int) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return gsm7Units(r) == 0 }) {
+		return truncate(s, maxLength, gsm7Units)
+	}
+	limit := ucs2Single
+	if maxLength > gsm7Single {
+		limit = (maxLength + gsm7Part - 1) / gsm7Part * ucs2Part
+	}
+	return truncate(s, min(limit, maxLength), ucs2Units)
+}
+
+// truncate cuts s to at most max units as counted by size, marking the cut
+// with "..."
+func truncate(s string, max int, size func(rune) int) string {
+	total := 0
+	for _, r := range s {
+		total += size(r)
+	}
+	if total <= max {
+		return s
+	}
+	used, end := 0, 0
+	for i, r := range s {
+		if used+size(r) > max-3 {
+			break
+		}
+		used += size(r)
+		end = i + utf8.RuneLen(r)
+	}
+	return strings.TrimSpace(s[:end]) + "..."
+}
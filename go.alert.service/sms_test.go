@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+func TestGSM7Units(t *testing.T) {
+	for r, want := range map[rune]int{'a': 1, 'Z': 1, '0': 1, '\n': 1, 'é': 1, '£': 1, '€': 2, '[': 2, '^': 2, '°': 0, 'ê': 0, '😀': 0} {
+		if got := gsm7Units(r); got != want {
+			t.Errorf("gsm7Units(%q) = %d, want %d", r, got, want)
+		}
+	}
+}
+
+func TestFitSMS(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         string
+		maxLength int
+		want      string
+	}{
+		{"ASCII that fits", "Freezer is warm", 160, "Freezer is warm"},
+		{"ASCII at the limit", strings.Repeat("a", 160), 160, strings.Repeat("a", 160)},
+		{"ASCII over the limit", strings.Repeat("a", 161), 160, strings.Repeat("a", 157) + "..."},
+		{"trailing space before the cut", strings.Repeat("a", 156) + "  bbbb", 160, strings.Repeat("a", 156) + "..."},
+		// "°" is not in GSM-7, so the whole text is sent as UCS-2
+		{"degree sign forces UCS-2", "Freezer 10°F " + strings.Repeat("a", 60), 160, "Freezer 10°F " + strings.Repeat("a", 54) + "..."},
+		{"UCS-2 that fits", "10°F", 160, "10°F"},
+		// "€" and "[" take two septets each
+		{"euro at the limit", strings.Repeat("€", 80), 160, strings.Repeat("€", 80)},
+		{"euro over the limit", strings.Repeat("€", 81), 160, strings.Repeat("€", 78) + "..."},
+		{"brackets over the limit", strings.Repeat("[", 81), 160, strings.Repeat("[", 78) + "..."},
+		// Characters outside the BMP take two UTF-16 units and are never split
+		{"surrogate pairs", strings.Repeat("😀", 40), 160, strings.Repeat("😀", 33) + "..."},
+		{"surrogate pair at the cut", strings.Repeat("a", 66) + "😀😀😀", 160, strings.Repeat("a", 66) + "..."},
+		// Longer limits span several segments of 153 septets or 67 UCS-2 units
+		{"ASCII over two segments", strings.Repeat("a", 400), 306, strings.Repeat("a", 303) + "..."},
+		{"UCS-2 over two segments", "°" + strings.Repeat("a", 200), 306, "°" + strings.Repeat("a", 130) + "..."},
+		{"UCS-2 under a short limit", "°" + strings.Repeat("a", 100), 40, "°" + strings.Repeat("a", 36) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitSMS(tt.s, tt.maxLength)
+			if got != tt.want {
+				t.Errorf("fitSMS = %q (%d runes), want %q (%d runes)", got, utf8.RuneCountInString(got), tt.want, utf8.RuneCountInString(tt.want))
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("fitSMS split a character: %q", got)
+			}
+		})
+	}
+}
+
+func TestTruncateUnits(t *testing.T) {
+	s := strings.Repeat("😀", 10)
+	got := truncate(s, 9, ucs2Units)
+	if units := len(utf16.Encode([]rune(got))); units > 9 {
+		t.Errorf("truncate(%q, 9) = %q, %d UTF-16 units", s, got, units)
+	}
+	if got != "😀😀😀..." {
+		t.Errorf("truncate(%q, 9) = %q, want three emoji and ...", s, got)
+	}
+}
+
+// fakeSMSCounter returns fixed counts and records what it was asked
+type fakeSMSCounter struct {
+	toNumber, total int
+	err             error
+	phone           string
+	numberSince     time.Time
+	totalSince      time.Time
+}
+
+func (c *fakeSMSCounter) countSentSMS(_ context.Context, phone string, numberSince, totalSince time.Time) (int, int, error) {
+	c.phone, c.numberSince, c.totalSince = phone, numberSince, totalSince
+	return c.toNumber, c.total, c.err
+}
+
+func TestSMSSend(t *testing.T) {
+	type request struct {
+		path, user, password string
+		to, from, body       string
+	}
+	var requests []request
+	status := http.StatusCreated
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		r.ParseForm()
+		requests = append(requests, request{r.URL.Path, user, password, r.PostForm.Get("To"), r.PostForm.Get("From"), r.PostForm.Get("Body")})
+		w.WriteHeader(status)
+	}))
+	defer gateway.Close()
+
+	pref := AlertPreference{UserId: "u1", Phone: sql.NullString{String: "+15550100", Valid: true}}
+	firing := Notification{Kind: "temperature", State: stateFiring, Title: "Freezer is warm", Message: "Freezer at 20°F"}
+	tests := []struct {
+		name      string
+		pref      AlertPreference
+		n         Notification
+		counter   fakeSMSCounter
+		perNumber int
+		total     int
+		status    int
+		wantErr   error // nil for success, errAny for any other error
+		wantSent  bool
+	}{
+		{name: "sends", pref: pref, n: firing, counter: fakeSMSCounter{toNumber: 4, total: 49}, perNumber: 5, total: 50, wantSent: true},
+		{name: "per number limit", pref: pref, n: firing, counter: fakeSMSCounter{toNumber: 5}, perNumber: 5, total: 50, wantErr: errRateLimited},
+		{name: "daily limit", pref: pref, n: firing, counter: fakeSMSCounter{total: 50}, perNumber: 5, total: 50, wantErr: errRateLimited},
+		{name: "no limits", pref: pref, n: firing, counter: fakeSMSCounter{err: errors.New("not asked")}, wantSent: true},
+		{name: "counting fails", pref: pref, n: firing, counter: fakeSMSCounter{err: errors.New("db down")}, perNumber: 5, wantErr: errAny},
+		{name: "resolved", pref: pref, n: Notification{Kind: "temperature", State: stateResolved}, wantErr: errNotCritical},
+		{name: "other kind", pref: pref, n: Notification{Kind: "offline", State: stateFiring}, wantErr: errNotCritical},
+		{name: "no phone", pref: AlertPreference{UserId: "u1"}, n: firing, wantErr: errNoRecipient},
+		{name: "gateway fails", pref: pref, n: firing, status: http.StatusInternalServerError, wantErr: errAny, wantSent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, status = nil, http.StatusCreated
+			if tt.status != 0 {
+				status = tt.status
+			}
+			counter := tt.counter
+			sms := &smsNotifier{apiURL: gateway.URL, accountSID: "AC1", authToken: "secret", from: "+15550199", maxLength: 160,
+				kinds: map[string]bool{"temperature": true, "pump": true}, sent: &counter, perNumber: tt.perNumber, total: tt.total}
+
+			err := sms.Send(context.Background(), tt.pref, tt.n)
+			switch {
+			case tt.wantErr == errAny && err == nil:
+				t.Error("Send succeeded, want an error")
+			case tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Errorf("Send = %v, want %v", err, tt.wantErr)
+			}
+			if sent := len(requests) > 0; sent != tt.wantSent {
+				t.Fatalf("sent %d requests, want sent %v", len(requests), tt.wantSent)
+			}
+			if !tt.wantSent {
+				return
+			}
+			want := request{"/2010-04-01/Accounts/AC1/Messages.json", "AC1", "secret", "+15550100", "+15550199", "Freezer is warm\nFreezer at 20°F"}
+			if requests[0] != want {
+				t.Errorf("sent %+v, want %+v", requests[0], want)
+			}
+			if tt.perNumber > 0 && (counter.phone != "+15550100" || time.Since(counter.numberSince) < time.Hour-time.Minute || time.Since(counter.totalSince) < 24*time.Hour-time.Minute) {
+				t.Errorf("counted texts to %s since %s and %s, want the last hour and day", counter.phone, counter.numberSince, counter.totalSince)
+			}
+		})
+	}
+}
+
+// errAny matches any error in the tables above
+var errAny = errors.New("any error")
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Alert states, stored in alert_state
+const (
+	stateFiring   = "firing"
+	stateResolved = "resolved"
+)
+
+const resolvedPriority = 5
+
+// alert is what a check found for one preference. When the condition holds,
+// title and message describe the alert; otherwise they announce that it
+// cleared and are only sent if the alert was firing.
+type alert struct {
+	firing    bool
+	value     sql.NullFloat64 // the reading the check looked at, if any
+	threshold sql.NullFloat64 // the threshold it was compared with
+	title     string
+	message   string
+	priority  int    // Gotify priority of the alert
+	summary   string // logged instead of the whole alert once sent
+}
+
+// AlertState is the last known state of one kind of alert (a check name) for
+// a user's location
+type AlertState struct {
+	UserId     string          `db:"userId"`
+	Location   string          `db:"location"`
+	Kind       string          `db:"kind"`
+	State      string          `db:"state"`
+	Value      sql.NullFloat64 `db:"value"`
+	Since      time.Time       `db:"since"`      // when the alert started firing or resolved
+	NotifiedAt sql.NullTime    `db:"notifiedAt"` // last notification delivered while firing
+}
+
+func (s *alertService) loadAlertState(ctx context.Context, pref AlertPreference, kind string) (*AlertState, error) {
+	var st AlertState
+	err := s.homeiotaDB.GetContext(ctx, &st, `SELECT "userId", location, kind, state, value, since, "notifiedAt" FROM alert_state WHERE "userId" = $1 AND location = $2 AND kind = $3`,
+		pref.UserId, pref.Location, kind)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *alertService) saveAlertState(ctx context.Context, st *AlertState) error {
+	_, err := s.homeiotaDB.NamedExecContext(ctx, `INSERT INTO alert_state ("userId", location, kind, state, value, since, "notifiedAt")
+		VALUES (:userId, :location, :kind, :state, :value, :since, :notifiedAt)
+		ON CONFLICT ("userId", location, kind) DO UPDATE
+		SET state = EXCLUDED.state, value = EXCLUDED.value, since = EXCLUDED.since, "notifiedAt" = EXCLUDED."notifiedAt"`, st)
+	return err
+}
+
+// alertTransition applies what a check found to the stored state of an alert,
+// nil if it never fired. It returns the notification that is due, stateFiring
+// or stateResolved ("" for none), and the state to save once it has been
+// delivered, nil when there is nothing to record. The alert is due when it
+// starts firing, again every renotifyInterval while it keeps firing (never if
+// that is 0) or until a notification was delivered, and "resolved" is due
+// when it clears.
+func alertTransition(st *AlertState, pref AlertPreference, kind string, firing bool, value sql.NullFloat64, renotifyInterval time.Duration, now time.Time) (send string, next *AlertState) {
+	wasFiring := st != nil && st.State == stateFiring
+	switch {
+	case firing && !wasFiring:
+		next = &AlertState{UserId: pref.UserId, Location: pref.Location, Kind: kind, State: stateFiring, Since: now}
+		send = stateFiring
+	case firing:
+		next = new(AlertState)
+		*next = *st
+		if !st.NotifiedAt.Valid || renotifyInterval > 0 && !st.NotifiedAt.Time.After(now.Add(-renotifyInterval)) {
+			send = stateFiring
+		}
+	case wasFiring:
+		next = new(AlertState)
+		*next = *st
+		next.State, next.Since, next.NotifiedAt = stateResolved, now, sql.NullTime{}
+		send = stateResolved
+	default:
+		return "", nil // nothing to record until it fires
+	}
+	if send == stateFiring {
+		next.NotifiedAt = sql.NullTime{Time: now, Valid: true}
+	}
+	next.Value = value
+	return send, next
+}
+
+// notify applies what a check found to the stored state of the alert and
+// sends what alertTransition says is due. An alert no channel delivered is
+// sent again on the next run, and an undelivered "resolved" notification
+// leaves the alert firing so it is retried too.
+func (s *alertService) notify(ctx context.Context, pref AlertPreference, kind string, a alert, now time.Time) error {
+	st, err := s.loadAlertState(ctx, pref, kind)
+	if err != nil {
+		// Better a repeated alert than a missed one
+		log.Printf("Failed to load %s alert state of %s for user %s, alerting anyway: %v", kind, pref.Location, pref.UserId, err)
+		if a.firing {
+			return s.deliver(ctx, pref, kind, stateFiring, a, now)
+		}
+		return nil
+	}
+
+	send, next := alertTransition(st, pref, kind, a.firing, a.value, s.renotifyInterval, now)
+	if next == nil {
+		return nil
+	}
+	var deliverErr error
+	switch send {
+	case stateFiring:
+		if deliverErr = s.deliver(ctx, pref, kind, stateFiring, a, now); deliverErr != nil {
+			next.NotifiedAt = sql.NullTime{}
+			if st != nil && st.State == stateFiring {
+				next.NotifiedAt = st.NotifiedAt
+			}
+		}
+	case stateResolved:
+		a.priority = resolvedPriority
+		a.summary = fmt.Sprintf("Resolved %s alert: %s", kind, pref.Location)
+		if err := s.deliver(ctx, pref, kind, stateResolved, a, now); err != nil {
+			return err
+		}
+	}
+	if err := s.saveAlertState(ctx, next); err != nil {
+		return err
+	}
+	return deliverErr
+}
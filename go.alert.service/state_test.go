@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestAlertTransition(t *testing.T) {
+	pref := AlertPreference{UserId: "u1", Location: "freezer"}
+	now := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) sql.NullTime { return sql.NullTime{Time: now.Add(-ago), Valid: true} }
+	firing := func(since, notified time.Duration) *AlertState {
+		return &AlertState{UserId: "u1", Location: "freezer", Kind: "temperature", State: stateFiring, Since: now.Add(-since), NotifiedAt: at(notified)}
+	}
+	resolved := &AlertState{UserId: "u1", Location: "freezer", Kind: "temperature", State: stateResolved, Since: now.Add(-time.Minute)}
+
+	tests := []struct {
+		name     string
+		st       *AlertState
+		firing   bool
+		renotify time.Duration
+		send     string
+		want     *AlertState // nil when nothing is saved
+	}{
+		{
+			name: "starts firing", firing: true, renotify: time.Hour, send: stateFiring,
+			want: &AlertState{State: stateFiring, Since: now, NotifiedAt: at(0)},
+		},
+		{
+			name: "repeat within the window", st: firing(2*time.Hour, 30*time.Minute), firing: true, renotify: time.Hour,
+			want: &AlertState{State: stateFiring, Since: now.Add(-2 * time.Hour), NotifiedAt: at(30 * time.Minute)},
+		},
+		{
+			name: "renotify after the window", st: firing(2*time.Hour, time.Hour), firing: true, renotify: time.Hour, send: stateFiring,
+			want: &AlertState{State: stateFiring, Since: now.Add(-2 * time.Hour), NotifiedAt: at(0)},
+		},
+		{
+			name: "renotify disabled", st: firing(48*time.Hour, 48*time.Hour), firing: true,
+			want: &AlertState{State: stateFiring, Since: now.Add(-48 * time.Hour), NotifiedAt: at(48 * time.Hour)},
+		},
+		{
+			name: "never delivered", st: &AlertState{UserId: "u1", Location: "freezer", Kind: "temperature", State: stateFiring, Since: now.Add(-time.Minute)}, firing: true, renotify: time.Hour, send: stateFiring,
+			want: &AlertState{State: stateFiring, Since: now.Add(-time.Minute), NotifiedAt: at(0)},
+		},
+		{
+			name: "resolves", st: firing(2*time.Hour, 30*time.Minute), renotify: time.Hour, send: stateResolved,
+			want: &AlertState{State: stateResolved, Since: now},
+		},
+		{name: "stays resolved", st: resolved, renotify: time.Hour},
+		{name: "never fired", renotify: time.Hour},
+		{
+			// A new episode, alerted at once however recently the last one was
+			name: "flaps back to firing", st: resolved, firing: true, renotify: time.Hour, send: stateFiring,
+			want: &AlertState{State: stateFiring, Since: now, NotifiedAt: at(0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := sql.NullFloat64{Float64: 12.5, Valid: true}
+			send, next := alertTransition(tt.st, pref, "temperature", tt.firing, value, tt.renotify, now)
+			if send != tt.send {
+				t.Errorf("send = %q, want %q", send, tt.send)
+			}
+			if tt.want == nil {
+				if next != nil {
+					t.Errorf("saves %+v, want nothing", next)
+				}
+				return
+			}
+			if next == nil {
+				t.Fatal("saves nothing")
+			}
+			if next.UserId != "u1" || next.Location != "freezer" || next.Kind != "temperature" || next.Value != value {
+				t.Errorf("saves %+v for the wrong alert or value", next)
+			}
+			if next.State != tt.want.State || !next.Since.Equal(tt.want.Since) || next.NotifiedAt != tt.want.NotifiedAt {
+				t.Errorf("saves state %s since %s notified %v, want %s since %s notified %v",
+					next.State, next.Since, next.NotifiedAt, tt.want.State, tt.want.Since, tt.want.NotifiedAt)
+			}
+		})
+	}
+}
+
+func TestAlertTransitionDoesNotChangeState(t *testing.T) {
+	now := time.Now()
+	st := &AlertState{State: stateFiring, Since: now.Add(-time.Hour)}
+	alertTransition(st, AlertPreference{}, "temperature", false, sql.NullFloat64{}, time.Hour, now)
+	if st.State != stateFiring || st.NotifiedAt.Valid {
+		t.Errorf("the loaded state was changed to %+v", st)
+	}
+}
+
+// TestAlertTransitionFlapping runs a condition that clears and returns
+// through the transitions, saving each state as notify does
+func TestAlertTransitionFlapping(t *testing.T) {
+	start := time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+	var st *AlertState
+	var sent []string
+	for i, firing := range []bool{true, true, false, true, false, false, true} {
+		send, next := alertTransition(st, AlertPreference{UserId: "u1", Location: "freezer"}, "temperature", firing, sql.NullFloat64{},
+			time.Hour, start.Add(time.Duration(i)*time.Minute))
+		if send != "" {
+			sent = append(sent, send)
+		}
+		if next != nil {
+			st = next
+		}
+	}
+	want := []string{stateFiring, stateResolved, stateFiring, stateResolved, stateFiring}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("sent %v, want %v", sent, want)
+		}
+	}
+	if !st.Since.Equal(start.Add(6 * time.Minute)) {
+		t.Errorf("the last episode started at %s, want %s", st.Since, start.Add(6*time.Minute))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	minAggregateBucket  = time.Minute
+	maxAggregateBuckets = 10000          // upper bound on buckets returned per request
+	defaultAggregateAge = 24 * time.Hour // range used when from is not given
+)
+
+// TemperatureAggregate summarizes the temperature readings of one location in one time bucket
+type TemperatureAggregate struct {
+	Bucket   time.Time `json:"bucket"`   // Start of the bucket
+	Location string    `json:"location"` // e.g., "freezer", "living room"
+	Min      float64   `json:"min"`
+	Max      float64   `json:"max"`
+	Avg      float64   `json:"avg"`
+	Count    int       `json:"count"` // Number of readings in the bucket
+
+	// Humidity statistics, omitted when no reading in the bucket had humidity
+	MinHumidity *float64 `json:"min_humidity,omitempty"`
+	MaxHumidity *float64 `json:"max_humidity,omitempty"`
+	AvgHumidity *float64 `json:"avg_humidity,omitempty"`
+	AvgDewPoint *float64 `json:"avg_dew_point,omitempty"`
+}
+
+// aggregateQuery selects the readings rolled up by the aggregate endpoints
+type aggregateQuery struct {
+	Bucket   time.Duration
+	From, To time.Time
+	Location string // temperatures only, empty for every location
+}
+
+// PumpAggregate summarizes the pump run time samples in one time bucket
+type PumpAggregate struct {
+	Bucket          time.Time `json:"bucket"`      // Start of the bucket
+	MinCurrent      float64   `json:"min_current"` // current in amps
+	MaxCurrent      float64   `json:"max_current"`
+	AvgCurrent      float64   `json:"avg_current"`
+	MaxRunTime      int       `json:"max_run_time"`      // Longest run time seen, in seconds
+	LowCurrentCount int       `json:"low_current_count"` // Samples flagged as low current
+	Count           int       `json:"count"`             // Number of samples in the bucket
+}
+
+// parseBucket accepts Go durations (5m, 1h) plus a day suffix (1d, 7d)
+func parseBucket(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fieldErrorf("bucket", "is required, e.g. 5m, 1h or 1d")
+	}
+	d, err := parseDayDuration(s)
+	if err != nil {
+		return 0, fieldErrorf("bucket", "must be a duration such as 5m, 1h or 1d")
+	}
+	if d < minAggregateBucket || d%time.Second != 0 {
+		return 0, fieldErrorf("bucket", "must be a whole number of seconds and at least %s", minAggregateBucket)
+	}
+	return d, nil
+}
+
+// parseAggregateParams reads bucket, from, to and location, defaulting the
+// range to the last day
+func parseAggregateParams(q url.Values) (aggregateQuery, error) {
+	a := aggregateQuery{Location: q.Get("location")}
+	var err error
+	if a.Bucket, err = parseBucket(q.Get("bucket")); err != nil {
+		return a, err
+	}
+	if a.From, a.To, err = parseTimeRange(q); err != nil {
+		return a, err
+	}
+	if a.To.IsZero() {
+		a.To = time.Now()
+	}
+	if a.From.IsZero() {
+		a.From = a.To.Add(-defaultAggregateAge)
+	}
+	if !a.From.Before(a.To) {
+		return a, fmt.Errorf("from must be before to")
+	}
+	if a.To.Sub(a.From)/a.Bucket > maxAggregateBuckets {
+		return a, fmt.Errorf("range too large for bucket %s: at most %d buckets", q.Get("bucket"), maxAggregateBuckets)
+	}
+	return a, nil
+}
+
+// aggregateRollup names the continuous aggregates a bucket can be rolled up
+// from, "daily" for whole days and "hourly" for whole hours, with their bucket
+// width. Other buckets are computed from the raw readings.
+func aggregateRollup(bucket time.Duration) (string, time.Duration) {
+	switch {
+	case bucket%(24*time.Hour) == 0:
+		return "daily", 24 * time.Hour
+	case bucket%time.Hour == 0:
+		return "hourly", time.Hour
+	}
+	return "", 0
+}
+
+// intervalArg renders a duration as a PostgreSQL interval literal for time_bucket
+func intervalArg(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d/time.Second))
+}
+
+func handleTemperatureAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAggregateParams(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	ctx := context.Background()
+
+	aggregates, err := store.AggregateTemperatures(ctx, q)
+	if err != nil {
+		writeError(w, "Failed to aggregate temperatures", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregates)
+}
+
+func handlePumpAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAggregateParams(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	q.Location = ""
+	ctx := context.Background()
+
+	aggregates, err := store.AggregatePumpRunTimes(ctx, q)
+	if err != nil {
+		writeError(w, "Failed to aggregate pump run times", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregates)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTemperatureAggregate(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+	humidity := 40.0
+	s.temperatures = []TemperatureReading{
+		{ID: 1, Value: 10, Location: "freezer", Timestamp: base, Humidity: &humidity},
+		{ID: 2, Value: 20, Location: "freezer", Timestamp: base.Add(10 * time.Minute)},
+		{ID: 3, Value: 5, Location: "freezer", Timestamp: base.Add(70 * time.Minute)},
+		{ID: 4, Value: 60, Location: "garage", Timestamp: base.Add(5 * time.Minute)},
+	}
+	handler := http.HandlerFunc(handleTemperatureAggregate)
+
+	w := serve(handler, http.MethodGet, "/tempmon/aggregate?bucket=1h&location=freezer", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tempmon/aggregate = %d: %s", w.Code, w.Body)
+	}
+	var aggregates []TemperatureAggregate
+	decodeBody(t, w, &aggregates)
+	if len(aggregates) != 2 {
+		t.Fatalf("got %d buckets, want 2: %+v", len(aggregates), aggregates)
+	}
+	first := aggregates[0]
+	if !first.Bucket.Equal(base) || first.Count != 2 || first.Min != 10 || first.Max != 20 || first.Avg != 15 {
+		t.Errorf("first bucket = %+v, want 2 readings from 10 to 20 at %s", first, base)
+	}
+	if first.AvgHumidity == nil || *first.AvgHumidity != 40 || aggregates[1].AvgHumidity != nil {
+		t.Errorf("humidity = %v then %v, want 40 then none", first.AvgHumidity, aggregates[1].AvgHumidity)
+	}
+
+	decodeBody(t, serve(handler, http.MethodGet, "/tempmon/aggregate?bucket=1d", ""), &aggregates)
+	if len(aggregates) < 2 {
+		t.Errorf("got %d buckets for every location, want at least 2", len(aggregates))
+	}
+
+	for _, target := range []string{"/tempmon/aggregate", "/tempmon/aggregate?bucket=30s", "/tempmon/aggregate?bucket=1m&from=2020-01-01T00:00:00Z"} {
+		if w := serve(handler, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestPumpAggregate(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	s.runTimes = []PumpRunTime{
+		{ID: 1, RunTime: 2, Current: 8, Timestamp: base.Add(time.Minute)},
+		{ID: 2, RunTime: 4, Current: 6, LowCurrent: true, Timestamp: base.Add(2 * time.Minute)},
+		{ID: 3, RunTime: 2, Current: 7, Timestamp: base.Add(90 * time.Minute)},
+	}
+
+	w := serve(http.HandlerFunc(handlePumpAggregate), http.MethodGet, "/pumpmon/aggregate?bucket=1h", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /pumpmon/aggregate = %d: %s", w.Code, w.Body)
+	}
+	var aggregates []PumpAggregate
+	decodeBody(t, w, &aggregates)
+	if len(aggregates) != 2 {
+		t.Fatalf("got %d buckets, want 2: %+v", len(aggregates), aggregates)
+	}
+	want := PumpAggregate{Bucket: base, MinCurrent: 6, MaxCurrent: 8, AvgCurrent: 7, MaxRunTime: 4, LowCurrentCount: 1, Count: 2}
+	if got := aggregates[0]; !got.Bucket.Equal(want.Bucket) || got.MinCurrent != want.MinCurrent || got.MaxCurrent != want.MaxCurrent ||
+		got.AvgCurrent != want.AvgCurrent || got.MaxRunTime != want.MaxRunTime || got.LowCurrentCount != want.LowCurrentCount || got.Count != want.Count {
+		t.Errorf("first bucket = %+v, want %+v", got, want)
+	}
+}
+
+func TestTimeBucket(t *testing.T) {
+	for _, tc := range []struct {
+		width time.Duration
+		ts    string
+		want  string
+	}{
+		{time.Hour, "2026-03-04T10:59:59Z", "2026-03-04T10:00:00Z"},
+		{24 * time.Hour, "2026-03-04T10:00:00Z", "2026-03-04T00:00:00Z"},
+		// Weeks start on the Monday of TimescaleDB's origin
+		{7 * 24 * time.Hour, "2026-03-04T10:00:00Z", "2026-03-02T00:00:00Z"},
+		{15 * time.Minute, "1999-12-31T23:50:00Z", "1999-12-31T23:45:00Z"},
+	} {
+		ts, _ := time.Parse(time.RFC3339, tc.ts)
+		if got := timeBucket(tc.width, ts).Format(time.RFC3339); got != tc.want {
+			t.Errorf("timeBucket(%s, %s) = %s, want %s", tc.width, tc.ts, got, tc.want)
+		}
+	}
+}
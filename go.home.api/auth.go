@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// API key scopes
+const (
+	scopeDevice = "device" // write readings and heartbeats of one device
+	scopeRead   = "read"   // read everything
+	scopeAdmin  = "admin"  // everything, including deletes, devices and keys
+)
+
+// apiKeyPrefix marks issued keys so they are easy to recognize in configs
+const apiKeyPrefix = "hk_"
+
+// authDisabled turns off API key checks, set from api_auth=off
+var authDisabled bool
+
+// APIKey describes an issued key. The key itself is never stored.
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // First characters of the key, to tell keys apart
+	Scope      string     `json:"scope"`  // "device", "read" or "admin"
+	DeviceID   string     `json:"device_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// issuedAPIKey is returned once when a key is created
+type issuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+const apiKeyColumns = "id, name, prefix, scope, COALESCE(device_id, ''), created_at, last_used_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }, k *APIKey) error {
+	var lastUsed, revoked sql.NullTime
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scope, &k.DeviceID, &k.CreatedAt, &lastUsed, &revoked)
+	k.LastUsedAt, k.RevokedAt = nullTime(lastUsed), nullTime(revoked)
+	return err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIKey issues a new key. Device keys must name an active device.
+func createAPIKey(ctx context.Context, name, scope, deviceID string) (issuedAPIKey, error) {
+	var issued issuedAPIKey
+	switch {
+	case name == "":
+		return issued, errors.New("name is required")
+	case scope != scopeDevice && scope != scopeRead && scope != scopeAdmin:
+		return issued, errors.New("scope must be device, read or admin")
+	case scope == scopeDevice && deviceID == "":
+		return issued, errors.New("device keys require a device_id")
+	case scope != scopeDevice && deviceID != "":
+		return issued, errors.New("only device keys have a device_id")
+	}
+	if scope == scopeDevice {
+		d, err := store.GetDevice(ctx, deviceID)
+		if err == errNotFound || (err == nil && d.DecommissionedAt != nil) {
+			return issued, fmt.Errorf("device %q is not an active registered device", deviceID)
+		} else if err != nil {
+			return issued, err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return issued, err
+	}
+	issued.Key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	issued.APIKey = APIKey{Name: name, Prefix: issued.Key[:len(apiKeyPrefix)+6], Scope: scope, DeviceID: deviceID}
+	err := store.InsertAPIKey(ctx, &issued.APIKey, hashAPIKey(issued.Key))
+	return issued, err
+}
+
+// revokeAPIKey marks a key as revoked; it reports false if there is no such key
+func revokeAPIKey(ctx context.Context, id int) (bool, error) {
+	err := store.RevokeAPIKey(ctx, id)
+	if err == errNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func listAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return store.ListAPIKeys(ctx)
+}
+
+// lookupAPIKey returns the active key matching key, or nil. The last use is
+// recorded at most once a minute.
+func lookupAPIKey(ctx context.Context, key string) (*APIKey, error) {
+	k, err := store.APIKeyByHash(ctx, hashAPIKey(key))
+	if err == errNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) > time.Minute {
+		if err := store.TouchAPIKey(ctx, k.ID); err != nil {
+			log.Printf("Failed to record use of API key %d: %v", k.ID, err)
+		}
+	}
+	return &k, nil
+}
+
+// --- Middleware ---
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the key that authenticated r, or nil when auth is off
+func requestAPIKey(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return k
+}
+
+// ingestionPaths accept writes from device keys
+var ingestionPaths = map[string]bool{
+	"/tempmon":       true,
+	"/tempmon/batch": true,
+	"/pumpmon":       true,
+	"/pumpmon/batch": true,
+	"/heartbeat":     true,
+}
+
+// publicPaths are served without an API key, for container and load balancer
+// probes
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// allowedScopes lists the scopes allowed to make a request: reads need a
+// read key, device writes a device key, and everything else an admin key.
+// Admin keys are always allowed.
+func allowedScopes(r *http.Request) []string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/apikeys"):
+		return nil
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return []string{scopeRead}
+	case r.Method == http.MethodPost && ingestionPaths[r.URL.Path]:
+		return []string{scopeDevice}
+	default:
+		return nil
+	}
+}
+
+// requireAPIKey authenticates every request but those for publicPaths with a
+// key sent as "Authorization: Bearer <key>" or "X-API-Key: <key>", or for
+// /stream as the access_token query parameter
+func requireAPIKey(next http.Handler) http.Handler {
+	if authDisabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = strings.TrimSpace(bearer)
+		}
+		if key == "" && r.URL.Path == "/stream" {
+			// Browsers cannot set headers on an EventSource
+			key = r.URL.Query().Get("access_token")
+		}
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go.home.api"`)
+			writeError(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+
+		k, err := lookupAPIKey(r.Context(), key)
+		if err != nil {
+			writeError(w, "Failed to check API key", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if k == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go.home.api", error="invalid_token"`)
+			writeError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		allowed := k.Scope == scopeAdmin
+		for _, scope := range allowedScopes(r) {
+			allowed = allowed || k.Scope == scope
+		}
+		if !allowed {
+			writeError(w, fmt.Sprintf("API key with scope %q may not %s %s", k.Scope, r.Method, r.URL.Path), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	})
+}
+
+// --- Device key checks ---
+
+// deviceKey returns the device key that authenticated r, or nil for admin
+// keys and when auth is off
+func deviceKey(r *http.Request) *APIKey {
+	if k := requestAPIKey(r); k != nil && k.Scope == scopeDevice {
+		return k
+	}
+	return nil
+}
+
+// claimTemperature restricts a reading to the key's device and its location,
+// filling in whichever of the two the device left out
+func (k *APIKey) claimTemperature(devices *deviceIndex, reading *TemperatureReading) error {
+	if _, ok := devices.byID[k.DeviceID]; !ok {
+		return fmt.Errorf("device %q is decommissioned", k.DeviceID)
+	}
+	return devices.claimTemperature("API key", k.DeviceID, reading)
+}
+
+// claimPumpRunTime restricts a pump sample to the key's device
+func (k *APIKey) claimPumpRunTime(devices *deviceIndex, rt *PumpRunTime) error {
+	if rt.DeviceID == "" {
+		rt.DeviceID = k.DeviceID
+	}
+	if rt.DeviceID != k.DeviceID {
+		return fmt.Errorf("API key may only write samples of device %q", k.DeviceID)
+	}
+	if _, ok := devices.byID[k.DeviceID]; !ok {
+		return fmt.Errorf("device %q is decommissioned", k.DeviceID)
+	}
+	return nil
+}
+
+// --- API Key Handlers ---
+
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := listAPIKeys(ctx)
+		if err != nil {
+			writeError(w, "Failed to fetch API keys", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case http.MethodPost:
+		var req struct {
+			Name     string `json:"name"`
+			Scope    string `json:"scope"`
+			DeviceID string `json:"device_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		issued, err := createAPIKey(ctx, req.Name, req.Scope, req.DeviceID)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issued)
+	default:
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSingleAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Path[len("/apikeys/"):])
+	if err != nil {
+		writeError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := context.Background()
+
+	found, err := revokeAPIKey(ctx, id)
+	if err != nil {
+		writeError(w, "Failed to revoke API key", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	if !found {
+		writeError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runAPIKeyCommand implements `go.home.api apikey create <scope> <name> [device_id] | list | revoke <id>`
+func runAPIKeyCommand(ctx context.Context, args []string) error {
+	usage := errors.New("usage: go.home.api apikey create <device|read|admin> <name> [device_id] | list | revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 || len(args) > 4 {
+			return usage
+		}
+		deviceID := ""
+		if len(args) == 4 {
+			deviceID = args[3]
+		}
+		issued, err := createAPIKey(ctx, args[2], args[1], deviceID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %d (%s). Store it now, it is not shown again:\n%s\n", issued.ID, issued.Scope, issued.Key)
+		return nil
+	case "list":
+		keys, err := listAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPE\tDEVICE\tLAST USED\tSTATUS")
+		for _, k := range keys {
+			lastUsed, status := "never", "active"
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Format(time.RFC3339)
+			}
+			if k.RevokedAt != nil {
+				status = "revoked " + k.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, k.Scope, k.DeviceID, lastUsed, status)
+		}
+		return tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid key ID %q", args[1])
+		}
+		found, err := revokeAPIKey(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("no API key with ID %d", id)
+		}
+		fmt.Printf("Revoked API key %d\n", id)
+		return nil
+	default:
+		return fmt.Errorf("unknown apikey command %q", args[0])
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	s := useMemoryStore(t,
+		Device{ID: "freezer", Type: deviceTypeTemperature, Name: "Freezer", Location: "freezer", ExpectedInterval: 30},
+		Device{ID: "garage", Type: deviceTypeTemperature, Name: "Garage", Location: "garage", ExpectedInterval: 30},
+	)
+	ctx := context.Background()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tempmon", handleTemperatures)
+	mux.HandleFunc("/devices", handleDevices)
+	mux.HandleFunc("/apikeys", handleAPIKeys)
+	mux.HandleFunc("/apikeys/", handleSingleAPIKey)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	handler := requireAPIKey(mux)
+
+	issue := func(scope, deviceID string) string {
+		t.Helper()
+		issued, err := createAPIKey(ctx, scope+" key", scope, deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issued.Key
+	}
+	admin, read, device := issue(scopeAdmin, ""), issue(scopeRead, ""), issue(scopeDevice, "freezer")
+	if _, err := createAPIKey(ctx, "ghost", scopeDevice, "ghost"); err == nil {
+		t.Error("created a device key for an unregistered device")
+	}
+
+	tests := []struct {
+		method, target, body, key string
+		want                      int
+	}{
+		{http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{http.MethodGet, "/tempmon", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/tempmon", "", "hk_wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/tempmon", "", read, http.StatusOK},
+		{http.MethodPost, "/tempmon", `{"value": 1, "location": "freezer"}`, read, http.StatusForbidden},
+		{http.MethodGet, "/tempmon", "", device, http.StatusForbidden},
+		{http.MethodPost, "/tempmon", `{"value": 1}`, device, http.StatusCreated},
+		{http.MethodPost, "/tempmon", `{"value": 1, "location": "garage"}`, device, http.StatusForbidden},
+		{http.MethodPost, "/devices", `{"id": "pump", "type": "pump", "name": "Pump"}`, device, http.StatusForbidden},
+		{http.MethodPost, "/devices", `{"id": "pump", "type": "pump", "name": "Pump"}`, admin, http.StatusCreated},
+		{http.MethodGet, "/apikeys", "", read, http.StatusForbidden},
+		{http.MethodGet, "/apikeys", "", admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve(handler, tt.method, tt.target, tt.body, "Authorization", "Bearer "+tt.key); w.Code != tt.want {
+			t.Errorf("%s %s %s with %.9q = %d, want %d: %s", tt.method, tt.target, tt.body, tt.key, w.Code, tt.want, w.Body)
+		}
+	}
+	if len(s.temperatures) != 1 || s.temperatures[0].DeviceID != "freezer" || s.temperatures[0].Location != "freezer" {
+		t.Errorf("stored %+v, want one reading of freezer", s.temperatures)
+	}
+
+	// Keys in use are touched, and revoked keys stop working
+	keys, _ := listAPIKeys(ctx)
+	if len(keys) != 3 || keys[1].LastUsedAt == nil {
+		t.Fatalf("keys = %+v, want 3 with the read key used", keys)
+	}
+	if w := serve(handler, http.MethodDelete, fmt.Sprintf("/apikeys/%d", keys[1].ID), "", "X-API-Key", admin); w.Code != http.StatusNoContent {
+		t.Errorf("revoking = %d, want 204", w.Code)
+	}
+	if w := serve(handler, http.MethodDelete, "/apikeys/999", "", "X-API-Key", admin); w.Code != http.StatusNotFound {
+		t.Errorf("revoking an unknown key = %d, want 404", w.Code)
+	}
+	if w := serve(handler, http.MethodGet, "/tempmon", "", "X-API-Key", read); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key = %d, want 401", w.Code)
+	}
+
+	// Decommissioned devices lose their keys' write access
+	if err := s.DecommissionDevice(ctx, "freezer"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handler, http.MethodPost, "/tempmon", `{"value": 1}`, "X-API-Key", device); w.Code != http.StatusForbidden {
+		t.Errorf("key of decommissioned device = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxBatchItems = 5000
+	maxBatchBytes = 10 << 20 // 10 MiB request body limit
+)
+
+// BatchItemResult reports the outcome of one item of a batch request
+type BatchItemResult struct {
+	Index     int          `json:"index"`               // Position of the item in the request
+	Status    int          `json:"status"`              // 201 stored, 200 retry of a stored item, 400 invalid, 403 not allowed for the API key
+	ID        int          `json:"id,omitempty"`        // ID of the stored row
+	Timestamp *time.Time   `json:"timestamp,omitempty"` // Timestamp of the stored row
+	Error     string       `json:"error,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"` // The invalid field, when known
+}
+
+// reject marks the item as not stored because of err. The invalid field is
+// reported as <index>.<field>.
+func (res *BatchItemResult) reject(status int, err error) {
+	res.Status = status
+	res.Error = err.Error()
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		res.Fields = []FieldError{{Field: strconv.Itoa(res.Index) + "." + fe.Field, Message: fe.Message}}
+	}
+}
+
+// batchItemKey derives the Idempotency-Key of item i from the request header,
+// so that a retried batch maps every item to the row stored the first time
+func batchItemKey(r *http.Request, i int) string {
+	header := r.Header.Get("Idempotency-Key")
+	if header == "" {
+		return ""
+	}
+	return header + ":" + strconv.Itoa(i)
+}
+
+// BatchResponse is returned by the batch ingestion endpoints
+type BatchResponse struct {
+	Inserted   int               `json:"inserted"`
+	Duplicates int               `json:"duplicates"` // Items already stored by an earlier request
+	Failed     int               `json:"failed"`
+	Results    []BatchItemResult `json:"results"`
+}
+
+// decodeBatch splits the request body into raw items. The body is either a
+// JSON array or, with an application/x-ndjson content type, one JSON object
+// per line.
+func decodeBatch(r *http.Request) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			items = append(items, json.RawMessage(bytes.Clone(line)))
+			if len(items) > maxBatchItems {
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read NDJSON body: %v", err)
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+			return nil, errors.New("request body must be a JSON array or NDJSON")
+		}
+	}
+	if len(items) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	if len(items) > maxBatchItems {
+		return nil, fmt.Errorf("batch too large: at most %d items", maxBatchItems)
+	}
+	return items, nil
+}
+
+// writeBatchResponse tallies the per-item results and writes them out
+func writeBatchResponse(w http.ResponseWriter, results []BatchItemResult) {
+	resp := BatchResponse{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case http.StatusCreated:
+			resp.Inserted++
+		case http.StatusOK:
+			resp.Duplicates++
+		default:
+			resp.Failed++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleTemperatureBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	items, err := decodeBatch(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	ctx := context.Background()
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		writeError(w, "Failed to load devices", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// Decode and validate each item; only the valid ones are inserted, and
+	// items whose Idempotency-Key or device_id/sequence pair was seen before
+	// are skipped
+	results := make([]BatchItemResult, len(items))
+	var keys []string
+	var readings []*TemperatureReading
+	var indexes []int
+	for i, raw := range items {
+		results[i].Index = i
+		var reading TemperatureReading
+		if err := json.Unmarshal(raw, &reading); err != nil {
+			results[i].reject(http.StatusBadRequest, decodeError("Invalid reading", err))
+			continue
+		}
+		if key := deviceKey(r); key != nil {
+			if err := key.claimTemperature(devices, &reading); err != nil {
+				results[i].reject(http.StatusForbidden, err)
+				continue
+			}
+		}
+		if err := devices.linkTemperature(&reading); err != nil {
+			results[i].reject(http.StatusBadRequest, err)
+			continue
+		}
+		if err := validateTemperature(&reading); err != nil {
+			results[i].reject(http.StatusBadRequest, err)
+			continue
+		}
+		readings = append(readings, &reading)
+		keys = append(keys, temperatureKey(batchItemKey(r, i), &reading))
+		indexes = append(indexes, i)
+	}
+
+	var replayed []bool
+	if len(readings) > 0 {
+		replayed, err = storeTemperatures(ctx, readings, keys)
+		if err != nil {
+			writeError(w, "Failed to create temperature readings", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	for j, reading := range readings {
+		res := &results[indexes[j]]
+		res.Status = http.StatusCreated
+		if replayed[j] {
+			res.Status = http.StatusOK
+		}
+		res.ID = reading.ID
+		res.Timestamp = &reading.Timestamp
+	}
+	writeBatchResponse(w, results)
+}
+
+func handlePumpRunTimeBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	items, err := decodeBatch(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	ctx := context.Background()
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		writeError(w, "Failed to load devices", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	// Decode and validate each item; only the valid ones are inserted, and
+	// items whose Idempotency-Key or device_id/sequence pair was seen before
+	// are skipped
+	results := make([]BatchItemResult, len(items))
+	var keys []string
+	var runTimes []*PumpRunTime
+	var indexes []int
+	for i, raw := range items {
+		results[i].Index = i
+		var rt PumpRunTime
+		if err := json.Unmarshal(raw, &rt); err != nil {
+			results[i].reject(http.StatusBadRequest, decodeError("Invalid pump run time", err))
+			continue
+		}
+		if key := deviceKey(r); key != nil {
+			if err := key.claimPumpRunTime(devices, &rt); err != nil {
+				results[i].reject(http.StatusForbidden, err)
+				continue
+			}
+		}
+		if err := devices.linkPumpRunTime(&rt); err != nil {
+			results[i].reject(http.StatusBadRequest, err)
+			continue
+		}
+		if err := validatePumpRunTime(&rt); err != nil {
+			results[i].reject(http.StatusBadRequest, err)
+			continue
+		}
+		runTimes = append(runTimes, &rt)
+		keys = append(keys, pumpRunTimeKey(batchItemKey(r, i), &rt))
+		indexes = append(indexes, i)
+	}
+
+	var replayed []bool
+	if len(runTimes) > 0 {
+		replayed, err = storePumpRunTimes(ctx, runTimes, keys)
+		if err != nil {
+			writeError(w, "Failed to create pump run times", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+	}
+
+	for j, rt := range runTimes {
+		res := &results[indexes[j]]
+		res.Status = http.StatusCreated
+		if replayed[j] {
+			res.Status = http.StatusOK
+		}
+		res.ID = rt.ID
+		res.Timestamp = &rt.Timestamp
+	}
+	writeBatchResponse(w, results)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTemperatureBatch(t *testing.T) {
+	s := useMemoryStore(t)
+	handler := http.HandlerFunc(handleTemperatureBatch)
+	body := `[{"value": 1, "location": "freezer"}, {"value": "cold", "location": "freezer"}, {"value": 2, "location": "garage"}]`
+
+	var first, retry BatchResponse
+	decodeBody(t, serve(handler, http.MethodPost, "/tempmon/batch", body, "Idempotency-Key", "abc"), &first)
+	decodeBody(t, serve(handler, http.MethodPost, "/tempmon/batch", body, "Idempotency-Key", "abc"), &retry)
+
+	if first.Inserted != 2 || first.Failed != 1 {
+		t.Fatalf("first batch = %+v, want 2 inserted and 1 failed", first)
+	}
+	if fields := first.Results[1].Fields; len(fields) != 1 || fields[0].Field != "1.value" {
+		t.Errorf("invalid item reported fields %+v, want 1.value", fields)
+	}
+
+	// The header applies to each item, so a retried batch stores nothing new
+	if retry.Inserted != 0 || retry.Duplicates != 2 {
+		t.Errorf("retried batch = %+v, want 2 duplicates", retry)
+	}
+	for _, i := range []int{0, 2} {
+		if retry.Results[i].ID != first.Results[i].ID {
+			t.Errorf("retried item %d returned ID %d, want %d", i, retry.Results[i].ID, first.Results[i].ID)
+		}
+	}
+	if len(s.temperatures) != 2 {
+		t.Errorf("stored %d readings, want 2", len(s.temperatures))
+	}
+}
+
+func TestPumpRunTimeBatch(t *testing.T) {
+	s := useMemoryStore(t)
+	handler := http.HandlerFunc(handlePumpRunTimeBatch)
+
+	// NDJSON, with the device and sequence deduplicating the repeated line
+	body := `{"run_time": 2, "current": 8, "device_id": "pump", "sequence": 1}
+{"run_time": 4, "current": 7, "device_id": "pump", "sequence": 2}
+{"run_time": 4, "current": 7, "device_id": "pump", "sequence": 2}
+{"run_time": -1, "current": 7}
+`
+	w := serve(handler, http.MethodPost, "/pumpmon/batch", body, "Content-Type", "application/x-ndjson")
+	var resp BatchResponse
+	decodeBody(t, w, &resp)
+	if resp.Inserted != 2 || resp.Duplicates != 1 || resp.Failed != 1 {
+		t.Fatalf("batch = %+v, want 2 inserted, 1 duplicate and 1 failed", resp)
+	}
+	if fields := resp.Results[3].Fields; len(fields) != 1 || fields[0].Field != "3.run_time" {
+		t.Errorf("invalid item reported fields %+v, want 3.run_time", fields)
+	}
+	if len(s.runTimes) != 2 {
+		t.Errorf("stored %d samples, want 2", len(s.runTimes))
+	}
+
+	if w := serve(handler, http.MethodPost, "/pumpmon/batch", `{"run_time": 2}`); w.Code != http.StatusBadRequest {
+		t.Errorf("a single object = %d, want 400", w.Code)
+	}
+}
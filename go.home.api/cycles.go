@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// pumpCycleGap ends a cycle: the pump monitor posts a sample every 2
+	// seconds while the pump runs, so a longer silence means it stopped
+	pumpCycleGap = 30 * time.Second
+
+	// pumpCycleWindow bounds the samples read by one sessionizer step
+	pumpCycleWindow = 24 * time.Hour
+
+	// pumpCycleInterval is how often new samples are sessionized
+	pumpCycleInterval = time.Minute
+)
+
+// pumpOnAmps is the current above which the pump counts as running, set from
+// pump_on_amps. The pump monitor posts one last sample below it when the pump
+// stops; that sample ends the cycle but is left out of the current statistics.
+var pumpOnAmps = 1.7
+
+// PumpCycle is one run of the pump, derived from its run time samples
+type PumpCycle struct {
+	ID                int       `json:"id"`
+	DeviceID          string    `json:"device_id,omitempty"`
+	Start             time.Time `json:"start"`            // When the pump started
+	End               time.Time `json:"end"`              // Last sample of the cycle
+	DurationSeconds   int       `json:"duration_seconds"` // Time from start to end
+	SampleCount       int       `json:"sample_count"`
+	AvgCurrent        float64   `json:"avg_current"`         // Amps, over the samples taken while running
+	PeakCurrent       float64   `json:"peak_current"`        // Amps
+	MinCurrent        float64   `json:"min_current"`         // Amps
+	LowCurrent        bool      `json:"low_current"`         // True if any sample reported low current
+	LowCurrentSamples int       `json:"low_current_samples"` // Samples that reported low current
+}
+
+// pumpSample is a row of pump_run_times as read by the sessionizer
+type pumpSample struct {
+	DeviceID   string
+	Timestamp  time.Time
+	RunTime    int
+	Current    float64
+	LowCurrent bool
+}
+
+// continues reports whether s belongs to the same cycle as the previous sample
+// of its device. A run_time that goes backwards means the pump restarted.
+func (s pumpSample) continues(prev pumpSample) bool {
+	return s.RunTime >= prev.RunTime && s.Timestamp.Sub(prev.Timestamp) <= pumpCycleGap
+}
+
+// buildPumpCycle summarizes the samples of one cycle. The start is taken from
+// the run_time of the first sample, which counts seconds since the pump started.
+func buildPumpCycle(samples []pumpSample) PumpCycle {
+	first, last := samples[0], samples[len(samples)-1]
+	c := PumpCycle{
+		DeviceID:    first.DeviceID,
+		Start:       first.Timestamp.Add(-time.Duration(first.RunTime) * time.Second),
+		End:         last.Timestamp,
+		SampleCount: len(samples),
+		MinCurrent:  math.Inf(1),
+		PeakCurrent: math.Inf(-1),
+	}
+	c.DurationSeconds = int(c.End.Sub(c.Start).Round(time.Second).Seconds())
+
+	running := 0
+	for _, s := range samples {
+		if s.Current >= pumpOnAmps {
+			running++
+		}
+	}
+	var sum float64
+	var n int
+	for _, s := range samples {
+		if s.LowCurrent {
+			c.LowCurrent = true
+			c.LowCurrentSamples++
+		}
+		if running > 0 && s.Current < pumpOnAmps {
+			continue
+		}
+		sum += s.Current
+		n++
+		c.MinCurrent = math.Min(c.MinCurrent, s.Current)
+		c.PeakCurrent = math.Max(c.PeakCurrent, s.Current)
+	}
+	c.AvgCurrent = math.Round(sum/float64(n)*1000) / 1000
+	return c
+}
+
+// sessionizePumpCycles turns new pump samples into cycles every
+// pumpCycleInterval until ctx is done
+func sessionizePumpCycles(ctx context.Context) {
+	ticker := time.NewTicker(pumpCycleInterval)
+	defer ticker.Stop()
+	for {
+		if err := sessionizePending(ctx); err != nil {
+			log.Printf("Failed to sessionize pump cycles: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionizePending processes the samples after the stored progress mark one
+// window at a time, catching up on the whole history on first start
+func sessionizePending(ctx context.Context) error {
+	for {
+		caughtUp, err := sessionizeStep(ctx)
+		if err != nil || caughtUp {
+			return err
+		}
+	}
+}
+
+// sessionizeStep sessionizes the window after the progress mark, first moving
+// the mark back to the earliest sample that arrived late. It holds the
+// progress row throughout, so samples stored meanwhile are either read by it
+// or marked late by markLatePumpSamples once it is done.
+func sessionizeStep(ctx context.Context) (caughtUp bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var from, late sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT processed_until, reprocess_from FROM pump_cycle_progress FOR UPDATE").Scan(&from, &late)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, "SELECT MIN(timestamp) FROM pump_run_times").Scan(&from)
+	}
+	if err != nil || !from.Valid {
+		return true, err
+	}
+
+	start := from.Time
+	if late.Valid {
+		if start, err = rewindPumpCycles(ctx, tx, start, late.Time); err != nil {
+			return false, err
+		}
+	}
+	now := time.Now()
+	next, written, err := sessionizeWindow(ctx, tx, start, now)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO pump_cycle_progress (processed_until) VALUES ($1)
+		ON CONFLICT (singleton) DO UPDATE SET processed_until = EXCLUDED.processed_until, reprocess_from = NULL`, next); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	if written > 0 {
+		log.Printf("Stored %d pump cycles", written)
+	}
+	return start.Add(pumpCycleWindow).After(now), nil
+}
+
+// rewindPumpCycles deletes the cycles that a sample which arrived late, taken
+// at late, may belong to or join, and returns where sessionizing has to start
+// again to rebuild them
+func rewindPumpCycles(ctx context.Context, tx *sql.Tx, from, late time.Time) (time.Time, error) {
+	cutoff := late.Add(-pumpCycleGap)
+	var earliest sql.NullTime
+	err := tx.QueryRowContext(ctx, `
+		WITH deleted AS (DELETE FROM pump_cycles WHERE end_time >= $1 RETURNING start_time)
+		SELECT MIN(start_time) FROM deleted`, cutoff).Scan(&earliest)
+	if err != nil {
+		return from, err
+	}
+	if cutoff.Before(from) {
+		from = cutoff
+	}
+	if earliest.Valid && earliest.Time.Before(from) {
+		from = earliest.Time
+	}
+	log.Printf("Sessionizing pump cycles again from %s for samples that arrived late", from.Format(time.RFC3339))
+	return from, nil
+}
+
+// markLatePumpSamples records the earliest of newly stored samples for the
+// sessionizer when it has already passed their time, or written a cycle they
+// may join. The row lock it takes on the progress mark holds off the
+// sessionizer until tx commits, so no sample is missed by both.
+func markLatePumpSamples(ctx context.Context, tx *sql.Tx, runTimes []*PumpRunTime) error {
+	if len(runTimes) == 0 {
+		return nil
+	}
+	earliest := runTimes[0].Timestamp
+	for _, rt := range runTimes[1:] {
+		if rt.Timestamp.Before(earliest) {
+			earliest = rt.Timestamp
+		}
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE pump_cycle_progress SET reprocess_from = CASE
+			WHEN $1 < processed_until OR EXISTS (SELECT 1 FROM pump_cycles WHERE end_time >= $2)
+			THEN LEAST(COALESCE(reprocess_from, $1), $1)
+			ELSE reprocess_from END`,
+		earliest, earliest.Add(-pumpCycleGap))
+	return err
+}
+
+// sessionizeWindow writes the cycles that finished within pumpCycleWindow after
+// from and returns where the next step should start: the first sample of the
+// earliest cycle that may still continue.
+func sessionizeWindow(ctx context.Context, tx *sql.Tx, from, now time.Time) (next time.Time, written int, err error) {
+	to := from.Add(pumpCycleWindow)
+	if to.After(now) {
+		to = now
+	}
+
+	// Cycles that were written by an earlier step must not be cut short when
+	// their tail is read again
+	done := map[string]time.Time{}
+	rows, err := tx.QueryContext(ctx, "SELECT COALESCE(device_id, ''), MAX(end_time) FROM pump_cycles WHERE end_time >= $1 GROUP BY 1", from)
+	if err != nil {
+		return from, 0, err
+	}
+	for rows.Next() {
+		var device string
+		var end time.Time
+		if err := rows.Scan(&device, &end); err != nil {
+			rows.Close()
+			return from, 0, err
+		}
+		done[device] = end
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return from, 0, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT COALESCE(device_id, ''), timestamp, run_time, current, low_current
+		FROM pump_run_times
+		WHERE timestamp >= $1 AND timestamp < $2
+		ORDER BY timestamp, id`, from, to)
+	if err != nil {
+		return from, 0, err
+	}
+	open := map[string][]pumpSample{}
+	var finished [][]pumpSample
+	for rows.Next() {
+		var s pumpSample
+		if err := rows.Scan(&s.DeviceID, &s.Timestamp, &s.RunTime, &s.Current, &s.LowCurrent); err != nil {
+			rows.Close()
+			return from, 0, err
+		}
+		if end, ok := done[s.DeviceID]; ok && !s.Timestamp.After(end) {
+			continue
+		}
+		cur := open[s.DeviceID]
+		if len(cur) > 0 && !s.continues(cur[len(cur)-1]) {
+			finished = append(finished, cur)
+			cur = nil
+		}
+		open[s.DeviceID] = append(cur, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return from, 0, err
+	}
+
+	// A cycle still open at the end of the window is complete only if the
+	// window reaches past its last sample by the cycle gap. The next step
+	// overlaps this one by the gap to pick up samples that arrived late.
+	next = to.Add(-pumpCycleGap)
+	for _, samples := range open {
+		if samples[len(samples)-1].Timestamp.Before(to.Add(-pumpCycleGap)) {
+			finished = append(finished, samples)
+		} else if samples[0].Timestamp.Before(next) {
+			next = samples[0].Timestamp
+		}
+	}
+	if !next.After(from) && to.Before(now) {
+		// A single cycle spans the whole window; move on rather than stall
+		next = to
+	}
+
+	for _, samples := range finished {
+		c := buildPumpCycle(samples)
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO pump_cycles (device_id, start_time, end_time, duration_seconds, sample_count, avg_current, peak_current, min_current, low_current, low_current_samples)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			ON CONFLICT DO NOTHING`,
+			nullString(c.DeviceID), c.Start, c.End, c.DurationSeconds, c.SampleCount, c.AvgCurrent, c.PeakCurrent, c.MinCurrent, c.LowCurrent, c.LowCurrentSamples)
+		if err != nil {
+			return from, written, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			written++
+		}
+	}
+	return next, written, nil
+}
+
+func handlePumpCycles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	filter := cycleFilter{DeviceID: r.URL.Query().Get("device_id"), LowCurrent: r.URL.Query().Get("low_current") == "true"}
+	ctx := context.Background()
+
+	cycles, err := store.ListPumpCycles(ctx, filter, page)
+	if err != nil {
+		writeError(w, "Failed to fetch pump cycles", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	writePage(w, r, page, cycles, func(last PumpCycle) pageCursor {
+		return pageCursor{Timestamp: last.Start, ID: last.ID}
+	})
+}
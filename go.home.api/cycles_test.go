@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPumpCycles(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		s.cycles = append(s.cycles, PumpCycle{ID: i + 1, DeviceID: "pump", Start: base.Add(time.Duration(i) * time.Hour), LowCurrent: i == 3})
+	}
+	s.cycles = append(s.cycles, PumpCycle{ID: 6, DeviceID: "other", Start: base})
+	handler := http.HandlerFunc(handlePumpCycles)
+
+	var ids []int
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		w := serve(handler, http.MethodGet, "/pumpmon/cycles?device_id=pump&limit=2&cursor="+cursor, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /pumpmon/cycles = %d: %s", w.Code, w.Body)
+		}
+		var page Page[PumpCycle]
+		decodeBody(t, w, &page)
+		for _, c := range page.Items {
+			ids = append(ids, c.ID)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(ids) != 5 || ids[0] != 5 || ids[4] != 1 {
+		t.Errorf("got cycles %v, want 5 to 1, newest first", ids)
+	}
+
+	var page Page[PumpCycle]
+	decodeBody(t, serve(handler, http.MethodGet, "/pumpmon/cycles?low_current=true", ""), &page)
+	if len(page.Items) != 1 || page.Items[0].ID != 4 {
+		t.Errorf("low_current=true returned %+v, want cycle 4", page.Items)
+	}
+}
+
+func TestBuildPumpCycle(t *testing.T) {
+	base := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	c := buildPumpCycle([]pumpSample{
+		{Timestamp: base, RunTime: 2, Current: 8},
+		{Timestamp: base.Add(2 * time.Second), RunTime: 4, Current: 6, LowCurrent: true},
+		{Timestamp: base.Add(4 * time.Second), RunTime: 6, Current: 0.1}, // the pump stopped
+	})
+	if !c.Start.Equal(base.Add(-2*time.Second)) || c.DurationSeconds != 6 || c.SampleCount != 3 {
+		t.Errorf("cycle %+v, want 3 samples over 6s from %s", c, base.Add(-2*time.Second))
+	}
+	if c.AvgCurrent != 7 || c.MinCurrent != 6 || c.PeakCurrent != 8 || !c.LowCurrent || c.LowCurrentSamples != 1 {
+		t.Errorf("cycle %+v, want currents 6 to 8 averaging 7 and one low current sample", c)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Device types
+const (
+	deviceTypeTemperature = "temperature"
+	deviceTypePump        = "pump"
+)
+
+// requireRegisteredDevices rejects readings and heartbeats from devices that
+// are not in the registry, set from require_registered_devices
+var requireRegisteredDevices bool
+
+// Device represents a registered sensor
+type Device struct {
+	ID               string     `json:"id"`                          // e.g., "pump", "freezer"
+	Type             string     `json:"type"`                        // "temperature" or "pump"
+	Name             string     `json:"name"`                        // Display name
+	Location         string     `json:"location,omitempty"`          // e.g., "freezer", "wellpump"
+	FirmwareVersion  string     `json:"firmware_version,omitempty"`  // Version reported by the device
+	ExpectedInterval int        `json:"expected_interval_seconds"`   // How often the device reports, in seconds
+	CreatedAt        time.Time  `json:"created_at"`                  // When the device was registered
+	UpdatedAt        time.Time  `json:"updated_at"`                  // When the device was last changed
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"` // Set once the device is retired
+}
+
+// deviceUpdate holds the fields of a PATCH/PUT request; nil fields are left unchanged
+type deviceUpdate struct {
+	Type             *string `json:"type"`
+	Name             *string `json:"name"`
+	Location         *string `json:"location"`
+	FirmwareVersion  *string `json:"firmware_version"`
+	ExpectedInterval *int    `json:"expected_interval_seconds"`
+}
+
+const deviceColumns = "id, type, name, COALESCE(location, ''), COALESCE(firmware_version, ''), expected_interval_seconds, created_at, updated_at, decommissioned_at"
+
+func scanDevice(row interface{ Scan(...interface{}) error }, d *Device) error {
+	var decommissioned sql.NullTime
+	err := row.Scan(&d.ID, &d.Type, &d.Name, &d.Location, &d.FirmwareVersion, &d.ExpectedInterval, &d.CreatedAt, &d.UpdatedAt, &decommissioned)
+	if decommissioned.Valid {
+		d.DecommissionedAt = &decommissioned.Time
+	}
+	return err
+}
+
+// validateDevice checks a device before it is created or updated
+func validateDevice(d *Device) error {
+	switch {
+	case d.ID == "":
+		return fieldErrorf("id", "is required")
+	case strings.ContainsAny(d.ID, "/ \t\n"):
+		return fieldErrorf("id", "must not contain slashes or whitespace")
+	case d.ID == "status":
+		return fieldErrorf("id", `"status" is reserved`)
+	case d.Type != deviceTypeTemperature && d.Type != deviceTypePump:
+		return fieldErrorf("type", "must be temperature or pump")
+	case d.Name == "":
+		return fieldErrorf("name", "is required")
+	case d.ExpectedInterval <= 0:
+		return fieldErrorf("expected_interval_seconds", "must be positive")
+	}
+	return nil
+}
+
+// nullString stores empty optional text columns as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint error
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// --- Device resolution during ingestion ---
+
+// deviceIndex is a snapshot of the active devices used to link readings
+type deviceIndex struct {
+	byID       map[string]Device
+	byLocation map[string]Device // "<type>/<location>"
+	pumps      []Device
+}
+
+// loadDeviceIndex reads all active devices from the store
+func loadDeviceIndex(ctx context.Context) (*deviceIndex, error) {
+	devices, err := store.ActiveDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &deviceIndex{byID: map[string]Device{}, byLocation: map[string]Device{}}
+	for _, d := range devices {
+		idx.byID[d.ID] = d
+		if d.Location != "" {
+			idx.byLocation[d.Type+"/"+d.Location] = d
+		}
+		if d.Type == deviceTypePump {
+			idx.pumps = append(idx.pumps, d)
+		}
+	}
+	return idx, nil
+}
+
+// linkTemperature sets the device of a reading, found by device_id or else by
+// location. A reading that only names its device gets the device's location.
+// Unregistered device IDs are stored as sent unless registration is required.
+func (idx *deviceIndex) linkTemperature(reading *TemperatureReading) error {
+	if reading.DeviceID != "" {
+		d, ok := idx.byID[reading.DeviceID]
+		if !ok || d.Type != deviceTypeTemperature {
+			if requireRegisteredDevices {
+				return fmt.Errorf("device %q is not a registered temperature device", reading.DeviceID)
+			}
+			return nil
+		}
+		if reading.Location == "" {
+			reading.Location = d.Location
+		}
+		return nil
+	}
+	if d, ok := idx.byLocation[deviceTypeTemperature+"/"+reading.Location]; ok {
+		reading.DeviceID = d.ID
+	} else if requireRegisteredDevices {
+		return fmt.Errorf("no registered temperature device at location %q", reading.Location)
+	}
+	return nil
+}
+
+// claimTemperature restricts a reading to the device deviceID and, when that
+// device is registered, to its location, filling in whichever of the two the
+// reading left out. Unregistered devices may not write readings for the
+// location of a registered one. who names the writer in errors.
+func (idx *deviceIndex) claimTemperature(who, deviceID string, reading *TemperatureReading) error {
+	if reading.DeviceID == "" {
+		reading.DeviceID = deviceID
+	}
+	if reading.DeviceID != deviceID {
+		return fmt.Errorf("%s may only write readings of device %q", who, deviceID)
+	}
+	d, ok := idx.byID[deviceID]
+	if !ok {
+		if owner, taken := idx.byLocation[deviceTypeTemperature+"/"+reading.Location]; taken {
+			return fmt.Errorf("%s may not write readings for location %q of device %q", who, reading.Location, owner.ID)
+		}
+		return nil
+	}
+	if reading.Location == "" {
+		reading.Location = d.Location
+	}
+	if reading.Location != d.Location {
+		return fmt.Errorf("%s may only write readings for location %q", who, d.Location)
+	}
+	return nil
+}
+
+// linkPumpRunTime sets the device of a pump sample, found by device_id or else
+// as the only registered pump
+func (idx *deviceIndex) linkPumpRunTime(rt *PumpRunTime) error {
+	if rt.DeviceID != "" {
+		if d, ok := idx.byID[rt.DeviceID]; ok && d.Type == deviceTypePump {
+			return nil
+		}
+		if requireRegisteredDevices {
+			return fmt.Errorf("device %q is not a registered pump", rt.DeviceID)
+		}
+		return nil
+	}
+	if len(idx.pumps) == 1 {
+		rt.DeviceID = idx.pumps[0].ID
+	} else if requireRegisteredDevices {
+		return errors.New("device_id is required when there is not exactly one registered pump")
+	}
+	return nil
+}
+
+// linkHeartbeat sets the pump flag of a heartbeat from the registry; heartbeats
+// of unregistered devices keep the flag they sent. As before the registry, an
+// unregistered device named "pump" is always the pump.
+func (idx *deviceIndex) linkHeartbeat(heartbeat *DeviceHeartbeat) error {
+	if d, ok := idx.byID[heartbeat.DeviceID]; ok {
+		heartbeat.Pump = d.Type == deviceTypePump
+	} else if requireRegisteredDevices {
+		return fmt.Errorf("device %q is not registered", heartbeat.DeviceID)
+	} else if heartbeat.DeviceID == "pump" {
+		heartbeat.Pump = true
+	}
+	return nil
+}
+
+// --- Device Handlers ---
+
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listDevices(w, r)
+	case http.MethodPost:
+		createDevice(w, r)
+	default:
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleSingleDevice(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len("/devices/"):]
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getDevice(w, r, id)
+	case http.MethodPut, http.MethodPatch:
+		updateDevice(w, r, id)
+	case http.MethodDelete:
+		decommissionDevice(w, r, id)
+	default:
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listDevices(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	q := r.URL.Query()
+
+	devices, err := store.ListDevices(ctx, deviceFilter{
+		Type:                  q.Get("type"),
+		IncludeDecommissioned: q.Get("include_decommissioned") == "true",
+	})
+	if err != nil {
+		writeError(w, "Failed to fetch devices", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+func createDevice(w http.ResponseWriter, r *http.Request) {
+	newDevice := Device{ExpectedInterval: 60}
+	if err := json.NewDecoder(r.Body).Decode(&newDevice); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := validateDevice(&newDevice); err != nil {
+		badRequest(w, err)
+		return
+	}
+	ctx := context.Background()
+
+	if err := store.CreateDevice(ctx, &newDevice); err != nil {
+		if err == errConflict {
+			writeError(w, "A device with this ID, or an active device of this type at this location, already exists", http.StatusConflict)
+			return
+		}
+		writeError(w, "Failed to create device", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newDevice)
+}
+
+func getDevice(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := context.Background()
+
+	d, err := store.GetDevice(ctx, id)
+	if err == errNotFound {
+		writeError(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, "Failed to fetch device", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+func updateDevice(w http.ResponseWriter, r *http.Request, id string) {
+	var update deviceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	ctx := context.Background()
+
+	var invalid error
+	d, err := store.UpdateDevice(ctx, id, func(d *Device) error {
+		// Apply the fields that were sent
+		if update.Type != nil {
+			d.Type = *update.Type
+		}
+		if update.Name != nil {
+			d.Name = *update.Name
+		}
+		if update.Location != nil {
+			d.Location = *update.Location
+		}
+		if update.FirmwareVersion != nil {
+			d.FirmwareVersion = *update.FirmwareVersion
+		}
+		if update.ExpectedInterval != nil {
+			d.ExpectedInterval = *update.ExpectedInterval
+		}
+		invalid = validateDevice(d)
+		return invalid
+	})
+	switch {
+	case err == nil:
+	case err == invalid:
+		badRequest(w, err)
+		return
+	case err == errNotFound:
+		writeError(w, "Not found", http.StatusNotFound)
+		return
+	case err == errConflict:
+		writeError(w, "An active device of this type already exists at this location", http.StatusConflict)
+		return
+	default:
+		writeError(w, "Failed to update device", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// decommissionDevice retires a device. Its readings are kept and it stays
+// visible with include_decommissioned=true.
+func decommissionDevice(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := context.Background()
+
+	if err := store.DecommissionDevice(ctx, id); err == errNotFound {
+		writeError(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, "Failed to decommission device", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
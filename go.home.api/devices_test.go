@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDeviceHandlers(t *testing.T) {
+	useMemoryStore(t)
+	devices := http.HandlerFunc(handleDevices)
+	single := http.HandlerFunc(handleSingleDevice)
+
+	tests := []struct {
+		handler http.Handler
+		method  string
+		target  string
+		body    string
+		want    int
+	}{
+		{devices, http.MethodPost, "/devices", `{"id": "freezer", "type": "temperature", "name": "Freezer", "location": "freezer"}`, http.StatusCreated},
+		{devices, http.MethodPost, "/devices", `{"id": "garage", "type": "temperature", "name": "Garage", "location": "garage"}`, http.StatusCreated},
+		{devices, http.MethodPost, "/devices", `{"id": "pump", "type": "pump", "name": "Well pump"}`, http.StatusCreated},
+		// Taken ID, taken location, invalid fields
+		{devices, http.MethodPost, "/devices", `{"id": "freezer", "type": "temperature", "name": "Other"}`, http.StatusConflict},
+		{devices, http.MethodPost, "/devices", `{"id": "freezer2", "type": "temperature", "name": "Other", "location": "freezer"}`, http.StatusConflict},
+		{devices, http.MethodPost, "/devices", `{"id": "bad id", "type": "temperature", "name": "Bad"}`, http.StatusBadRequest},
+		{devices, http.MethodPost, "/devices", `{"id": "fan", "type": "fan", "name": "Fan"}`, http.StatusBadRequest},
+
+		{single, http.MethodGet, "/devices/freezer", "", http.StatusOK},
+		{single, http.MethodGet, "/devices/nope", "", http.StatusNotFound},
+		{single, http.MethodPatch, "/devices/garage", `{"firmware_version": "1.2.0"}`, http.StatusOK},
+		{single, http.MethodPatch, "/devices/garage", `{"location": "freezer"}`, http.StatusConflict},
+		{single, http.MethodPatch, "/devices/garage", `{"expected_interval_seconds": 0}`, http.StatusBadRequest},
+		{single, http.MethodPatch, "/devices/nope", `{"name": "Nope"}`, http.StatusNotFound},
+
+		// A decommissioned device frees its location
+		{single, http.MethodDelete, "/devices/freezer", "", http.StatusNoContent},
+		{single, http.MethodDelete, "/devices/nope", "", http.StatusNotFound},
+		{devices, http.MethodPost, "/devices", `{"id": "freezer2", "type": "temperature", "name": "New freezer", "location": "freezer"}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if w := serve(tt.handler, tt.method, tt.target, tt.body); w.Code != tt.want {
+			t.Errorf("%s %s %s = %d, want %d: %s", tt.method, tt.target, tt.body, w.Code, tt.want, w.Body)
+		}
+	}
+
+	var garage Device
+	decodeBody(t, serve(single, http.MethodGet, "/devices/garage", ""), &garage)
+	if garage.FirmwareVersion != "1.2.0" || garage.Location != "garage" || garage.ExpectedInterval != 60 {
+		t.Errorf("garage = %+v, want firmware 1.2.0 at garage every 60s", garage)
+	}
+
+	lists := map[string][]string{
+		"/devices":                             {"freezer2", "garage", "pump"},
+		"/devices?include_decommissioned=true": {"freezer", "freezer2", "garage", "pump"},
+		"/devices?type=pump":                   {"pump"},
+	}
+	for target, want := range lists {
+		var list []Device
+		decodeBody(t, serve(devices, http.MethodGet, target, ""), &list)
+		var ids []string
+		for _, d := range list {
+			ids = append(ids, d.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("GET %s = %v, want %v", target, ids, want)
+		}
+	}
+}
+
+func TestHeartbeatPumpFlag(t *testing.T) {
+	s := useMemoryStore(t, Device{ID: "pump-2", Type: deviceTypePump, Name: "Backup pump", ExpectedInterval: 60})
+	handler := http.HandlerFunc(handleDeviceHeartbeats)
+
+	tests := []struct {
+		body string
+		pump bool
+	}{
+		{`{"device_id": "pump"}`, true},              // unregistered legacy pump monitor
+		{`{"device_id": "pump-2"}`, true},            // registered pump
+		{`{"device_id": "freezer"}`, false},          // unregistered, no flag
+		{`{"device_id": "fan", "pump": true}`, true}, // unregistered, keeps its flag
+	}
+	for _, tt := range tests {
+		if w := serve(handler, http.MethodPost, "/heartbeat", tt.body); w.Code != http.StatusCreated {
+			t.Fatalf("POST /heartbeat %s = %d: %s", tt.body, w.Code, w.Body)
+		}
+	}
+	for i, tt := range tests {
+		if got := s.heartbeats[i].Pump; got != tt.pump {
+			t.Errorf("%s stored pump=%v, want %v", tt.body, got, tt.pump)
+		}
+	}
+}
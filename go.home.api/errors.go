@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorResponse is the JSON body of every error response
+type ErrorResponse struct {
+	Error  string       `json:"error"`            // Human readable summary
+	Status int          `json:"status"`           // HTTP status code, repeated for convenience
+	Fields []FieldError `json:"fields,omitempty"` // Problems with individual fields, for 400 responses
+}
+
+// FieldError is a problem with one field of the request body or one query
+// parameter. Nested fields are dotted, e.g. "2.value" for the third item of
+// a batch.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// fieldErrorf returns a FieldError for field with a formatted message
+func fieldErrorf(field, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeError writes an ErrorResponse. It takes the same arguments as
+// http.Error, plus any field errors.
+func writeError(w http.ResponseWriter, message string, code int, fields ...FieldError) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: message, Status: code, Fields: fields})
+}
+
+// badRequest writes a 400 for err, listing the field when err is a FieldError
+func badRequest(w http.ResponseWriter, err error) {
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		writeError(w, err.Error(), http.StatusBadRequest, *fe)
+		return
+	}
+	writeError(w, err.Error(), http.StatusBadRequest)
+}
+
+// writeDecodeError writes a 400 for a request body that could not be decoded,
+// naming the field when a value had the wrong JSON type
+func writeDecodeError(w http.ResponseWriter, err error) {
+	badRequest(w, decodeError("Invalid request body", err))
+}
+
+// decodeError returns a FieldError for a JSON value of the wrong type, and
+// otherwise err prefixed with message
+func decodeError(message string, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return &FieldError{Field: typeErr.Field, Message: "must be " + jsonTypeName(typeErr.Type.Kind().String())}
+	}
+	return fmt.Errorf("%s: %v", message, err)
+}
+
+// jsonTypeName describes a Go kind or OpenAPI type as the JSON type a client
+// should send
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "an integer"
+	case strings.HasPrefix(kind, "float"), kind == "number":
+		return "a number"
+	case kind == "bool", kind == "boolean":
+		return "a boolean"
+	case kind == "string":
+		return "a string"
+	case kind == "slice", kind == "array":
+		return "an array"
+	default:
+		return "an object"
+	}
+}
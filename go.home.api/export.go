@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	exportFlushRows    = 1000  // rows written between flushes of CSV and NDJSON output
+	exportRowGroupRows = 50000 // rows per Parquet row group, bounding the memory per export
+)
+
+// exportFormats maps the format parameter to the response content type
+var exportFormats = map[string]string{
+	"csv":     "text/csv; charset=utf-8",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// exportRow is a row type that can be written in every export format
+type exportRow interface {
+	csvRecord() []string
+}
+
+// temperatureExportRow is a temperature reading as exported
+type temperatureExportRow struct {
+	ID        int       `json:"id" parquet:"id"`
+	Timestamp time.Time `json:"timestamp" parquet:"timestamp,timestamp(microsecond)"`
+	Location  string    `json:"location" parquet:"location,dict"`
+	Value     float64   `json:"value" parquet:"value"`
+	Humidity  *float64  `json:"humidity,omitempty" parquet:"humidity,optional"`
+	DewPoint  *float64  `json:"dew_point,omitempty" parquet:"dew_point,optional"`
+	DeviceID  string    `json:"device_id,omitempty" parquet:"device_id,dict"`
+}
+
+var temperatureExportHeader = []string{"id", "timestamp", "location", "value", "humidity", "dew_point", "device_id"}
+
+func (r temperatureExportRow) csvRecord() []string {
+	return []string{strconv.Itoa(r.ID), r.Timestamp.UTC().Format(time.RFC3339Nano), r.Location,
+		formatFloat(&r.Value), formatFloat(r.Humidity), formatFloat(r.DewPoint), r.DeviceID}
+}
+
+// pumpExportRow is a pump run time sample as exported
+type pumpExportRow struct {
+	ID         int       `json:"id" parquet:"id"`
+	Timestamp  time.Time `json:"timestamp" parquet:"timestamp,timestamp(microsecond)"`
+	RunTime    int       `json:"run_time" parquet:"run_time"`
+	Current    float64   `json:"current" parquet:"current"`
+	LowCurrent bool      `json:"low_current" parquet:"low_current"`
+	DeviceID   string    `json:"device_id,omitempty" parquet:"device_id,dict"`
+}
+
+var pumpExportHeader = []string{"id", "timestamp", "run_time", "current", "low_current", "device_id"}
+
+func (r pumpExportRow) csvRecord() []string {
+	return []string{strconv.Itoa(r.ID), r.Timestamp.UTC().Format(time.RFC3339Nano), strconv.Itoa(r.RunTime),
+		formatFloat(&r.Current), strconv.FormatBool(r.LowCurrent), r.DeviceID}
+}
+
+// formatFloat renders an optional number for CSV, empty when missing
+func formatFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+// exportParams holds the options shared by the export endpoints
+type exportParams struct {
+	Format   string
+	From, To time.Time
+	DeviceID string
+	Location string // temperatures only
+}
+
+func parseExportParams(r *http.Request) (exportParams, error) {
+	q := r.URL.Query()
+	p := exportParams{Format: q.Get("format"), DeviceID: q.Get("device_id"), Location: q.Get("location")}
+	if p.Format == "" {
+		p.Format = "csv"
+	}
+	if _, ok := exportFormats[p.Format]; !ok {
+		return p, errors.New("invalid format: must be csv, ndjson or parquet")
+	}
+	var err error
+	p.From, p.To, err = parseTimeRange(q)
+	return p, err
+}
+
+// filename names the download after the table and the requested range
+func (p exportParams) filename(table string) string {
+	name := table
+	if !p.From.IsZero() {
+		name += "_from_" + p.From.UTC().Format("20060102T150405Z")
+	}
+	if !p.To.IsZero() {
+		name += "_to_" + p.To.UTC().Format("20060102T150405Z")
+	}
+	return name + "." + p.Format
+}
+
+// rowWriter writes exported rows in one format
+type rowWriter[T exportRow] interface {
+	write(row *T) error
+	flush() error
+	close() error
+}
+
+type csvRowWriter[T exportRow] struct{ w *csv.Writer }
+
+func (c csvRowWriter[T]) write(row *T) error { return c.w.Write((*row).csvRecord()) }
+func (c csvRowWriter[T]) flush() error       { c.w.Flush(); return c.w.Error() }
+func (c csvRowWriter[T]) close() error       { return c.flush() }
+
+type ndjsonRowWriter[T exportRow] struct{ enc *json.Encoder }
+
+func (n ndjsonRowWriter[T]) write(row *T) error { return n.enc.Encode(row) }
+func (n ndjsonRowWriter[T]) flush() error       { return nil }
+func (n ndjsonRowWriter[T]) close() error       { return nil }
+
+type parquetRowWriter[T exportRow] struct {
+	w   *parquet.GenericWriter[T]
+	buf []T
+}
+
+func (p *parquetRowWriter[T]) write(row *T) error {
+	p.buf = append(p.buf, *row)
+	if len(p.buf) < exportFlushRows {
+		return nil
+	}
+	return p.flush()
+}
+
+func (p *parquetRowWriter[T]) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := p.w.Write(p.buf)
+	p.buf = p.buf[:0]
+	return err
+}
+
+func (p *parquetRowWriter[T]) close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	return p.w.Close()
+}
+
+// streamExport writes each row to the response as soon as the store reads it,
+// so exports of any size use constant memory
+func streamExport[T exportRow](w http.ResponseWriter, r *http.Request, p exportParams, table string, header []string,
+	query func(ctx context.Context, p exportParams) (rowCursor[T], error)) {
+	ctx := r.Context()
+
+	rows, err := query(ctx, p)
+	if err != nil {
+		writeError(w, "Failed to export "+table, http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer rows.Close()
+
+	// Exports can take longer than the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", exportFormats[p.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", p.filename(table)))
+	w.WriteHeader(http.StatusOK)
+
+	var out rowWriter[T]
+	switch p.Format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return
+		}
+		out = csvRowWriter[T]{w: cw}
+	case "ndjson":
+		out = ndjsonRowWriter[T]{enc: json.NewEncoder(w)}
+	case "parquet":
+		out = &parquetRowWriter[T]{w: parquet.NewGenericWriter[T](w, parquet.MaxRowsPerRowGroup(exportRowGroupRows))}
+	}
+
+	// Headers are sent by now, so failures can only end the response early
+	n := 0
+	for rows.Next() {
+		var row T
+		if err := rows.Scan(&row); err != nil {
+			log.Printf("Export of %s failed: %v", table, err)
+			return
+		}
+		if err := out.write(&row); err != nil {
+			logExportError(table, err)
+			return
+		}
+		if n++; n%exportFlushRows == 0 && p.Format != "parquet" {
+			if err := out.flush(); err != nil {
+				logExportError(table, err)
+				return
+			}
+			rc.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Export of %s failed: %v", table, err)
+		return
+	}
+	if err := out.close(); err != nil {
+		logExportError(table, err)
+	}
+}
+
+// logExportError logs write failures other than the client going away
+func logExportError(table string, err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) || strings.Contains(err.Error(), "broken pipe") {
+		return
+	}
+	log.Printf("Export of %s failed: %v", table, err)
+}
+
+func handleTemperatureExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, err := parseExportParams(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	streamExport(w, r, p, "temperatures", temperatureExportHeader, store.ExportTemperatures)
+}
+
+func handlePumpExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, err := parseExportParams(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	p.Location = ""
+	streamExport(w, r, p, "pump_run_times", pumpExportHeader, store.ExportPumpRunTimes)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestTemperatureExport(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	s.temperatures = []TemperatureReading{
+		{ID: 2, Value: 2, Location: "freezer", Timestamp: base.Add(time.Minute)},
+		{ID: 1, Value: 1, Location: "freezer", Timestamp: base},
+		{ID: 3, Value: 3, Location: "garage", Timestamp: base.Add(2 * time.Minute)},
+		{ID: 4, Value: 4, Location: "freezer", Timestamp: base.Add(time.Hour)},
+	}
+
+	w := serve(http.HandlerFunc(handleTemperatureExport), http.MethodGet,
+		"/tempmon/export?format=ndjson&location=freezer&from=2026-03-04T10:00:00Z&to=2026-03-04T11:00:00Z", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /tempmon/export = %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="temperatures_from_20260304T100000Z_to_20260304T110000Z.ndjson"`; got != want {
+		t.Errorf("Content-Disposition = %s, want %s", got, want)
+	}
+	var ids []int
+	for scanner := bufio.NewScanner(w.Body); scanner.Scan(); {
+		var row temperatureExportRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, row.ID)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("exported IDs %v, want [1 2] in time order", ids)
+	}
+
+	if w := serve(http.HandlerFunc(handleTemperatureExport), http.MethodGet, "/tempmon/export?format=xml", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("format=xml = %d, want 400", w.Code)
+	}
+}
+
+func TestPumpExport(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	s.runTimes = []PumpRunTime{
+		{ID: 1, RunTime: 2, Current: 8, Timestamp: base, DeviceID: "pump"},
+		{ID: 2, RunTime: 2, Current: 7, Timestamp: base, DeviceID: "other"},
+	}
+
+	w := serve(http.HandlerFunc(handlePumpExport), http.MethodGet, "/pumpmon/export?device_id=pump", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != exportFormats["csv"] {
+		t.Fatalf("GET /pumpmon/export = %d (%s): %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "1,") {
+		t.Errorf("exported %q, want the header and sample 1", lines)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, rewriting the file with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n got: %s\nwant: %s", name, got, want)
+	}
+}
+
+// exportFixture fills s with readings and samples covering every column,
+// including missing optional ones
+func exportFixture(s *memStore) {
+	base := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	humidity, dewPoint := 45.5, 22.25
+	s.temperatures = []TemperatureReading{
+		{ID: 1, Value: -2.5, Location: "freezer", Timestamp: base, DeviceID: "freezer-1"},
+		{ID: 2, Value: 68, Location: "living room", Timestamp: base.Add(1500 * time.Millisecond), Humidity: &humidity, DewPoint: &dewPoint},
+	}
+	s.runTimes = []PumpRunTime{
+		{ID: 1, RunTime: 2, Current: 8.25, Timestamp: base, DeviceID: "pump"},
+		{ID: 2, RunTime: 4, Current: 1.5, LowCurrent: true, Timestamp: base.Add(2 * time.Second)},
+	}
+}
+
+func TestExportCSVGolden(t *testing.T) {
+	exportFixture(useMemoryStore(t))
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		target  string
+		golden  string
+	}{
+		{handleTemperatureExport, "/tempmon/export?format=csv", "temperatures.csv"},
+		{handlePumpExport, "/pumpmon/export?format=csv", "pump_run_times.csv"},
+	} {
+		w := serve(tc.handler, http.MethodGet, tc.target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", tc.target, w.Code, w.Body)
+		}
+		checkGolden(t, tc.golden, w.Body.Bytes())
+	}
+}
+
+// TestExportParquetGolden pins the Parquet schema, whose column order and
+// types readers depend on, and reads the rows back. The file bytes themselves
+// include the writer version, so they are not compared.
+func TestExportParquetGolden(t *testing.T) {
+	s := useMemoryStore(t)
+	exportFixture(s)
+
+	w := serve(http.HandlerFunc(handleTemperatureExport), http.MethodGet, "/tempmon/export?format=parquet", "")
+	temperatures := readParquet[temperatureExportRow](t, w.Body.Bytes(), "temperatures.parquet.schema")
+	if len(temperatures) != 2 || temperatures[0].DeviceID != "freezer-1" || temperatures[0].Humidity != nil ||
+		temperatures[1].Humidity == nil || *temperatures[1].Humidity != 45.5 || !temperatures[1].Timestamp.Equal(s.temperatures[1].Timestamp) {
+		t.Errorf("read back temperatures %+v", temperatures)
+	}
+
+	w = serve(http.HandlerFunc(handlePumpExport), http.MethodGet, "/pumpmon/export?format=parquet", "")
+	runTimes := readParquet[pumpExportRow](t, w.Body.Bytes(), "pump_run_times.parquet.schema")
+	if len(runTimes) != 2 || runTimes[0].Current != 8.25 || !runTimes[1].LowCurrent || runTimes[1].DeviceID != "" {
+		t.Errorf("read back pump run times %+v", runTimes)
+	}
+}
+
+// readParquet checks the schema of a Parquet file against a golden file and
+// returns its rows
+func readParquet[T any](t *testing.T, data []byte, golden string) []T {
+	t.Helper()
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("invalid Parquet output: %v", err)
+	}
+	checkGolden(t, golden, []byte(f.Schema().String()+"\n"))
+
+	rows, err := parquet.Read[T](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("read Parquet rows: %v", err)
+	}
+	return rows
+}
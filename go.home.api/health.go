@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	readyTimeout   = 2 * time.Second  // bounds the checks run per /readyz request
+	dbRetryInitial = time.Second      // first wait between database connection attempts
+	dbRetryMax     = 30 * time.Second // the wait doubles up to this
+)
+
+var (
+	dbWaitTimeout   = 2 * time.Minute  // how long startup waits for the database (db_wait_timeout)
+	shutdownTimeout = 30 * time.Second // how long in-flight requests get to finish (shutdown_timeout)
+	shutdownDrain   = 5 * time.Second  // how long /readyz fails before the server stops accepting connections (shutdown_drain)
+
+	// shuttingDown is set once the server starts draining, so /readyz fails
+	// and load balancers stop sending requests
+	shuttingDown atomic.Bool
+)
+
+// HealthStatus is the body of /healthz and /readyz
+type HealthStatus struct {
+	Status string            `json:"status"`           // "ok" or "unavailable"
+	Checks map[string]string `json:"checks,omitempty"` // per check, "ok" or what failed
+}
+
+// waitForDB pings the database until it answers, backing off between
+// attempts, so the API can start before the database does
+func waitForDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dbWaitTimeout)
+	defer cancel()
+	wait := dbRetryInitial
+	for {
+		err := store.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Database not reachable, retrying in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, dbRetryMax)
+	}
+}
+
+// handleHealthz reports that the process is up. It does not touch the
+// database, so a database outage does not get the API restarted.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthStatus{Status: "ok"})
+}
+
+// handleReadyz reports whether the API can serve requests: the database is
+// reachable, its schema is current and the server is not shutting down
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	status := HealthStatus{Status: "ok", Checks: map[string]string{"database": "ok", "schema": "ok"}}
+	if err := store.Ping(ctx); err != nil {
+		status.Checks["database"] = err.Error()
+		status.Checks["schema"] = "not checked"
+	} else if current, latest, err := schemaVersions(ctx); err != nil {
+		status.Checks["schema"] = err.Error()
+	} else if current < latest {
+		status.Checks["schema"] = fmt.Sprintf("at version %d but version %d is required", current, latest)
+	}
+	if shuttingDown.Load() {
+		status.Checks["server"] = "shutting down"
+	}
+
+	code := http.StatusOK
+	for _, result := range status.Checks {
+		if result != "ok" {
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// shutdownServer fails readiness, keeps serving for shutdownDrain so load
+// balancers notice and stop sending new requests, then stops accepting
+// connections and waits up to shutdownTimeout for in-flight requests
+func shutdownServer(ctx context.Context, server *http.Server) error {
+	shuttingDown.Store(true)
+	if shutdownDrain > 0 {
+		log.Printf("Draining for %s before closing connections", shutdownDrain)
+		select {
+		case <-ctx.Done():
+		case <-time.After(shutdownDrain):
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	s := useMemoryStore(t)
+	s.pingErr = errors.New("connection refused")
+
+	// Liveness does not depend on the database
+	w := serve(http.HandlerFunc(handleHealthz), http.MethodGet, "/healthz", "")
+	var status HealthStatus
+	decodeBody(t, w, &status)
+	if w.Code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("GET /healthz = %d %+v, want 200 ok", w.Code, status)
+	}
+	if w := serve(http.HandlerFunc(handleHealthz), http.MethodPost, "/healthz", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /healthz = %d, want 405", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	latest, _ := latestMigration()
+	for _, tc := range []struct {
+		name         string
+		pingErr      error
+		version      int
+		shuttingDown bool
+		code         int
+		failed       string // the check that fails, if any
+	}{
+		{name: "ready", version: latest, code: http.StatusOK},
+		{name: "database down", pingErr: errors.New("connection refused"), version: latest, code: http.StatusServiceUnavailable, failed: "database"},
+		{name: "schema behind", version: latest - 1, code: http.StatusServiceUnavailable, failed: "schema"},
+		{name: "shutting down", version: latest, shuttingDown: true, code: http.StatusServiceUnavailable, failed: "server"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := useMemoryStore(t)
+			s.pingErr, s.schemaVersion = tc.pingErr, tc.version
+			shuttingDown.Store(tc.shuttingDown)
+			t.Cleanup(func() { shuttingDown.Store(false) })
+
+			w := serve(http.HandlerFunc(handleReadyz), http.MethodGet, "/readyz", "")
+			var status HealthStatus
+			decodeBody(t, w, &status)
+			if w.Code != tc.code {
+				t.Errorf("GET /readyz = %d %+v, want %d", w.Code, status, tc.code)
+			}
+			for check, result := range status.Checks {
+				if (result == "ok") == (check == tc.failed) && result != "not checked" {
+					t.Errorf("check %s = %q", check, result)
+				}
+			}
+			if tc.failed != "" && status.Status != "unavailable" {
+				t.Errorf("status = %q, want unavailable", status.Status)
+			}
+		})
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	useMemoryStore(t)
+	prevDrain, prevTimeout := shutdownDrain, shutdownTimeout
+	shutdownDrain, shutdownTimeout = 200*time.Millisecond, time.Second
+	t.Cleanup(func() {
+		shutdownDrain, shutdownTimeout = prevDrain, prevTimeout
+		shuttingDown.Store(false)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(handleReadyz)}
+	go server.Serve(ln)
+	url := "http://" + ln.Addr().String() + "/readyz"
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- shutdownServer(context.Background(), server) }()
+
+	// While draining, the server still answers, but is no longer ready
+	for !shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET /readyz while draining: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while draining = %d, want 503", resp.StatusCode)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("shutdownServer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < shutdownDrain {
+		t.Errorf("shutdown took %s, want at least the %s drain", elapsed, shutdownDrain)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Error("GET /readyz after shutdown succeeded, want the connection refused")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// idempotencyTTL is how long keys are remembered, set from idempotency_ttl
+var idempotencyTTL = 7 * 24 * time.Hour
+
+// idempotentRow identifies the row stored for an idempotency key
+type idempotentRow struct {
+	ID        int
+	Timestamp time.Time
+}
+
+// idempotencyKey builds the dedup key of a reading of the given kind. An
+// Idempotency-Key header wins; otherwise a (device, sequence) pair is used.
+// Both are scoped by the device, so two devices that happen to send the same
+// header do not collide. An empty result means the reading is not deduplicated.
+func idempotencyKey(kind, header, device string, sequence *int64) string {
+	if header != "" {
+		return kind + ":key:" + device + ":" + header
+	}
+	if sequence != nil && device != "" {
+		return kind + ":seq:" + device + ":" + strconv.FormatInt(*sequence, 10)
+	}
+	return ""
+}
+
+// claimIdempotencyKeys reserves every non-empty key. claimed[i] is true when
+// keys[i] was not seen before and this is its first occurrence in the request;
+// the reading must then be inserted and recorded. Other keyed readings are
+// retries of an earlier one.
+func claimIdempotencyKeys(ctx context.Context, tx *sql.Tx, keys []string) ([]bool, error) {
+	claimed := make([]bool, len(keys))
+	var unique []string
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if k != "" && !seen[k] {
+			seen[k] = true
+			unique = append(unique, k)
+		}
+	}
+	if len(unique) == 0 {
+		return claimed, nil
+	}
+
+	// A concurrent request holding the same key blocks this insert until it
+	// commits, after which the key counts as already used
+	rows, err := tx.QueryContext(ctx, `INSERT INTO idempotency_keys (key) SELECT unnest($1::text[]) ON CONFLICT (key) DO NOTHING RETURNING key`, pq.Array(unique))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fresh := map[string]bool{}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		fresh[k] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, k := range keys {
+		if fresh[k] {
+			claimed[i] = true
+			delete(fresh, k) // later duplicates in the same request are retries
+		}
+	}
+	return claimed, nil
+}
+
+// recordIdempotencyKeys stores the rows created for freshly claimed keys
+func recordIdempotencyKeys(ctx context.Context, tx *sql.Tx, keys []string, stored []idempotentRow) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(stored))
+	timestamps := make([]string, len(stored))
+	for i, row := range stored {
+		ids[i] = int64(row.ID)
+		timestamps[i] = row.Timestamp.Format(time.RFC3339Nano)
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE idempotency_keys k SET row_id = v.id, row_timestamp = v.ts
+		FROM unnest($1::text[], $2::integer[], $3::timestamptz[]) AS v(key, id, ts)
+		WHERE k.key = v.key`, pq.Array(keys), pq.Array(ids), pq.Array(timestamps))
+	return err
+}
+
+// lookupIdempotencyKey returns the row stored for a key that was already used
+func lookupIdempotencyKey(ctx context.Context, tx *sql.Tx, key string) (idempotentRow, error) {
+	var id sql.NullInt64
+	var ts sql.NullTime
+	err := tx.QueryRowContext(ctx, "SELECT row_id, row_timestamp FROM idempotency_keys WHERE key = $1", key).Scan(&id, &ts)
+	if err != nil {
+		return idempotentRow{}, err
+	}
+	if !id.Valid || !ts.Valid {
+		return idempotentRow{}, errors.New("idempotency key has no stored row")
+	}
+	return idempotentRow{ID: int(id.Int64), Timestamp: ts.Time}, nil
+}
+
+// pruneIdempotencyKeys periodically forgets keys older than idempotencyTTL
+func pruneIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		res, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().Add(-idempotencyTTL))
+		if err != nil {
+			log.Printf("Failed to prune idempotency keys: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d idempotency keys", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"go-home-api/notify"
+
+	"github.com/lib/pq"
+)
+
+// insertChunkSize bounds the rows per INSERT statement, keeping the bind
+// parameter count well under PostgreSQL's limit of 65535
+const insertChunkSize = 1000
+
+// maxClockSkew is how far in the future a device-supplied timestamp may be,
+// set from max_clock_skew
+var maxClockSkew = 5 * time.Minute
+
+// validateTimestamp rejects device timestamps too far in the future. A zero
+// timestamp is allowed and replaced with the time of insertion.
+func validateTimestamp(ts time.Time) error {
+	if !ts.IsZero() && ts.After(time.Now().Add(maxClockSkew)) {
+		return fieldErrorf("timestamp", "is more than %s in the future", maxClockSkew)
+	}
+	return nil
+}
+
+// validateTemperature checks a reading before it is stored
+func validateTemperature(reading *TemperatureReading) error {
+	if reading.Location == "" {
+		return fieldErrorf("location", "is required")
+	}
+	if reading.Humidity != nil && (*reading.Humidity < 0 || *reading.Humidity > 100) {
+		return fieldErrorf("humidity", "must be between 0 and 100")
+	}
+	return validateTimestamp(reading.Timestamp)
+}
+
+// validatePumpRunTime checks a pump sample before it is stored
+func validatePumpRunTime(rt *PumpRunTime) error {
+	if rt.RunTime < 0 {
+		return fieldErrorf("run_time", "must not be negative")
+	}
+	return validateTimestamp(rt.Timestamp)
+}
+
+// dewPoint derives the dew point in Fahrenheit from a temperature in
+// Fahrenheit and relative humidity in percent using the Magnus formula
+func dewPoint(tempF, humidity float64) *float64 {
+	if humidity <= 0 {
+		return nil
+	}
+	const b, c = 17.62, 243.12
+	tempC := (tempF - 32) / 1.8
+	gamma := math.Log(humidity/100) + b*tempC/(c+tempC)
+	dewF := c*gamma/(b-gamma)*1.8 + 32
+	dewF = math.Round(dewF*100) / 100
+	return &dewF
+}
+
+// nullFloat converts a nullable column to an optional JSON number
+func nullFloat(n sql.NullFloat64) *float64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Float64
+}
+
+// timestampOrNow returns ts, or now when the device didn't send one
+func timestampOrNow(ts, now time.Time) time.Time {
+	if ts.IsZero() {
+		return now
+	}
+	return ts
+}
+
+// insertRows writes n rows into table with multi-row INSERT statements.
+// values returns the column values of row i; when returning is set, scan is
+// called with each returned row in insertion order.
+func insertRows(ctx context.Context, tx *sql.Tx, table string, columns []string, n int, values func(i int) []interface{}, returning string, scan func(i int, rows *sql.Rows) error) error {
+	for start := 0; start < n; start += insertChunkSize {
+		end := min(start+insertChunkSize, n)
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		for i := start; i < end; i++ {
+			if i > start {
+				sb.WriteString(", ")
+			}
+			sb.WriteString("(")
+			for j := range columns {
+				if j > 0 {
+					sb.WriteString(", ")
+				}
+				fmt.Fprintf(&sb, "$%d", len(args)+j+1)
+			}
+			sb.WriteString(")")
+			args = append(args, values(i)...)
+		}
+
+		if returning == "" {
+			if _, err := tx.ExecContext(ctx, sb.String(), args...); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sb.WriteString(" RETURNING " + returning)
+		rows, err := tx.QueryContext(ctx, sb.String(), args...)
+		if err != nil {
+			return err
+		}
+		i := start
+		for rows.Next() {
+			if err := scan(i, rows); err != nil {
+				rows.Close()
+				return err
+			}
+			i++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTemperatures stores readings and fills in their IDs, timestamps and
+// dew points
+func insertTemperatures(ctx context.Context, tx *sql.Tx, readings []*TemperatureReading) error {
+	now := time.Now()
+	for _, reading := range readings {
+		reading.DewPoint = nil
+		if reading.Humidity != nil {
+			reading.DewPoint = dewPoint(reading.Value, *reading.Humidity)
+		}
+	}
+	return insertRows(ctx, tx, "temperatures", []string{"value", "location", "timestamp", "humidity", "dew_point", "device_id"}, len(readings),
+		func(i int) []interface{} {
+			return []interface{}{readings[i].Value, readings[i].Location, timestampOrNow(readings[i].Timestamp, now), readings[i].Humidity, readings[i].DewPoint, nullString(readings[i].DeviceID)}
+		},
+		"id, timestamp",
+		func(i int, rows *sql.Rows) error {
+			return rows.Scan(&readings[i].ID, &readings[i].Timestamp)
+		})
+}
+
+// insertPumpRunTimes stores pump samples and fills in their IDs and
+// timestamps. Low current samples are also copied to the critical table.
+func insertPumpRunTimes(ctx context.Context, tx *sql.Tx, runTimes []*PumpRunTime) error {
+	now := time.Now()
+	columns := []string{"run_time", "current", "low_current", "timestamp", "device_id"}
+	err := insertRows(ctx, tx, "pump_run_times", columns, len(runTimes),
+		func(i int) []interface{} {
+			return []interface{}{runTimes[i].RunTime, runTimes[i].Current, runTimes[i].LowCurrent, timestampOrNow(runTimes[i].Timestamp, now), nullString(runTimes[i].DeviceID)}
+		},
+		"id, timestamp",
+		func(i int, rows *sql.Rows) error {
+			return rows.Scan(&runTimes[i].ID, &runTimes[i].Timestamp)
+		})
+	if err != nil {
+		return err
+	}
+
+	var critical []*PumpRunTime
+	for _, rt := range runTimes {
+		if rt.LowCurrent {
+			critical = append(critical, rt)
+		}
+	}
+	if len(critical) == 0 {
+		return nil
+	}
+	return insertRows(ctx, tx, "pump_run_times_critical", columns, len(critical),
+		func(i int) []interface{} {
+			return []interface{}{critical[i].RunTime, critical[i].Current, critical[i].LowCurrent, critical[i].Timestamp, nullString(critical[i].DeviceID)}
+		}, "", nil)
+}
+
+// notifyRows queues a notification with each row as JSON on channel; they are
+// delivered to listeners when tx commits
+func notifyRows[T any](ctx context.Context, tx *sql.Tx, channel string, rows []*T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	payloads := make([]string, len(rows))
+	for i, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		payloads[i] = string(data)
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_notify($1, payload) FROM unnest($2::text[]) AS payload", channel, pq.Array(payloads))
+	return err
+}
+
+// ingestTemperatures inserts readings whose idempotency key (if any) is new
+// and fills in the stored row for the others. replayed[i] reports that
+// readings[i] is a retry of an earlier reading.
+func ingestTemperatures(ctx context.Context, tx *sql.Tx, readings []*TemperatureReading, keys []string) (replayed []bool, err error) {
+	claimed, err := claimIdempotencyKeys(ctx, tx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh []*TemperatureReading
+	var freshKeys []string
+	var freshRows []*TemperatureReading
+	replayed = make([]bool, len(readings))
+	for i, reading := range readings {
+		switch {
+		case keys[i] == "":
+			fresh = append(fresh, reading)
+		case claimed[i]:
+			fresh = append(fresh, reading)
+			freshKeys = append(freshKeys, keys[i])
+			freshRows = append(freshRows, reading)
+		default:
+			replayed[i] = true
+		}
+	}
+
+	if err := insertTemperatures(ctx, tx, fresh); err != nil {
+		return nil, err
+	}
+	if err := notifyRows(ctx, tx, notify.ChannelTemperature, fresh); err != nil {
+		return nil, err
+	}
+	stored := make([]idempotentRow, len(freshRows))
+	for i, reading := range freshRows {
+		stored[i] = idempotentRow{ID: reading.ID, Timestamp: reading.Timestamp}
+	}
+	if err := recordIdempotencyKeys(ctx, tx, freshKeys, stored); err != nil {
+		return nil, err
+	}
+
+	for i, reading := range readings {
+		if !replayed[i] {
+			continue
+		}
+		row, err := lookupIdempotencyKey(ctx, tx, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		reading.ID, reading.Timestamp = row.ID, row.Timestamp
+		// Report the values that were stored the first time
+		var humidity, dewPoint sql.NullFloat64
+		err = tx.QueryRowContext(ctx, "SELECT value, location, humidity, dew_point FROM temperatures WHERE id = $1 AND timestamp = $2", row.ID, row.Timestamp).
+			Scan(&reading.Value, &reading.Location, &humidity, &dewPoint)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil {
+			reading.Humidity, reading.DewPoint = nullFloat(humidity), nullFloat(dewPoint)
+		}
+	}
+	return replayed, nil
+}
+
+// ingestPumpRunTimes is the pump sample counterpart of ingestTemperatures
+func ingestPumpRunTimes(ctx context.Context, tx *sql.Tx, runTimes []*PumpRunTime, keys []string) (replayed []bool, err error) {
+	claimed, err := claimIdempotencyKeys(ctx, tx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh []*PumpRunTime
+	var freshKeys []string
+	var freshRows []*PumpRunTime
+	replayed = make([]bool, len(runTimes))
+	for i, rt := range runTimes {
+		switch {
+		case keys[i] == "":
+			fresh = append(fresh, rt)
+		case claimed[i]:
+			fresh = append(fresh, rt)
+			freshKeys = append(freshKeys, keys[i])
+			freshRows = append(freshRows, rt)
+		default:
+			replayed[i] = true
+		}
+	}
+
+	if err := insertPumpRunTimes(ctx, tx, fresh); err != nil {
+		return nil, err
+	}
+	if err := markLatePumpSamples(ctx, tx, fresh); err != nil {
+		return nil, err
+	}
+	if err := notifyRows(ctx, tx, notify.ChannelPump, fresh); err != nil {
+		return nil, err
+	}
+	stored := make([]idempotentRow, len(freshRows))
+	for i, rt := range freshRows {
+		stored[i] = idempotentRow{ID: rt.ID, Timestamp: rt.Timestamp}
+	}
+	if err := recordIdempotencyKeys(ctx, tx, freshKeys, stored); err != nil {
+		return nil, err
+	}
+
+	for i, rt := range runTimes {
+		if !replayed[i] {
+			continue
+		}
+		row, err := lookupIdempotencyKey(ctx, tx, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		rt.ID, rt.Timestamp = row.ID, row.Timestamp
+		// Report the values that were stored the first time
+		err = tx.QueryRowContext(ctx, "SELECT run_time, current, low_current FROM pump_run_times WHERE id = $1 AND timestamp = $2", row.ID, row.Timestamp).
+			Scan(&rt.RunTime, &rt.Current, &rt.LowCurrent)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return replayed, nil
+}
+
+// temperatureKey returns the idempotency key of a reading. The device defaults
+// to the location, which is how temperature monitors are identified today.
+func temperatureKey(header string, reading *TemperatureReading) string {
+	device := reading.DeviceID
+	if device == "" {
+		device = reading.Location
+	}
+	return idempotencyKey("temperature", header, device, reading.Sequence)
+}
+
+// pumpRunTimeKey returns the idempotency key of a pump sample. The device
+// defaults to "pump", the ID the pump monitor sends with its heartbeats.
+func pumpRunTimeKey(header string, rt *PumpRunTime) string {
+	device := rt.DeviceID
+	if device == "" {
+		device = "pump"
+	}
+	return idempotencyKey("pump", header, device, rt.Sequence)
+}
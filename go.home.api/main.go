@@ -8,27 +8,37 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq" // Import the PostgreSQL driver
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // TemperatureReading represents a single temperature measurement with location
 type TemperatureReading struct {
 	ID        int       `json:"id"`
-	Value     float64   `json:"value"`     // Temperature value in Fahrenheit
-	Location  string    `json:"location"`  // e.g., "freezer", "living room"
-	Timestamp time.Time `json:"timestamp"` // When the reading was taken
+	Value     float64   `json:"value"`               // Temperature value in Fahrenheit
+	Location  string    `json:"location"`            // e.g., "freezer", "living room"
+	Timestamp time.Time `json:"timestamp"`           // When the reading was taken
+	Humidity  *float64  `json:"humidity,omitempty"`  // Relative humidity in percent, if the sensor reports it
+	DewPoint  *float64  `json:"dew_point,omitempty"` // Dew point in Fahrenheit, derived from value and humidity
+	DeviceID  string    `json:"device_id,omitempty"` // Sending device, deduplicates retries together with sequence
+	Sequence  *int64    `json:"sequence,omitempty"`  // Per-device counter, deduplicates retries
 }
 
 // PumpRunTime represents a single water pump run time record
 type PumpRunTime struct {
 	ID         int       `json:"id"`
-	RunTime    int       `json:"run_time"`    // Run time in seconds
-	Current    float64   `json:"current"`     // current in amps
-	LowCurrent bool      `json:"low_current"` // 1 if low current, 0 if not
-	Timestamp  time.Time `json:"timestamp"`   // When the pump ran
+	RunTime    int       `json:"run_time"`            // Run time in seconds
+	Current    float64   `json:"current"`             // current in amps
+	LowCurrent bool      `json:"low_current"`         // 1 if low current, 0 if not
+	Timestamp  time.Time `json:"timestamp"`           // When the pump ran
+	DeviceID   string    `json:"device_id,omitempty"` // Sending device, deduplicates retries together with sequence
+	Sequence   *int64    `json:"sequence,omitempty"`  // Per-device counter, deduplicates retries
 }
 
 // DeviceHeartbeat represents a device's heartbeat with device identifier
@@ -57,133 +67,174 @@ func main() {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 	defer db.Close()
+	store = newPostgresStore(db)
 
 	ctx := context.Background()
 
-	// Create the temperatures table as a hypertable in TimescaleDB
-	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS temperatures (
-			id SERIAL,
-			value REAL NOT NULL,
-			location TEXT NOT NULL,
-			timestamp TIMESTAMPTZ DEFAULT NOW(),
-			PRIMARY KEY (id, timestamp)
-		);
-	`)
-	if err != nil {
-		log.Fatalf("Failed to create temperature table: %v", err)
-	}
+	// SIGTERM (docker stop) and Ctrl-C start a graceful shutdown
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Check if the table is already a hypertable
-	var isHypertable bool
-	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'temperatures')`).Scan(&isHypertable)
-	if err != nil {
-		log.Fatalf("Failed to check if table is a hypertable: %v", err)
+	if v := os.Getenv("db_wait_timeout"); v != "" {
+		if dbWaitTimeout, err = parseDayDuration(v); err != nil || dbWaitTimeout < 0 {
+			log.Fatalf("Invalid db_wait_timeout %q", v)
+		}
 	}
-
-	// Create hypertable only if it's not already a hypertable
-	if !isHypertable {
-		_, err = db.ExecContext(ctx, `SELECT create_hypertable('temperatures', 'timestamp');`)
-		if err != nil {
-			log.Fatalf("Failed to create hypertable: %v", err)
+	if v := os.Getenv("shutdown_timeout"); v != "" {
+		if shutdownTimeout, err = parseDayDuration(v); err != nil || shutdownTimeout < 0 {
+			log.Fatalf("Invalid shutdown_timeout %q", v)
+		}
+	}
+	if v := os.Getenv("shutdown_drain"); v != "" {
+		if shutdownDrain, err = parseDayDuration(v); err != nil || shutdownDrain < 0 {
+			log.Fatalf("Invalid shutdown_drain %q", v)
 		}
 	}
+	if err := waitForDB(sigCtx); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
 
-	// Create the pump_run_times table as a hypertable in TimescaleDB
-	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS pump_run_times (
-			id SERIAL,
-			run_time INTEGER NOT NULL,
-			current REAL NOT NULL,
-			low_current BOOLEAN NOT NULL,
-			timestamp TIMESTAMPTZ DEFAULT NOW(),
-			PRIMARY KEY (id, timestamp)
-		);
-	`)
-	if err != nil {
-		log.Fatalf("Failed to create pump_run_times table: %v", err)
+	// Device timestamp and retry deduplication settings
+	if v := os.Getenv("max_clock_skew"); v != "" {
+		if maxClockSkew, err = parseDayDuration(v); err != nil || maxClockSkew < 0 {
+			log.Fatalf("Invalid max_clock_skew %q", v)
+		}
 	}
-	// Check if the table is already a hypertable
-	isHypertable = false
-	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'pump_run_times')`).Scan(&isHypertable)
-	if err != nil {
-		log.Fatalf("Failed to check if table is a hypertable: %v", err)
+	if v := os.Getenv("idempotency_ttl"); v != "" {
+		if idempotencyTTL, err = parseDayDuration(v); err != nil || idempotencyTTL <= 0 {
+			log.Fatalf("Invalid idempotency_ttl %q", v)
+		}
 	}
 
-	// Create hypertable only if it's not already a hypertable
-	if !isHypertable {
-		_, err = db.ExecContext(ctx, `SELECT create_hypertable('pump_run_times', 'timestamp');`)
-		if err != nil {
-			log.Fatalf("Failed to create hypertable: %v", err)
+	requireRegisteredDevices = os.Getenv("require_registered_devices") == "true"
+	authDisabled = os.Getenv("api_auth") == "off"
+	if v := os.Getenv("pump_on_amps"); v != "" {
+		if pumpOnAmps, err = strconv.ParseFloat(v, 64); err != nil || pumpOnAmps < 0 {
+			log.Fatalf("Invalid pump_on_amps %q", v)
 		}
 	}
 
-	// Create the pump_run_times_critical table as a hypertable in TimescaleDB
-	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS pump_run_times_critical (
-			id SERIAL,
-			run_time INTEGER NOT NULL,
-			current REAL NOT NULL,
-			low_current BOOLEAN NOT NULL,
-			timestamp TIMESTAMPTZ DEFAULT NOW(),
-			PRIMARY KEY (id, timestamp)
-		);
-	`)
-	if err != nil {
-		log.Fatalf("Failed to create pump_run_times_critical table: %v", err)
+	// `go.home.api migrate ...` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(ctx, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
 	}
-	// Check if the table is already a hypertable
-	isHypertable = false
-	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'pump_run_times_critical')`).Scan(&isHypertable)
-	if err != nil {
-		log.Fatalf("Failed to check if table is a hypertable: %v", err)
+
+	// Apply pending migrations on startup when asked to, then refuse to serve
+	// against a schema that is behind
+	if os.Getenv("auto_migrate") == "true" {
+		if err := migrateUp(ctx, 0); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+	}
+	if err := checkSchema(ctx); err != nil {
+		log.Fatalf("Schema check failed: %v", err)
 	}
 
-	// Create hypertable only if it's not already a hypertable
-	if !isHypertable {
-		_, err = db.ExecContext(ctx, `SELECT create_hypertable('pump_run_times_critical', 'timestamp');`)
-		if err != nil {
-			log.Fatalf("Failed to create critical hypertable: %v", err)
+	// `go.home.api apikey ...` manages API keys and exits
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := runAPIKeyCommand(ctx, os.Args[2:]); err != nil {
+			log.Fatalf("API key command failed: %v", err)
 		}
+		return
 	}
 
-	// Create the device_heartbeats table as a hypertable in TimescaleDB
-	_, err = db.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS device_heartbeats (
-			id SERIAL,
-			device_id VARCHAR(255) NOT NULL,
-			pump BOOLEAN NOT NULL,
-			timestamp TIMESTAMPTZ DEFAULT NOW(),
-			PRIMARY KEY (id, timestamp)
-		);
-	`)
-	if err != nil {
-		log.Fatalf("Failed to create device_heartbeats table: %v", err)
+	// Apply retention/compression policies
+	if err := applyTablePolicies(ctx); err != nil {
+		log.Fatalf("Failed to apply table policies: %v", err)
 	}
-	// Check if the table is already a hypertable
-	isHypertable = false
-	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM timescaledb_information.hypertables WHERE hypertable_name = 'device_heartbeats')`).Scan(&isHypertable)
-	if err != nil {
-		log.Fatalf("Failed to check if table is a hypertable: %v", err)
+
+	// Background workers run until the server has drained
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	var workers sync.WaitGroup
+	runWorker := func(fn func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			fn(workerCtx)
+		}()
 	}
+	runWorker(pruneIdempotencyKeys)
+	runWorker(sessionizePumpCycles)
 
-	// Create hypertable only if it's not already a hypertable
-	if !isHypertable {
-		_, err = db.ExecContext(ctx, `SELECT create_hypertable('device_heartbeats', 'timestamp');`)
-		if err != nil {
-			log.Fatalf("Failed to create device_heartbeats hypertable: %v", err)
-		}
+	registerMetrics(db)
+
+	if err := loadOpenAPI(); err != nil {
+		log.Fatal(err)
 	}
+	validateResponses = os.Getenv("validate_responses") == "true"
 
 	// Define API endpoints
-	http.HandleFunc("/tempmon", handleTemperatures)       // GET all, POST new
+	http.HandleFunc("/tempmon", handleTemperatures)       // GET list, POST new
 	http.HandleFunc("/tempmon/", handleSingleTemperature) // GET, DELETE by ID
-	http.HandleFunc("/pumpmon", handlePumpRunTimes)       // GET all, POST new
-	http.HandleFunc("/pumpmon/", handleSinglePumpRunTime) // GET, DELETE by ID
+	http.HandleFunc("/tempmon/aggregate", handleTemperatureAggregate)
+	http.HandleFunc("/tempmon/batch", handleTemperatureBatch)   // POST array or NDJSON
+	http.HandleFunc("/tempmon/export", handleTemperatureExport) // GET as CSV, NDJSON or Parquet
+	http.HandleFunc("/pumpmon", handlePumpRunTimes)             // GET list, POST new
+	http.HandleFunc("/pumpmon/", handleSinglePumpRunTime)       // GET, DELETE by ID
+	http.HandleFunc("/pumpmon/aggregate", handlePumpAggregate)
+	http.HandleFunc("/pumpmon/batch", handlePumpRunTimeBatch) // POST array or NDJSON
+	http.HandleFunc("/pumpmon/export", handlePumpExport)      // GET as CSV, NDJSON or Parquet
+	http.HandleFunc("/pumpmon/cycles", handlePumpCycles)
+	http.HandleFunc("/pumpmon/stats", handlePumpStats)
 	http.HandleFunc("/heartbeat", handleDeviceHeartbeats)
-
-	fmt.Println("Server listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("/devices", handleDevices)       // GET list, POST new
+	http.HandleFunc("/devices/", handleSingleDevice) // GET, PUT/PATCH, DELETE (decommission) by ID
+	http.HandleFunc("/devices/status", handleDeviceStatus)
+	http.HandleFunc("/stream", handleStream)         // Server-Sent Events of new readings
+	http.HandleFunc("/apikeys", handleAPIKeys)       // GET list, POST new (admin)
+	http.HandleFunc("/apikeys/", handleSingleAPIKey) // DELETE (revoke) by ID (admin)
+	http.Handle("/metrics", promhttp.Handler())      // Prometheus metrics
+	http.HandleFunc("/openapi.json", handleOpenAPI)  // OpenAPI 3 document
+	http.HandleFunc("/healthz", handleHealthz)       // Liveness, without auth
+	http.HandleFunc("/readyz", handleReadyz)         // Readiness (database and schema), without auth
+
+	if authDisabled {
+		log.Println("API key authentication is disabled (api_auth=off)")
+	}
+
+	// Optionally take readings from an MQTT broker as well
+	mqttCfg, err := mqttConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if mqttCfg.Broker != "" {
+		runWorker(func(ctx context.Context) { runMQTT(ctx, mqttCfg) })
+	}
+
+	server := &http.Server{
+		Addr:              ":8080",
+		Handler:           instrumentRequests(http.DefaultServeMux, requireAPIKey(validateRequests(http.DefaultServeMux))),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute, // batch bodies can be large
+		WriteTimeout:      time.Minute, // /stream and the exports lift this for themselves
+		IdleTimeout:       2 * time.Minute,
+	}
+	// Shutdown does not wait for /stream clients to leave, so end their streams
+	server.RegisterOnShutdown(hub.close)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Server listening on :8080")
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-sigCtx.Done():
+	}
+	stop() // a second signal kills the process
+
+	// Fail readiness, drain in-flight requests, then stop the workers
+	log.Printf("Shutting down, waiting up to %s for requests to finish", shutdownDrain+shutdownTimeout)
+	if err := shutdownServer(ctx, server); err != nil {
+		log.Printf("Shutdown did not finish cleanly: %v", err)
+	}
+	stopWorkers()
+	workers.Wait()
+	log.Println("Server stopped")
 }
 
 // Device heartbeat handlers
@@ -192,53 +243,63 @@ func handleDeviceHeartbeats(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		createDeviceHeartbeat(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func createDeviceHeartbeat(w http.ResponseWriter, r *http.Request) {
 	var heartbeat DeviceHeartbeat
 	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to decode JSON: %v", err), http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
 
+	// Device keys may only send heartbeats for their own device
+	if key := deviceKey(r); key != nil {
+		if heartbeat.DeviceID == "" {
+			heartbeat.DeviceID = key.DeviceID
+		}
+		if heartbeat.DeviceID != key.DeviceID {
+			writeError(w, fmt.Sprintf("API key may only send heartbeats for device %q", key.DeviceID), http.StatusForbidden)
+			return
+		}
+	}
+
 	// Validate required fields
 	if heartbeat.DeviceID == "" {
-		http.Error(w, "Device ID is required", http.StatusBadRequest)
+		writeError(w, "Device ID is required", http.StatusBadRequest)
 		return
 	}
 
-	// Set the timestamp to now if not provided
-	if heartbeat.Timestamp.IsZero() {
-		heartbeat.Timestamp = time.Now()
+	if err := validateTimestamp(heartbeat.Timestamp); err != nil {
+		badRequest(w, err)
+		return
 	}
 
-	// Set the pump to false if not provided
-	if !heartbeat.Pump {
-		heartbeat.Pump = false
+	// Registered devices report their type from the registry; others keep
+	// the pump flag they sent
+	ctx := context.Background()
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		writeError(w, "Failed to load devices", http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
-
-	// Set pump to true if device_id is "pump" or "well pump"
-	if heartbeat.DeviceID == "pump" {
-		heartbeat.Pump = true
+	if err := devices.linkHeartbeat(&heartbeat); err != nil {
+		badRequest(w, err)
+		return
 	}
 
-	// Insert the new heartbeat
-	query := "INSERT INTO device_heartbeats (device_id, pump, timestamp) VALUES ($1, $2, $3) RETURNING id"
-	var id int
-	if err := db.QueryRow(query, heartbeat.DeviceID, heartbeat.Pump, heartbeat.Timestamp).Scan(&id); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to insert heartbeat: %v", err), http.StatusInternalServerError)
+	// Insert the new heartbeat; the ID comes back from RETURNING
+	if err := storeHeartbeat(ctx, &heartbeat); err != nil {
+		writeError(w, fmt.Sprintf("Failed to insert heartbeat: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Set the ID on the returned object
-	heartbeat.ID = id
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(heartbeat); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode JSON: %v", err), http.StatusInternalServerError)
+		writeError(w, fmt.Sprintf("Failed to encode JSON: %v", err), http.StatusInternalServerError)
 	}
 }
 
@@ -251,7 +312,7 @@ func handleTemperatures(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		createTemperature(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -259,7 +320,7 @@ func handleSingleTemperature(w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/tempmon/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		writeError(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
@@ -269,112 +330,89 @@ func handleSingleTemperature(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		deleteTemperature(w, r, id)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func getAllTemperatures(w http.ResponseWriter, r *http.Request) {
-	location := r.URL.Query().Get("location")
-	ctx := context.Background()
-
-	// Use a prepared statement to prevent SQL injection
-	query := "SELECT id, value, location, timestamp FROM temperatures"
-	var args []interface{}
-	if location != "" {
-		query += " WHERE location = $1" // Use $1 for prepared statement arguments in PostgreSQL
-		args = append(args, location)
-	}
-
-	stmt, err := db.PrepareContext(ctx, query)
+	page, err := parsePageParams(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
+		badRequest(w, err)
 		return
 	}
-	defer stmt.Close()
+	filter := readingFilter{Location: r.URL.Query().Get("location"), DeviceID: r.URL.Query().Get("device_id")}
+	ctx := context.Background()
 
-	rows, err := stmt.QueryContext(ctx, args...)
+	readings, err := store.ListTemperatures(ctx, filter, page)
 	if err != nil {
-		http.Error(w, "Failed to fetch temperatures", http.StatusInternalServerError)
+		writeError(w, "Failed to fetch temperatures", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	defer rows.Close()
 
-	var readings []TemperatureReading
-	for rows.Next() {
-		var reading TemperatureReading
-		if err := rows.Scan(&reading.ID, &reading.Value, &reading.Location, &reading.Timestamp); err != nil {
-			http.Error(w, "Failed to scan temperature reading", http.StatusInternalServerError)
-			log.Println(err)
-			return
-		}
-		readings = append(readings, reading)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(readings)
+	writePage(w, r, page, readings, func(last TemperatureReading) pageCursor {
+		return pageCursor{Timestamp: last.Timestamp, ID: last.ID}
+	})
 }
 
 func createTemperature(w http.ResponseWriter, r *http.Request) {
 	var newReading TemperatureReading
 	err := json.NewDecoder(r.Body).Decode(&newReading)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
 	ctx := context.Background()
 
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "INSERT INTO temperatures (value, location) VALUES ($1, $2) RETURNING id") // Use $1, $2 for prepared statement arguments in PostgreSQL and  RETURNING id
+	devices, err := loadDeviceIndex(ctx)
 	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
+		writeError(w, "Failed to load devices", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	defer stmt.Close()
-
-	var id int
-	err = stmt.QueryRowContext(ctx, newReading.Value, newReading.Location).Scan(&id) // get the ID
-	if err != nil {
-		http.Error(w, "Failed to create temperature reading", http.StatusInternalServerError)
-		log.Println(err)
+	if key := deviceKey(r); key != nil {
+		if err := key.claimTemperature(devices, &newReading); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if err := devices.linkTemperature(&newReading); err != nil {
+		badRequest(w, err)
+		return
+	}
+	if err := validateTemperature(&newReading); err != nil {
+		badRequest(w, err)
 		return
 	}
-	newReading.ID = id
 
-	// Fetch the created reading to get the timestamp
-	row := db.QueryRowContext(ctx, "SELECT id, value, location, timestamp FROM temperatures WHERE id = $1", id)
-	err = row.Scan(&newReading.ID, &newReading.Value, &newReading.Location, &newReading.Timestamp)
+	// Insert the reading unless it is a retry; the ID and timestamp come back from RETURNING
+	key := temperatureKey(r.Header.Get("Idempotency-Key"), &newReading)
+	replayed, err := storeTemperatures(ctx, []*TemperatureReading{&newReading}, []string{key})
 	if err != nil {
-		log.Println("Failed to retrieve created temperature reading:", err)
+		writeError(w, "Failed to create temperature reading", http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if replayed[0] {
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(newReading)
 }
 
 func getTemperature(w http.ResponseWriter, r *http.Request, id int) {
 	ctx := context.Background()
 
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "SELECT id, value, location, timestamp FROM temperatures WHERE id = $1") // Use $1 for prepared statement arguments in PostgreSQL
-	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRowContext(ctx, id)
-	var reading TemperatureReading
-	err = row.Scan(&reading.ID, &reading.Value, &reading.Location, &reading.Timestamp)
-	if err == sql.ErrNoRows {
-		http.NotFound(w, r)
+	reading, err := store.GetTemperature(ctx, id)
+	if err == errNotFound {
+		writeError(w, "Not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		http.Error(w, "Failed to fetch temperature reading", http.StatusInternalServerError)
+		writeError(w, "Failed to fetch temperature reading", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
@@ -386,18 +424,8 @@ func getTemperature(w http.ResponseWriter, r *http.Request, id int) {
 func deleteTemperature(w http.ResponseWriter, r *http.Request, id int) {
 	ctx := context.Background()
 
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "DELETE FROM temperatures WHERE id = $1") // Use $1 for prepared statement arguments in PostgreSQL
-	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.ExecContext(ctx, id)
-	if err != nil {
-		http.Error(w, "Failed to delete temperature reading", http.StatusInternalServerError)
+	if err := store.DeleteTemperature(ctx, id); err != nil {
+		writeError(w, "Failed to delete temperature reading", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
@@ -414,7 +442,7 @@ func handlePumpRunTimes(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		createPumpRunTime(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -422,7 +450,7 @@ func handleSinglePumpRunTime(w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Path[len("/pumpmon/"):]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		writeError(w, "Invalid ID", http.StatusBadRequest)
 		return
 	}
 
@@ -432,133 +460,93 @@ func handleSinglePumpRunTime(w http.ResponseWriter, r *http.Request) {
 	case http.MethodDelete:
 		deletePumpRunTime(w, r, id)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func getAllPumpRunTimes(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "SELECT id, run_time, current, low_current, timestamp FROM pump_run_times") // Corrected query
+	page, err := parsePageParams(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
+		badRequest(w, err)
 		return
 	}
-	defer stmt.Close()
+	filter := readingFilter{DeviceID: r.URL.Query().Get("device_id")}
+	ctx := context.Background()
 
-	rows, err := stmt.QueryContext(ctx)
+	runTimes, err := store.ListPumpRunTimes(ctx, filter, page)
 	if err != nil {
-		http.Error(w, "Failed to fetch pump run times", http.StatusInternalServerError)
+		writeError(w, "Failed to fetch pump run times", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	defer rows.Close()
 
-	var runTimes []PumpRunTime
-	for rows.Next() {
-		var rt PumpRunTime
-		var lowCurrentFromDB bool // Change to bool
-		if err := rows.Scan(&rt.ID, &rt.RunTime, &rt.Current, &lowCurrentFromDB, &rt.Timestamp); err != nil {
-			http.Error(w, "Failed to scan pump run time", http.StatusInternalServerError)
-			log.Println(err)
-			return
-		}
-		rt.LowCurrent = lowCurrentFromDB // Use the boolean value directly
-		runTimes = append(runTimes, rt)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(runTimes)
+	writePage(w, r, page, runTimes, func(last PumpRunTime) pageCursor {
+		return pageCursor{Timestamp: last.Timestamp, ID: last.ID}
+	})
 }
 
 func createPumpRunTime(w http.ResponseWriter, r *http.Request) {
 	var newRunTime PumpRunTime
 	err := json.NewDecoder(r.Body).Decode(&newRunTime)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
-
-	// Convert bool to int for SQLite
-	lowCurrentInt := 0
-	if newRunTime.LowCurrent {
-		lowCurrentInt = 1
-	}
 	ctx := context.Background()
 
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "INSERT INTO pump_run_times (run_time, current, low_current) VALUES ($1, $2, $3) RETURNING id") // Corrected query with RETURNING
+	devices, err := loadDeviceIndex(ctx)
 	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
+		writeError(w, "Failed to load devices", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	defer stmt.Close()
-
-	var id int
-	err = stmt.QueryRowContext(ctx, newRunTime.RunTime, newRunTime.Current, lowCurrentInt).Scan(&id)
-	if err != nil {
-		http.Error(w, "Failed to create pump run time", http.StatusInternalServerError)
-		log.Println(err)
+	if key := deviceKey(r); key != nil {
+		if err := key.claimPumpRunTime(devices, &newRunTime); err != nil {
+			writeError(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if err := devices.linkPumpRunTime(&newRunTime); err != nil {
+		badRequest(w, err)
 		return
 	}
-	newRunTime.ID = id
-
-	// If this is a critical reading (low_current = true), also insert into the critical table
-	if newRunTime.LowCurrent {
-		criticalStmt, err := db.PrepareContext(ctx, "INSERT INTO pump_run_times_critical (run_time, current, low_current) VALUES ($1, $2, $3)")
-		if err != nil {
-			log.Printf("Failed to prepare critical statement: %v", err)
-		} else {
-			defer criticalStmt.Close()
-			_, err = criticalStmt.ExecContext(ctx, newRunTime.RunTime, newRunTime.Current, lowCurrentInt)
-			if err != nil {
-				log.Printf("Failed to insert into critical table: %v", err)
-			}
-		}
+	if err := validatePumpRunTime(&newRunTime); err != nil {
+		badRequest(w, err)
+		return
 	}
 
-	// Fetch the created run time to get the timestamp
-	row := db.QueryRowContext(ctx, "SELECT id, run_time, current, low_current, timestamp FROM pump_run_times WHERE id = $1", id)
-	var lowCurrentFromDB bool // changed type to bool
-	err = row.Scan(&newRunTime.ID, &newRunTime.RunTime, &newRunTime.Current, &lowCurrentFromDB, &newRunTime.Timestamp)
+	// Insert the run time (and the critical copy for low current readings)
+	// unless it is a retry; the ID and timestamp come back from RETURNING
+	key := pumpRunTimeKey(r.Header.Get("Idempotency-Key"), &newRunTime)
+	replayed, err := storePumpRunTimes(ctx, []*PumpRunTime{&newRunTime}, []string{key})
 	if err != nil {
-		log.Println("Failed to retrieve created pump run time:", err)
+		writeError(w, "Failed to create pump run time", http.StatusInternalServerError)
+		log.Println(err)
+		return
 	}
-	newRunTime.LowCurrent = lowCurrentFromDB
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if replayed[0] {
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
 	json.NewEncoder(w).Encode(newRunTime)
 }
 
 func getPumpRunTime(w http.ResponseWriter, r *http.Request, id int) {
 	ctx := context.Background()
 
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "SELECT id, run_time, current, low_current, timestamp FROM pump_run_times WHERE id = $1") // Corrected query
-	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	defer stmt.Close()
-
-	row := stmt.QueryRowContext(ctx, id)
-	var rt PumpRunTime
-	var lowCurrentFromDB bool // Change to bool
-	err = row.Scan(&rt.ID, &rt.RunTime, &rt.Current, &lowCurrentFromDB, &rt.Timestamp)
-	if err == sql.ErrNoRows {
-		http.NotFound(w, r)
+	rt, err := store.GetPumpRunTime(ctx, id)
+	if err == errNotFound {
+		writeError(w, "Not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		http.Error(w, "Failed to fetch pump run time", http.StatusInternalServerError)
+		writeError(w, "Failed to fetch pump run time", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
-	rt.LowCurrent = lowCurrentFromDB
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rt)
@@ -566,18 +554,9 @@ func getPumpRunTime(w http.ResponseWriter, r *http.Request, id int) {
 
 func deletePumpRunTime(w http.ResponseWriter, r *http.Request, id int) {
 	ctx := context.Background()
-	// Use a prepared statement
-	stmt, err := db.PrepareContext(ctx, "DELETE FROM pump_run_times WHERE id = $1") // Corrected query
-	if err != nil {
-		http.Error(w, "Failed to prepare statement", http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, id)
-	if err != nil {
-		http.Error(w, "Failed to delete pump run time", http.StatusInternalServerError)
+	if err := store.DeletePumpRunTime(ctx, id); err != nil {
+		writeError(w, "Failed to delete pump run time", http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
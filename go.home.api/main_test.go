@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useMemoryStore points the package level store at a new memStore with the
+// given devices for the duration of the test
+func useMemoryStore(t *testing.T, devices ...Device) *memStore {
+	t.Helper()
+	s := newMemoryStore(devices...)
+	prev := store
+	store = s
+	t.Cleanup(func() { store = prev })
+	return s
+}
+
+// serve sends a request with an optional JSON body to handler and records
+// the response. Header pairs are name, value, name, value...
+func serve(handler http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// decodeBody decodes a JSON response into v, failing the test on bad JSON
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+}
+
+// nextCursor returns the cursor of the Link header, or "" on the last page
+func nextCursor(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	link := w.Header().Get("Link")
+	if link == "" {
+		return ""
+	}
+	target, _, _ := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+	next, err := url.Parse(target)
+	if err != nil {
+		t.Fatalf("invalid Link header %q: %v", link, err)
+	}
+	return next.Query().Get("cursor")
+}
+
+func TestTemperaturePagination(t *testing.T) {
+	useMemoryStore(t)
+	handler := http.HandlerFunc(handleTemperatures)
+
+	// Five readings, two of which share a timestamp so the ID breaks the tie
+	base := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for i, offset := range []int{0, 1, 1, 2, 3} {
+		body := fmt.Sprintf(`{"value": %d, "location": "freezer", "timestamp": %q}`, i, base.Add(time.Duration(offset)*time.Minute).Format(time.RFC3339))
+		if w := serve(handler, http.MethodPost, "/tempmon", body); w.Code != http.StatusCreated {
+			t.Fatalf("POST /tempmon = %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// Without an order the newest readings come first
+	for _, order := range []string{"asc", "desc", ""} {
+		var values []float64
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("order=%s: too many pages", order)
+			}
+			w := serve(handler, http.MethodGet, "/tempmon?limit=2&order="+order+"&cursor="+cursor, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /tempmon = %d: %s", w.Code, w.Body)
+			}
+			var page Page[TemperatureReading]
+			decodeBody(t, w, &page)
+			for _, reading := range page.Items {
+				values = append(values, reading.Value)
+			}
+			if cursor = nextCursor(t, w); cursor != page.NextCursor {
+				t.Fatalf("order=%s: Link cursor %q differs from next_cursor %q", order, cursor, page.NextCursor)
+			}
+			if cursor == "" {
+				break
+			}
+		}
+		want := "[4 3 2 1 0]"
+		if order == "asc" {
+			want = "[0 1 2 3 4]"
+		}
+		if got := fmt.Sprint(values); got != want {
+			t.Errorf("order=%s: got values %s, want %s", order, got, want)
+		}
+	}
+
+	w := serve(handler, http.MethodGet, "/tempmon?from="+url.QueryEscape(base.Add(time.Minute).Format(time.RFC3339))+"&to="+url.QueryEscape(base.Add(3*time.Minute).Format(time.RFC3339)), "")
+	var page Page[TemperatureReading]
+	decodeBody(t, w, &page)
+	if len(page.Items) != 3 || page.NextCursor != "" || w.Header().Get("Link") != "" {
+		t.Errorf("from/to returned %d readings with cursor %q and Link %q, want 3 and none", len(page.Items), page.NextCursor, w.Header().Get("Link"))
+	}
+}
+
+func TestTemperatureIdempotency(t *testing.T) {
+	s := useMemoryStore(t)
+	handler := http.HandlerFunc(handleTemperatures)
+
+	first := serve(handler, http.MethodPost, "/tempmon", `{"value": 1, "location": "freezer", "humidity": 50}`, "Idempotency-Key", "abc")
+	retry := serve(handler, http.MethodPost, "/tempmon", `{"value": 2, "location": "freezer"}`, "Idempotency-Key", "abc")
+	if first.Code != http.StatusCreated || retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("got %d then %d (replayed %q), want 201 then a replayed 200", first.Code, retry.Code, retry.Header().Get("Idempotent-Replayed"))
+	}
+	var stored, replayed TemperatureReading
+	decodeBody(t, first, &stored)
+	decodeBody(t, retry, &replayed)
+	if replayed.ID != stored.ID || replayed.Value != 1 || replayed.DewPoint == nil {
+		t.Errorf("replay returned %+v, want the first reading %+v", replayed, stored)
+	}
+
+	// The same device and sequence deduplicate without a header
+	for i := 0; i < 2; i++ {
+		serve(handler, http.MethodPost, "/tempmon", `{"value": 3, "location": "garage", "device_id": "garage", "sequence": 7}`)
+	}
+	if len(s.temperatures) != 2 {
+		t.Errorf("stored %d readings, want 2", len(s.temperatures))
+	}
+}
+
+func TestPumpRunTimeIdempotency(t *testing.T) {
+	s := useMemoryStore(t, Device{ID: "pump", Type: deviceTypePump, Name: "Well pump", Location: "wellpump", ExpectedInterval: 60})
+	handler := http.HandlerFunc(handlePumpRunTimes)
+
+	first := serve(handler, http.MethodPost, "/pumpmon", `{"run_time": 10, "current": 8}`, "Idempotency-Key", "abc")
+	retry := serve(handler, http.MethodPost, "/pumpmon", `{"run_time": 10, "current": 8}`, "Idempotency-Key", "abc")
+	if first.Code != http.StatusCreated || retry.Code != http.StatusOK {
+		t.Fatalf("got %d then %d, want 201 then 200", first.Code, retry.Code)
+	}
+	// The only registered pump claims samples that do not name a device
+	if len(s.runTimes) != 1 || s.runTimes[0].DeviceID != "pump" {
+		t.Errorf("stored %+v, want one sample of pump", s.runTimes)
+	}
+
+	w := serve(http.HandlerFunc(handleSinglePumpRunTime), http.MethodGet, fmt.Sprintf("/pumpmon/%d", s.runTimes[0].ID), "")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /pumpmon/{id} = %d", w.Code)
+	}
+	if w := serve(http.HandlerFunc(handleSinglePumpRunTime), http.MethodGet, "/pumpmon/999", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /pumpmon/999 = %d, want 404", w.Code)
+	}
+}
+
+func TestSingleTemperature(t *testing.T) {
+	s := useMemoryStore(t)
+	s.temperatures = []TemperatureReading{{ID: 1, Value: 5, Location: "freezer", Timestamp: time.Now()}}
+	handler := http.HandlerFunc(handleSingleTemperature)
+
+	w := serve(handler, http.MethodGet, "/tempmon/1", "")
+	var reading TemperatureReading
+	decodeBody(t, w, &reading)
+	if w.Code != http.StatusOK || reading.ID != 1 || reading.Location != "freezer" {
+		t.Errorf("GET /tempmon/1 = %d %+v, want reading 1", w.Code, reading)
+	}
+	for target, want := range map[string]int{"/tempmon/2": http.StatusNotFound, "/tempmon/abc": http.StatusBadRequest} {
+		if w := serve(handler, http.MethodGet, target, ""); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, want)
+		}
+	}
+
+	if w := serve(handler, http.MethodDelete, "/tempmon/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /tempmon/1 = %d, want 204", w.Code)
+	}
+	if len(s.temperatures) != 0 {
+		t.Errorf("%d readings left after DELETE, want 0", len(s.temperatures))
+	}
+	if w := serve(handler, http.MethodGet, "/tempmon/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /tempmon/1 after DELETE = %d, want 404", w.Code)
+	}
+}
+
+func TestPumpRunTimeList(t *testing.T) {
+	s := useMemoryStore(t)
+	base := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for i := 1; i <= 3; i++ {
+		s.runTimes = append(s.runTimes, PumpRunTime{ID: i, RunTime: i, Current: 7, DeviceID: "pump", Timestamp: base.Add(time.Duration(i) * time.Minute)})
+	}
+	s.runTimes = append(s.runTimes, PumpRunTime{ID: 4, RunTime: 1, Current: 7, DeviceID: "other", Timestamp: base})
+
+	w := serve(http.HandlerFunc(handlePumpRunTimes), http.MethodGet, "/pumpmon?device_id=pump&limit=2", "")
+	var page Page[PumpRunTime]
+	decodeBody(t, w, &page)
+	if w.Code != http.StatusOK || len(page.Items) != 2 || page.Items[0].ID != 3 || page.NextCursor == "" {
+		t.Fatalf("GET /pumpmon = %d %+v, want samples 3 and 2 and a cursor", w.Code, page)
+	}
+	cursor := page.NextCursor
+	page = Page[PumpRunTime]{}
+	decodeBody(t, serve(http.HandlerFunc(handlePumpRunTimes), http.MethodGet, "/pumpmon?device_id=pump&limit=2&cursor="+cursor, ""), &page)
+	if len(page.Items) != 1 || page.Items[0].ID != 1 || page.NextCursor != "" {
+		t.Errorf("second page = %+v, want sample 1 and no cursor", page)
+	}
+
+	if w := serve(http.HandlerFunc(handleSinglePumpRunTime), http.MethodDelete, "/pumpmon/2", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /pumpmon/2 = %d, want 204", w.Code)
+	}
+	if w := serve(http.HandlerFunc(handleSinglePumpRunTime), http.MethodGet, "/pumpmon/2", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /pumpmon/2 after DELETE = %d, want 404", w.Code)
+	}
+}
+
+func TestIdempotencyKeyScopedByDevice(t *testing.T) {
+	s := useMemoryStore(t)
+	handler := http.HandlerFunc(handleTemperatures)
+
+	// The same header from two locations stores both readings
+	freezer := serve(handler, http.MethodPost, "/tempmon", `{"value": 1, "location": "freezer"}`, "Idempotency-Key", "boot-1")
+	garage := serve(handler, http.MethodPost, "/tempmon", `{"value": 2, "location": "garage"}`, "Idempotency-Key", "boot-1")
+	if freezer.Code != http.StatusCreated || garage.Code != http.StatusCreated {
+		t.Fatalf("got %d and %d, want both 201", freezer.Code, garage.Code)
+	}
+	if retry := serve(handler, http.MethodPost, "/tempmon", `{"value": 2, "location": "garage"}`, "Idempotency-Key", "boot-1"); retry.Code != http.StatusOK {
+		t.Errorf("retry from garage = %d, want 200", retry.Code)
+	}
+	if len(s.temperatures) != 2 {
+		t.Errorf("stored %d readings, want 2", len(s.temperatures))
+	}
+
+	for _, tc := range []struct {
+		header, device string
+		sequence       *int64
+		want           string
+	}{
+		{"abc", "freezer", nil, "temperature:key:freezer:abc"},
+		{"", "freezer", new(int64), "temperature:seq:freezer:0"},
+		{"", "freezer", nil, ""},
+	} {
+		if got := idempotencyKey("temperature", tc.header, tc.device, tc.sequence); got != tc.want {
+			t.Errorf("idempotencyKey(%q, %q) = %q, want %q", tc.header, tc.device, got, tc.want)
+		}
+	}
+}
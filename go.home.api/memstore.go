@@ -0,0 +1,741 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStore is a Store that keeps everything in memory. It follows pgStore's
+// semantics (IDs, default timestamps, dew points, idempotency keys and
+// keyset pagination) so handlers can be exercised with httptest without
+// TimescaleDB.
+type memStore struct {
+	mu           sync.Mutex
+	nextID       int
+	temperatures []TemperatureReading
+	runTimes     []PumpRunTime
+	heartbeats   []DeviceHeartbeat
+	keys         map[string]int // idempotency key to the ID stored for it
+	devices      []Device
+	apiKeys      []APIKey
+	apiKeyHashes map[int]string // API key ID to the hash of its secret
+	cycles       []PumpCycle    // set by tests, as memStore does not sessionize
+
+	pingErr       error // returned by Ping, to simulate an unreachable database
+	schemaVersion int   // the latest migration unless set
+}
+
+func newMemoryStore(devices ...Device) *memStore {
+	s := &memStore{keys: map[string]int{}, devices: devices, apiKeyHashes: map[int]string{}}
+	s.schemaVersion, _ = latestMigration()
+	return s
+}
+
+func (s *memStore) id() int {
+	s.nextID++
+	return s.nextID
+}
+
+// claim reports whether key is new and, if not, the ID stored for it
+func (s *memStore) claim(key string) (existing int, fresh bool) {
+	if key == "" {
+		return 0, true
+	}
+	if id, ok := s.keys[key]; ok {
+		return id, false
+	}
+	return 0, true
+}
+
+// pageRows applies the time range, order, cursor and limit of page to rows,
+// returning up to page.Limit+1 of them like pageParams.clause does
+func pageRows[T any](rows []T, page pageParams, key func(T) (time.Time, int)) []T {
+	var out []T
+	for _, row := range rows {
+		ts, id := key(row)
+		if !page.From.IsZero() && ts.Before(page.From) {
+			continue
+		}
+		if !page.To.IsZero() && !ts.Before(page.To) {
+			continue
+		}
+		// Keep only rows beyond the cursor in the requested order
+		if c := page.After; c != nil {
+			cmp := compareKeys(ts, id, c.Timestamp, c.ID)
+			if page.Desc && cmp >= 0 || !page.Desc && cmp <= 0 {
+				continue
+			}
+		}
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ti, ii := key(out[i])
+		tj, ij := key(out[j])
+		if page.Desc {
+			return compareKeys(ti, ii, tj, ij) > 0
+		}
+		return compareKeys(ti, ii, tj, ij) < 0
+	})
+	if len(out) > page.Limit+1 {
+		out = out[:page.Limit+1]
+	}
+	return out
+}
+
+// compareKeys orders rows by timestamp and then ID, like ORDER BY timestamp, id
+func compareKeys(ts1 time.Time, id1 int, ts2 time.Time, id2 int) int {
+	if c := ts1.Compare(ts2); c != 0 {
+		return c
+	}
+	return id1 - id2
+}
+
+func (s *memStore) ListTemperatures(_ context.Context, filter readingFilter, page pageParams) ([]TemperatureReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matching := []TemperatureReading{}
+	for _, reading := range s.temperatures {
+		if (filter.Location == "" || reading.Location == filter.Location) && (filter.DeviceID == "" || reading.DeviceID == filter.DeviceID) {
+			matching = append(matching, reading)
+		}
+	}
+	readings := pageRows(matching, page, func(r TemperatureReading) (time.Time, int) { return r.Timestamp, r.ID })
+	if readings == nil {
+		readings = []TemperatureReading{}
+	}
+	return readings, nil
+}
+
+func (s *memStore) GetTemperature(_ context.Context, id int) (TemperatureReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, reading := range s.temperatures {
+		if reading.ID == id {
+			return reading, nil
+		}
+	}
+	return TemperatureReading{}, errNotFound
+}
+
+func (s *memStore) DeleteTemperature(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, reading := range s.temperatures {
+		if reading.ID == id {
+			s.temperatures = append(s.temperatures[:i], s.temperatures[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertTemperatures(_ context.Context, readings []*TemperatureReading, keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	replayed := make([]bool, len(readings))
+	for i, reading := range readings {
+		if id, fresh := s.claim(keys[i]); !fresh {
+			// Report the values that were stored the first time
+			for _, stored := range s.temperatures {
+				if stored.ID == id {
+					reading.ID, reading.Timestamp = stored.ID, stored.Timestamp
+					reading.Value, reading.Location = stored.Value, stored.Location
+					reading.Humidity, reading.DewPoint = stored.Humidity, stored.DewPoint
+				}
+			}
+			replayed[i] = true
+			continue
+		}
+		reading.ID = s.id()
+		reading.Timestamp = timestampOrNow(reading.Timestamp, now)
+		reading.DewPoint = nil
+		if reading.Humidity != nil {
+			reading.DewPoint = dewPoint(reading.Value, *reading.Humidity)
+		}
+		if keys[i] != "" {
+			s.keys[keys[i]] = reading.ID
+		}
+		stored := *reading
+		stored.Sequence = nil
+		s.temperatures = append(s.temperatures, stored)
+	}
+	return replayed, nil
+}
+
+func (s *memStore) ListPumpRunTimes(_ context.Context, filter readingFilter, page pageParams) ([]PumpRunTime, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matching := []PumpRunTime{}
+	for _, rt := range s.runTimes {
+		if filter.DeviceID == "" || rt.DeviceID == filter.DeviceID {
+			matching = append(matching, rt)
+		}
+	}
+	runTimes := pageRows(matching, page, func(rt PumpRunTime) (time.Time, int) { return rt.Timestamp, rt.ID })
+	if runTimes == nil {
+		runTimes = []PumpRunTime{}
+	}
+	return runTimes, nil
+}
+
+func (s *memStore) GetPumpRunTime(_ context.Context, id int) (PumpRunTime, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rt := range s.runTimes {
+		if rt.ID == id {
+			return rt, nil
+		}
+	}
+	return PumpRunTime{}, errNotFound
+}
+
+func (s *memStore) DeletePumpRunTime(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, rt := range s.runTimes {
+		if rt.ID == id {
+			s.runTimes = append(s.runTimes[:i], s.runTimes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStore) InsertPumpRunTimes(_ context.Context, runTimes []*PumpRunTime, keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	replayed := make([]bool, len(runTimes))
+	for i, rt := range runTimes {
+		if id, fresh := s.claim(keys[i]); !fresh {
+			for _, stored := range s.runTimes {
+				if stored.ID == id {
+					rt.ID, rt.Timestamp = stored.ID, stored.Timestamp
+					rt.RunTime, rt.Current, rt.LowCurrent = stored.RunTime, stored.Current, stored.LowCurrent
+				}
+			}
+			replayed[i] = true
+			continue
+		}
+		rt.ID = s.id()
+		rt.Timestamp = timestampOrNow(rt.Timestamp, now)
+		if keys[i] != "" {
+			s.keys[keys[i]] = rt.ID
+		}
+		stored := *rt
+		stored.Sequence = nil
+		s.runTimes = append(s.runTimes, stored)
+	}
+	return replayed, nil
+}
+
+func (s *memStore) InsertHeartbeat(_ context.Context, heartbeat *DeviceHeartbeat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	heartbeat.ID = s.id()
+	heartbeat.Timestamp = timestampOrNow(heartbeat.Timestamp, time.Now())
+	s.heartbeats = append(s.heartbeats, *heartbeat)
+	return nil
+}
+
+func (s *memStore) ActiveDevices(_ context.Context) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var devices []Device
+	for _, d := range s.devices {
+		if d.DecommissionedAt == nil {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (s *memStore) ListDevices(_ context.Context, filter deviceFilter) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := []Device{}
+	for _, d := range s.devices {
+		if (filter.IncludeDecommissioned || d.DecommissionedAt == nil) && (filter.Type == "" || d.Type == filter.Type) {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices, nil
+}
+
+func (s *memStore) device(id string) int {
+	return slices.IndexFunc(s.devices, func(d Device) bool { return d.ID == id })
+}
+
+// conflicts reports whether d would break the unique ID or the unique active
+// type and location of devices_active_location_idx; skip is the index of the
+// stored version of d, or -1
+func (s *memStore) conflicts(d Device, skip int) bool {
+	for i, other := range s.devices {
+		if i == skip {
+			continue
+		}
+		if other.ID == d.ID {
+			return true
+		}
+		if d.Location != "" && other.DecommissionedAt == nil && other.Type == d.Type && other.Location == d.Location {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memStore) GetDevice(_ context.Context, id string) (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.device(id); i >= 0 {
+		return s.devices[i], nil
+	}
+	return Device{}, errNotFound
+}
+
+func (s *memStore) CreateDevice(_ context.Context, d *Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conflicts(*d, -1) {
+		return errConflict
+	}
+	d.CreatedAt = time.Now()
+	d.UpdatedAt, d.DecommissionedAt = d.CreatedAt, nil
+	s.devices = append(s.devices, *d)
+	return nil
+}
+
+func (s *memStore) UpdateDevice(_ context.Context, id string, apply func(d *Device) error) (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.device(id)
+	if i < 0 {
+		return Device{}, errNotFound
+	}
+	d := s.devices[i]
+	if err := apply(&d); err != nil {
+		return d, err
+	}
+	// Only the fields the UPDATE in pgStore sets are kept
+	stored := s.devices[i]
+	stored.Type, stored.Name, stored.Location = d.Type, d.Name, d.Location
+	stored.FirmwareVersion, stored.ExpectedInterval = d.FirmwareVersion, d.ExpectedInterval
+	if stored.DecommissionedAt == nil && s.conflicts(stored, i) {
+		return d, errConflict
+	}
+	stored.UpdatedAt = time.Now()
+	s.devices[i] = stored
+	return stored, nil
+}
+
+func (s *memStore) DecommissionDevice(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.device(id)
+	if i < 0 {
+		return errNotFound
+	}
+	now := time.Now()
+	if s.devices[i].DecommissionedAt == nil {
+		s.devices[i].DecommissionedAt = &now
+	}
+	s.devices[i].UpdatedAt = now
+	return nil
+}
+
+func (s *memStore) InsertAPIKey(_ context.Context, k *APIKey, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k.ID = s.id()
+	k.CreatedAt = time.Now()
+	k.LastUsedAt, k.RevokedAt = nil, nil
+	s.apiKeys = append(s.apiKeys, *k)
+	s.apiKeyHashes[k.ID] = hash
+	return nil
+}
+
+func (s *memStore) ListAPIKeys(_ context.Context) ([]APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]APIKey{}, s.apiKeys...), nil
+}
+
+func (s *memStore) apiKey(id int) int {
+	return slices.IndexFunc(s.apiKeys, func(k APIKey) bool { return k.ID == id })
+}
+
+func (s *memStore) RevokeAPIKey(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.apiKey(id)
+	if i < 0 {
+		return errNotFound
+	}
+	if s.apiKeys[i].RevokedAt == nil {
+		now := time.Now()
+		s.apiKeys[i].RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *memStore) APIKeyByHash(_ context.Context, hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.apiKeys {
+		if k.RevokedAt == nil && s.apiKeyHashes[k.ID] == hash {
+			return k, nil
+		}
+	}
+	return APIKey{}, errNotFound
+}
+
+func (s *memStore) TouchAPIKey(_ context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.apiKey(id); i >= 0 {
+		now := time.Now()
+		s.apiKeys[i].LastUsedAt = &now
+	}
+	return nil
+}
+
+// timeBucketOrigin is where TimescaleDB's time_bucket starts counting buckets
+var timeBucketOrigin = time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)
+
+// timeBucket returns the start of the bucket of the given width containing ts,
+// like time_bucket does
+func timeBucket(width time.Duration, ts time.Time) time.Time {
+	d := ts.Sub(timeBucketOrigin)
+	b := d / width * width
+	if d < 0 && d%width != 0 {
+		b -= width
+	}
+	return timeBucketOrigin.Add(b).In(ts.Location())
+}
+
+// inRange reports whether ts is within [from, to); zero bounds are open
+func inRange(ts, from, to time.Time) bool {
+	return (from.IsZero() || !ts.Before(from)) && (to.IsZero() || ts.Before(to))
+}
+
+// AggregateTemperatures computes the buckets from the readings; unlike
+// pgStore it has no continuous aggregates, so the range is never widened
+func (s *memStore) AggregateTemperatures(_ context.Context, q aggregateQuery) ([]TemperatureAggregate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type group struct {
+		a                        TemperatureAggregate
+		sum, humiditySum, dewSum float64
+		humidityCount, dewCount  int
+		minHumidity, maxHumidity float64
+	}
+	groups := map[string]*group{}
+	var order []*group
+	for _, reading := range s.temperatures {
+		if !inRange(reading.Timestamp, q.From, q.To) || q.Location != "" && reading.Location != q.Location {
+			continue
+		}
+		bucket := timeBucket(q.Bucket, reading.Timestamp)
+		key := bucket.UTC().Format(time.RFC3339Nano) + "|" + reading.Location
+		g, ok := groups[key]
+		if !ok {
+			g = &group{a: TemperatureAggregate{Bucket: bucket, Location: reading.Location, Min: math.Inf(1), Max: math.Inf(-1)},
+				minHumidity: math.Inf(1), maxHumidity: math.Inf(-1)}
+			groups[key] = g
+			order = append(order, g)
+		}
+		g.a.Min, g.a.Max = math.Min(g.a.Min, reading.Value), math.Max(g.a.Max, reading.Value)
+		g.sum += reading.Value
+		g.a.Count++
+		if reading.Humidity != nil {
+			g.minHumidity, g.maxHumidity = math.Min(g.minHumidity, *reading.Humidity), math.Max(g.maxHumidity, *reading.Humidity)
+			g.humiditySum += *reading.Humidity
+			g.humidityCount++
+		}
+		if reading.DewPoint != nil {
+			g.dewSum += *reading.DewPoint
+			g.dewCount++
+		}
+	}
+
+	aggregates := []TemperatureAggregate{}
+	for _, g := range order {
+		g.a.Avg = g.sum / float64(g.a.Count)
+		if g.humidityCount > 0 {
+			avg := g.humiditySum / float64(g.humidityCount)
+			g.a.MinHumidity, g.a.MaxHumidity, g.a.AvgHumidity = &g.minHumidity, &g.maxHumidity, &avg
+		}
+		if g.dewCount > 0 {
+			avg := g.dewSum / float64(g.dewCount)
+			g.a.AvgDewPoint = &avg
+		}
+		aggregates = append(aggregates, g.a)
+	}
+	slices.SortFunc(aggregates, func(a, b TemperatureAggregate) int {
+		if c := a.Bucket.Compare(b.Bucket); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Location, b.Location)
+	})
+	return aggregates, nil
+}
+
+func (s *memStore) AggregatePumpRunTimes(_ context.Context, q aggregateQuery) ([]PumpAggregate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	groups := map[time.Time]*PumpAggregate{}
+	sums := map[time.Time]float64{}
+	for _, rt := range s.runTimes {
+		if !inRange(rt.Timestamp, q.From, q.To) {
+			continue
+		}
+		bucket := timeBucket(q.Bucket, rt.Timestamp).UTC()
+		a, ok := groups[bucket]
+		if !ok {
+			a = &PumpAggregate{Bucket: bucket, MinCurrent: math.Inf(1), MaxCurrent: math.Inf(-1)}
+			groups[bucket] = a
+		}
+		a.MinCurrent, a.MaxCurrent = math.Min(a.MinCurrent, rt.Current), math.Max(a.MaxCurrent, rt.Current)
+		a.MaxRunTime = max(a.MaxRunTime, rt.RunTime)
+		if rt.LowCurrent {
+			a.LowCurrentCount++
+		}
+		a.Count++
+		sums[bucket] += rt.Current
+	}
+
+	aggregates := []PumpAggregate{}
+	for bucket, a := range groups {
+		a.AvgCurrent = sums[bucket] / float64(a.Count)
+		aggregates = append(aggregates, *a)
+	}
+	slices.SortFunc(aggregates, func(a, b PumpAggregate) int { return a.Bucket.Compare(b.Bucket) })
+	return aggregates, nil
+}
+
+// sliceCursor is the rowCursor over rows already in memory
+type sliceCursor[T any] struct {
+	rows []T
+	next int
+}
+
+func (c *sliceCursor[T]) Next() bool {
+	c.next++
+	return c.next <= len(c.rows)
+}
+
+func (c *sliceCursor[T]) Scan(row *T) error {
+	*row = c.rows[c.next-1]
+	return nil
+}
+
+func (c *sliceCursor[T]) Err() error   { return nil }
+func (c *sliceCursor[T]) Close() error { return nil }
+
+func (s *memStore) ExportTemperatures(_ context.Context, p exportParams) (rowCursor[temperatureExportRow], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows []temperatureExportRow
+	for _, r := range s.temperatures {
+		if inRange(r.Timestamp, p.From, p.To) && (p.Location == "" || r.Location == p.Location) && (p.DeviceID == "" || r.DeviceID == p.DeviceID) {
+			rows = append(rows, temperatureExportRow{ID: r.ID, Timestamp: r.Timestamp, Location: r.Location, Value: r.Value,
+				Humidity: r.Humidity, DewPoint: r.DewPoint, DeviceID: r.DeviceID})
+		}
+	}
+	slices.SortFunc(rows, func(a, b temperatureExportRow) int { return compareKeys(a.Timestamp, a.ID, b.Timestamp, b.ID) })
+	return &sliceCursor[temperatureExportRow]{rows: rows}, nil
+}
+
+func (s *memStore) ExportPumpRunTimes(_ context.Context, p exportParams) (rowCursor[pumpExportRow], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows []pumpExportRow
+	for _, rt := range s.runTimes {
+		if inRange(rt.Timestamp, p.From, p.To) && (p.DeviceID == "" || rt.DeviceID == p.DeviceID) {
+			rows = append(rows, pumpExportRow{ID: rt.ID, Timestamp: rt.Timestamp, RunTime: rt.RunTime, Current: rt.Current,
+				LowCurrent: rt.LowCurrent, DeviceID: rt.DeviceID})
+		}
+	}
+	slices.SortFunc(rows, func(a, b pumpExportRow) int { return compareKeys(a.Timestamp, a.ID, b.Timestamp, b.ID) })
+	return &sliceCursor[pumpExportRow]{rows: rows}, nil
+}
+
+func (s *memStore) ListPumpCycles(_ context.Context, filter cycleFilter, page pageParams) ([]PumpCycle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matching := []PumpCycle{}
+	for _, c := range s.cycles {
+		if (filter.DeviceID == "" || c.DeviceID == filter.DeviceID) && (!filter.LowCurrent || c.LowCurrent) {
+			matching = append(matching, c)
+		}
+	}
+	cycles := pageRows(matching, page, func(c PumpCycle) (time.Time, int) { return c.Start, c.ID })
+	if cycles == nil {
+		cycles = []PumpCycle{}
+	}
+	return cycles, nil
+}
+
+// PumpStats splits the samples into cycles like pgStore does
+func (s *memStore) PumpStats(_ context.Context, q statsQuery) ([]PumpStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := map[string][]pumpSample{}
+	for _, rt := range s.runTimes {
+		if inRange(rt.Timestamp, q.From, q.To) && (q.DeviceID == "" || rt.DeviceID == q.DeviceID) {
+			samples[rt.DeviceID] = append(samples[rt.DeviceID], pumpSample{DeviceID: rt.DeviceID, Timestamp: rt.Timestamp,
+				RunTime: rt.RunTime, Current: rt.Current, LowCurrent: rt.LowCurrent})
+		}
+	}
+
+	groups := map[time.Time]*PumpStats{}
+	for _, device := range samples {
+		slices.SortStableFunc(device, func(a, b pumpSample) int { return a.Timestamp.Compare(b.Timestamp) })
+		for len(device) > 0 {
+			n := 1
+			for n < len(device) && device[n].continues(device[n-1]) {
+				n++
+			}
+			c := buildPumpCycle(device[:n])
+			device = device[n:]
+			if c.Start.Before(q.From) {
+				continue
+			}
+
+			period := periodStart(q.Period, c.Start.In(q.Location))
+			st, ok := groups[period]
+			if !ok {
+				st = &PumpStats{Period: period}
+				groups[period] = st
+			}
+			st.Cycles++
+			st.TotalRunSeconds += c.DurationSeconds
+			st.LongestCycleSeconds = max(st.LongestCycleSeconds, c.DurationSeconds)
+			st.LowCurrentSamples += c.LowCurrentSamples
+		}
+	}
+
+	stats := []PumpStats{}
+	for _, st := range groups {
+		st.AvgCycleSeconds = math.Round(float64(st.TotalRunSeconds)/float64(st.Cycles)*10) / 10
+		stats = append(stats, *st)
+	}
+	slices.SortFunc(stats, func(a, b PumpStats) int { return a.Period.Compare(b.Period) })
+	return stats, nil
+}
+
+// newest returns the row with the latest timestamp among those accepted by
+// match, or nil
+func newest[T any](rows []T, ts func(T) time.Time, match func(T) bool) *T {
+	var latest *T
+	for i := range rows {
+		if match(rows[i]) && (latest == nil || ts(rows[i]).After(ts(*latest))) {
+			latest = &rows[i]
+		}
+	}
+	return latest
+}
+
+func (s *memStore) DeviceActivity(_ context.Context) ([]DeviceStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []DeviceStatus{}
+	for _, d := range s.devices {
+		if d.DecommissionedAt != nil {
+			continue
+		}
+		st := DeviceStatus{ID: d.ID, Type: d.Type, Name: d.Name, Location: d.Location, ExpectedInterval: d.ExpectedInterval}
+		if hb := newest(s.heartbeats, func(h DeviceHeartbeat) time.Time { return h.Timestamp },
+			func(h DeviceHeartbeat) bool { return h.DeviceID == d.ID }); hb != nil {
+			st.LastHeartbeat = &hb.Timestamp
+		}
+		switch d.Type {
+		case deviceTypeTemperature:
+			if r := newest(s.temperatures, func(r TemperatureReading) time.Time { return r.Timestamp }, func(r TemperatureReading) bool {
+				return r.DeviceID == d.ID || r.DeviceID == "" && r.Location == d.Location
+			}); r != nil {
+				st.LastReading, st.LastValue = &r.Timestamp, &r.Value
+			}
+		case deviceTypePump:
+			if rt := newest(s.runTimes, func(rt PumpRunTime) time.Time { return rt.Timestamp },
+				func(rt PumpRunTime) bool { return rt.DeviceID == d.ID }); rt != nil {
+				st.LastReading, st.LastValue = &rt.Timestamp, &rt.Current
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	slices.SortFunc(statuses, func(a, b DeviceStatus) int { return cmp.Compare(a.ID, b.ID) })
+	return statuses, nil
+}
+
+func (s *memStore) LatestTemperatures(_ context.Context, since time.Time) ([]TemperatureReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := map[string]TemperatureReading{}
+	for _, r := range s.temperatures {
+		if prev, ok := latest[r.Location]; !r.Timestamp.Before(since) && (!ok || r.Timestamp.After(prev.Timestamp)) {
+			latest[r.Location] = r
+		}
+	}
+	readings := []TemperatureReading{}
+	for _, r := range latest {
+		readings = append(readings, r)
+	}
+	slices.SortFunc(readings, func(a, b TemperatureReading) int { return cmp.Compare(a.Location, b.Location) })
+	return readings, nil
+}
+
+func (s *memStore) LatestPumpRunTimes(_ context.Context, since time.Time) ([]PumpRunTime, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := map[string]PumpRunTime{}
+	for _, rt := range s.runTimes {
+		if prev, ok := latest[rt.DeviceID]; !rt.Timestamp.Before(since) && (!ok || rt.Timestamp.After(prev.Timestamp)) {
+			latest[rt.DeviceID] = rt
+		}
+	}
+	runTimes := []PumpRunTime{}
+	for _, rt := range latest {
+		runTimes = append(runTimes, rt)
+	}
+	slices.SortFunc(runTimes, func(a, b PumpRunTime) int { return cmp.Compare(a.DeviceID, b.DeviceID) })
+	return runTimes, nil
+}
+
+func (s *memStore) LatestHeartbeats(_ context.Context, since time.Time) ([]DeviceHeartbeat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := map[string]DeviceHeartbeat{}
+	for _, h := range s.heartbeats {
+		i := s.device(h.DeviceID)
+		if i >= 0 && s.devices[i].DecommissionedAt != nil || i < 0 && h.Timestamp.Before(since) {
+			continue
+		}
+		if prev, ok := latest[h.DeviceID]; !ok || h.Timestamp.After(prev.Timestamp) {
+			latest[h.DeviceID] = DeviceHeartbeat{DeviceID: h.DeviceID, Timestamp: h.Timestamp}
+		}
+	}
+	heartbeats := []DeviceHeartbeat{}
+	for _, h := range latest {
+		heartbeats = append(heartbeats, h)
+	}
+	slices.SortFunc(heartbeats, func(a, b DeviceHeartbeat) int { return cmp.Compare(a.DeviceID, b.DeviceID) })
+	return heartbeats, nil
+}
+
+func (s *memStore) Ping(_ context.Context) error {
+	return s.pingErr
+}
+
+func (s *memStore) SchemaVersion(_ context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.schemaVersion, nil
+}
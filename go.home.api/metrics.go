@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const (
+	metricsNamespace = "homeiota"
+	metricsWindow    = 7 * 24 * time.Hour // how far back latest readings are looked for
+	metricsTimeout   = 10 * time.Second   // bounds the queries run per scrape
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by handler pattern, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by handler pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+)
+
+// registerMetrics registers the request, database pool and reading metrics
+// with the default registry, which /metrics serves along with the Go runtime
+// and process metrics
+func registerMetrics(db *sql.DB) {
+	prometheus.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		collectors.NewDBStatsCollector(db, "homeiota"),
+		newReadingsCollector(store),
+	)
+}
+
+// statusRecorder remembers the status code written by a handler. Unwrap keeps
+// http.NewResponseController working for the streaming handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrumentRequests counts and times every request, labelled with the mux
+// pattern that serves it so IDs in paths do not create new series
+func instrumentRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		httpRequests.WithLabelValues(pattern, r.Method, strconv.Itoa(rec.code)).Inc()
+		// Streams stay open for as long as the client likes, which would
+		// only skew the latency histogram
+		if pattern != "/stream" {
+			httpRequestDuration.WithLabelValues(pattern, r.Method).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// readingsCollector reports the newest readings and heartbeats, read from
+// the store on every scrape
+type readingsCollector struct {
+	store Store
+
+	temperature     *prometheus.Desc
+	humidity        *prometheus.Desc
+	temperatureTime *prometheus.Desc
+	pumpCurrent     *prometheus.Desc
+	pumpRunTime     *prometheus.Desc
+	pumpLowCurrent  *prometheus.Desc
+	pumpTime        *prometheus.Desc
+	heartbeatAge    *prometheus.Desc
+	scrapeErrors    *prometheus.Desc
+}
+
+func newReadingsCollector(store Store) *readingsCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil)
+	}
+	return &readingsCollector{
+		store:           store,
+		temperature:     desc("temperature_fahrenheit", "Latest temperature reading per location.", "location"),
+		humidity:        desc("humidity_percent", "Latest relative humidity per location, for sensors that report it.", "location"),
+		temperatureTime: desc("temperature_timestamp_seconds", "Time of the latest temperature reading per location.", "location"),
+		pumpCurrent:     desc("pump_current_amps", "Current of the latest pump sample.", "device_id"),
+		pumpRunTime:     desc("pump_run_time_seconds", "Run time of the latest pump sample.", "device_id"),
+		pumpLowCurrent:  desc("pump_low_current", "1 if the latest pump sample was flagged as low current.", "device_id"),
+		pumpTime:        desc("pump_timestamp_seconds", "Time of the latest pump sample.", "device_id"),
+		heartbeatAge:    desc("heartbeat_age_seconds", "Seconds since the last heartbeat per device.", "device_id"),
+		scrapeErrors:    desc("readings_scrape_errors", "Queries that failed while collecting the reading metrics.", "query"),
+	}
+}
+
+func (c *readingsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.temperature
+	ch <- c.humidity
+	ch <- c.temperatureTime
+	ch <- c.pumpCurrent
+	ch <- c.pumpRunTime
+	ch <- c.pumpLowCurrent
+	ch <- c.pumpTime
+	ch <- c.heartbeatAge
+	ch <- c.scrapeErrors
+}
+
+func (c *readingsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsTimeout)
+	defer cancel()
+
+	for _, q := range []struct {
+		name    string
+		collect func(context.Context, chan<- prometheus.Metric) error
+	}{
+		{"temperatures", c.collectTemperatures},
+		{"pumps", c.collectPumps},
+		{"heartbeats", c.collectHeartbeats},
+	} {
+		failed := 0.0
+		if err := q.collect(ctx, ch); err != nil {
+			failed = 1
+			log.Printf("Failed to collect %s metrics: %v", q.name, err)
+		}
+		ch <- prometheus.MustNewConstMetric(c.scrapeErrors, prometheus.GaugeValue, failed, q.name)
+	}
+}
+
+func (c *readingsCollector) collectTemperatures(ctx context.Context, ch chan<- prometheus.Metric) error {
+	readings, err := c.store.LatestTemperatures(ctx, time.Now().Add(-metricsWindow))
+	if err != nil {
+		return err
+	}
+	for _, reading := range readings {
+		ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, reading.Value, reading.Location)
+		if reading.Humidity != nil {
+			ch <- prometheus.MustNewConstMetric(c.humidity, prometheus.GaugeValue, *reading.Humidity, reading.Location)
+		}
+		ch <- prometheus.MustNewConstMetric(c.temperatureTime, prometheus.GaugeValue, float64(reading.Timestamp.Unix()), reading.Location)
+	}
+	return nil
+}
+
+func (c *readingsCollector) collectPumps(ctx context.Context, ch chan<- prometheus.Metric) error {
+	runTimes, err := c.store.LatestPumpRunTimes(ctx, time.Now().Add(-metricsWindow))
+	if err != nil {
+		return err
+	}
+	for _, rt := range runTimes {
+		low := 0.0
+		if rt.LowCurrent {
+			low = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.pumpCurrent, prometheus.GaugeValue, rt.Current, rt.DeviceID)
+		ch <- prometheus.MustNewConstMetric(c.pumpRunTime, prometheus.GaugeValue, float64(rt.RunTime), rt.DeviceID)
+		ch <- prometheus.MustNewConstMetric(c.pumpLowCurrent, prometheus.GaugeValue, low, rt.DeviceID)
+		ch <- prometheus.MustNewConstMetric(c.pumpTime, prometheus.GaugeValue, float64(rt.Timestamp.Unix()), rt.DeviceID)
+	}
+	return nil
+}
+
+// collectHeartbeats reports every active registered device that has sent a
+// heartbeat, however long ago, so silent devices keep a growing age rather
+// than disappearing. Unregistered devices are only reported within the window.
+func (c *readingsCollector) collectHeartbeats(ctx context.Context, ch chan<- prometheus.Metric) error {
+	now := time.Now()
+	heartbeats, err := c.store.LatestHeartbeats(ctx, now.Add(-metricsWindow))
+	if err != nil {
+		return err
+	}
+	for _, heartbeat := range heartbeats {
+		ch <- prometheus.MustNewConstMetric(c.heartbeatAge, prometheus.GaugeValue, now.Sub(heartbeat.Timestamp).Seconds(), heartbeat.DeviceID)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestReadingsCollector(t *testing.T) {
+	now := time.Now()
+	s := newMemoryStore(Device{ID: "quiet", Type: deviceTypeTemperature, Location: "attic", ExpectedInterval: 60})
+	humidity := 45.0
+	s.temperatures = []TemperatureReading{
+		{ID: 1, Value: 4, Location: "freezer", Timestamp: now.Add(-2 * time.Minute)},
+		{ID: 2, Value: 5, Location: "freezer", Timestamp: now.Add(-time.Minute), Humidity: &humidity},
+		{ID: 3, Value: 70, Location: "basement", Timestamp: now.Add(-30 * 24 * time.Hour)},
+	}
+	s.runTimes = []PumpRunTime{{ID: 1, RunTime: 4, Current: 7.5, LowCurrent: true, DeviceID: "pump", Timestamp: now}}
+	s.heartbeats = []DeviceHeartbeat{
+		{DeviceID: "quiet", Timestamp: now.Add(-30 * 24 * time.Hour)}, // registered, so reported however old
+		{DeviceID: "stranger", Timestamp: now.Add(-30 * 24 * time.Hour)},
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newReadingsCollector(s))
+	w := serve(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), http.MethodGet, "/metrics", "")
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`homeiota_temperature_fahrenheit{location="freezer"} 5`,
+		`homeiota_humidity_percent{location="freezer"} 45`,
+		`homeiota_pump_current_amps{device_id="pump"} 7.5`,
+		`homeiota_pump_run_time_seconds{device_id="pump"} 4`,
+		`homeiota_pump_low_current{device_id="pump"} 1`,
+		`homeiota_heartbeat_age_seconds{device_id="quiet"}`,
+		`homeiota_readings_scrape_errors{query="heartbeats"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	for _, unwanted := range []string{`location="basement"`, `device_id="stranger"`} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("metrics report %s, which is outside the window", unwanted)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS device_heartbeats;
+DROP TABLE IF EXISTS pump_run_times_critical;
+DROP TABLE IF EXISTS pump_run_times;
+DROP TABLE IF EXISTS temperatures;
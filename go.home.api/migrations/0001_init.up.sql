@@ -0,0 +1,39 @@
+-- Base hypertables. IF NOT EXISTS keeps this safe to apply to databases
+-- created before migrations were introduced.
+CREATE TABLE IF NOT EXISTS temperatures (
+	id SERIAL,
+	value REAL NOT NULL,
+	location TEXT NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (id, timestamp)
+);
+SELECT create_hypertable('temperatures', 'timestamp', if_not_exists => TRUE);
+
+CREATE TABLE IF NOT EXISTS pump_run_times (
+	id SERIAL,
+	run_time INTEGER NOT NULL,
+	current REAL NOT NULL,
+	low_current BOOLEAN NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (id, timestamp)
+);
+SELECT create_hypertable('pump_run_times', 'timestamp', if_not_exists => TRUE);
+
+CREATE TABLE IF NOT EXISTS pump_run_times_critical (
+	id SERIAL,
+	run_time INTEGER NOT NULL,
+	current REAL NOT NULL,
+	low_current BOOLEAN NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (id, timestamp)
+);
+SELECT create_hypertable('pump_run_times_critical', 'timestamp', if_not_exists => TRUE);
+
+CREATE TABLE IF NOT EXISTS device_heartbeats (
+	id SERIAL,
+	device_id VARCHAR(255) NOT NULL,
+	pump BOOLEAN NOT NULL,
+	timestamp TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (id, timestamp)
+);
+SELECT create_hypertable('device_heartbeats', 'timestamp', if_not_exists => TRUE);
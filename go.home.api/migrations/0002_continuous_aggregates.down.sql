@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+DROP MATERIALIZED VIEW IF EXISTS pump_run_times_daily;
+DROP MATERIALIZED VIEW IF EXISTS pump_run_times_hourly;
+DROP MATERIALIZED VIEW IF EXISTS temperatures_daily;
+DROP MATERIALIZED VIEW IF EXISTS temperatures_hourly;
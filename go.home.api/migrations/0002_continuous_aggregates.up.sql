@@ -0,0 +1,37 @@
+-- migrate:no-transaction
+-- Continuous aggregates cannot be created inside a transaction block. They
+-- are real-time, adding the readings newer than the last refresh, so
+-- /aggregate can serve recent buckets from them.
+CREATE MATERIALIZED VIEW IF NOT EXISTS temperatures_hourly WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 hour', timestamp) AS bucket, location,
+		MIN(value) AS min, MAX(value) AS max, AVG(value) AS avg, COUNT(*) AS count
+	FROM temperatures GROUP BY bucket, location;
+SELECT add_continuous_aggregate_policy('temperatures_hourly',
+	start_offset => INTERVAL '3 hours', end_offset => INTERVAL '1 hour',
+	schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS temperatures_daily WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 day', timestamp) AS bucket, location,
+		MIN(value) AS min, MAX(value) AS max, AVG(value) AS avg, COUNT(*) AS count
+	FROM temperatures GROUP BY bucket, location;
+SELECT add_continuous_aggregate_policy('temperatures_daily',
+	start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+	schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS pump_run_times_hourly WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 hour', timestamp) AS bucket,
+		MIN(current) AS min_current, MAX(current) AS max_current, AVG(current) AS avg_current,
+		MAX(run_time) AS max_run_time, COUNT(*) FILTER (WHERE low_current) AS low_current_count, COUNT(*) AS count
+	FROM pump_run_times GROUP BY bucket;
+SELECT add_continuous_aggregate_policy('pump_run_times_hourly',
+	start_offset => INTERVAL '3 hours', end_offset => INTERVAL '1 hour',
+	schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS pump_run_times_daily WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 day', timestamp) AS bucket,
+		MIN(current) AS min_current, MAX(current) AS max_current, AVG(current) AS avg_current,
+		MAX(run_time) AS max_run_time, COUNT(*) FILTER (WHERE low_current) AS low_current_count, COUNT(*) AS count
+	FROM pump_run_times GROUP BY bucket;
+SELECT add_continuous_aggregate_policy('pump_run_times_daily',
+	start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+	schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE);
@@ -0,0 +1,9 @@
+-- Keys of already ingested readings, used to deduplicate device retries.
+-- Rows are pruned by the service once they are older than idempotency_ttl.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key TEXT PRIMARY KEY,
+	row_id INTEGER,
+	row_timestamp TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
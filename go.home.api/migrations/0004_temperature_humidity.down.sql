@@ -0,0 +1,6 @@
+-- migrate:no-transaction
+DROP MATERIALIZED VIEW IF EXISTS temperatures_humidity_daily;
+DROP MATERIALIZED VIEW IF EXISTS temperatures_humidity_hourly;
+
+ALTER TABLE temperatures DROP COLUMN IF EXISTS dew_point;
+ALTER TABLE temperatures DROP COLUMN IF EXISTS humidity;
@@ -0,0 +1,28 @@
+-- migrate:no-transaction
+-- Relative humidity (percent) and derived dew point (Fahrenheit) from the SHT4x.
+ALTER TABLE temperatures ADD COLUMN IF NOT EXISTS humidity REAL;
+ALTER TABLE temperatures ADD COLUMN IF NOT EXISTS dew_point REAL;
+
+-- The humidity rollups are aggregates of their own: temperatures_hourly and
+-- temperatures_daily keep buckets whose readings retention has dropped, which
+-- rebuilding them would lose. No reading had humidity before this migration,
+-- so there is nothing to materialize yet and the policies fill them in.
+CREATE MATERIALIZED VIEW IF NOT EXISTS temperatures_humidity_hourly WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 hour', timestamp) AS bucket, location,
+		MIN(humidity) AS min_humidity, MAX(humidity) AS max_humidity, AVG(humidity) AS avg_humidity,
+		AVG(dew_point) AS avg_dew_point, COUNT(*) AS count, COUNT(dew_point) AS dew_point_count
+	FROM temperatures WHERE humidity IS NOT NULL GROUP BY bucket, location
+	WITH NO DATA;
+SELECT add_continuous_aggregate_policy('temperatures_humidity_hourly',
+	start_offset => INTERVAL '3 hours', end_offset => INTERVAL '1 hour',
+	schedule_interval => INTERVAL '30 minutes', if_not_exists => TRUE);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS temperatures_humidity_daily WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+	SELECT time_bucket('1 day', timestamp) AS bucket, location,
+		MIN(humidity) AS min_humidity, MAX(humidity) AS max_humidity, AVG(humidity) AS avg_humidity,
+		AVG(dew_point) AS avg_dew_point, COUNT(*) AS count, COUNT(dew_point) AS dew_point_count
+	FROM temperatures WHERE humidity IS NOT NULL GROUP BY bucket, location
+	WITH NO DATA;
+SELECT add_continuous_aggregate_policy('temperatures_humidity_daily',
+	start_offset => INTERVAL '3 days', end_offset => INTERVAL '1 day',
+	schedule_interval => INTERVAL '1 hour', if_not_exists => TRUE);
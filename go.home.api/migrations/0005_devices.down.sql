@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS device_heartbeats_device_id_idx;
+DROP INDEX IF EXISTS pump_run_times_device_id_idx;
+DROP INDEX IF EXISTS temperatures_device_id_idx;
+ALTER TABLE pump_run_times_critical DROP COLUMN IF EXISTS device_id;
+ALTER TABLE pump_run_times DROP COLUMN IF EXISTS device_id;
+ALTER TABLE temperatures DROP COLUMN IF EXISTS device_id;
+DROP TABLE IF EXISTS devices;
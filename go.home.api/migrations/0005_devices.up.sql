@@ -0,0 +1,34 @@
+-- Registry of known devices. Readings are linked to a device through the new
+-- device_id columns; existing rows keep a NULL device_id.
+CREATE TABLE IF NOT EXISTS devices (
+	id TEXT PRIMARY KEY,
+	type TEXT NOT NULL CHECK (type IN ('temperature', 'pump')),
+	name TEXT NOT NULL,
+	location TEXT,
+	firmware_version TEXT,
+	expected_interval_seconds INTEGER NOT NULL DEFAULT 60 CHECK (expected_interval_seconds > 0),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	decommissioned_at TIMESTAMPTZ
+);
+
+-- Readings posted by location resolve to the single active device there
+CREATE UNIQUE INDEX IF NOT EXISTS devices_active_location_idx ON devices (type, location) WHERE decommissioned_at IS NULL;
+
+ALTER TABLE temperatures ADD COLUMN IF NOT EXISTS device_id TEXT;
+ALTER TABLE pump_run_times ADD COLUMN IF NOT EXISTS device_id TEXT;
+ALTER TABLE pump_run_times_critical ADD COLUMN IF NOT EXISTS device_id TEXT;
+
+CREATE INDEX IF NOT EXISTS temperatures_device_id_idx ON temperatures (device_id, timestamp DESC);
+CREATE INDEX IF NOT EXISTS pump_run_times_device_id_idx ON pump_run_times (device_id, timestamp DESC);
+CREATE INDEX IF NOT EXISTS device_heartbeats_device_id_idx ON device_heartbeats (device_id, timestamp DESC);
+
+-- Register the devices that are already reporting: the pump monitor sends
+-- heartbeats as "pump" and temperature monitors are known by their location
+INSERT INTO devices (id, type, name, location, expected_interval_seconds)
+	SELECT 'pump', 'pump', 'Well pump', 'wellpump', 60
+	WHERE EXISTS (SELECT 1 FROM device_heartbeats WHERE device_id = 'pump')
+	ON CONFLICT DO NOTHING;
+INSERT INTO devices (id, type, name, location, expected_interval_seconds)
+	SELECT DISTINCT location, 'temperature', location, location, 30 FROM temperatures
+	ON CONFLICT DO NOTHING;
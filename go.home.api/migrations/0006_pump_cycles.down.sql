@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS pump_cycle_progress;
+DROP TABLE IF EXISTS pump_cycles;
@@ -0,0 +1,27 @@
+-- Pump cycles derived from the pump_run_times samples by the service. A cycle
+-- is written once no sample has followed it for the cycle gap.
+CREATE TABLE IF NOT EXISTS pump_cycles (
+	id SERIAL PRIMARY KEY,
+	device_id TEXT,
+	start_time TIMESTAMPTZ NOT NULL,
+	end_time TIMESTAMPTZ NOT NULL,
+	duration_seconds INTEGER NOT NULL,
+	sample_count INTEGER NOT NULL,
+	avg_current DOUBLE PRECISION NOT NULL,
+	peak_current DOUBLE PRECISION NOT NULL,
+	min_current DOUBLE PRECISION NOT NULL,
+	low_current BOOLEAN NOT NULL DEFAULT FALSE,
+	low_current_samples INTEGER NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS pump_cycles_device_start_idx ON pump_cycles (COALESCE(device_id, ''), start_time);
+CREATE INDEX IF NOT EXISTS pump_cycles_start_time_idx ON pump_cycles (start_time DESC);
+CREATE INDEX IF NOT EXISTS pump_cycles_device_end_idx ON pump_cycles (device_id, end_time DESC);
+
+-- Samples before processed_until belong to cycles that are already written.
+-- reprocess_from is the earliest sample stored after that, whose cycles are
+-- rebuilt on the next run.
+CREATE TABLE IF NOT EXISTS pump_cycle_progress (
+	singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+	processed_until TIMESTAMPTZ NOT NULL,
+	reprocess_from TIMESTAMPTZ
+);
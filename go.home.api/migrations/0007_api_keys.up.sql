@@ -0,0 +1,14 @@
+-- API keys. Only the SHA-256 hash of a key is stored; the key itself is shown
+-- once when it is issued.
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	prefix TEXT NOT NULL,
+	scope TEXT NOT NULL CHECK (scope IN ('device', 'read', 'admin')),
+	device_id TEXT REFERENCES devices (id),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_used_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ,
+	CHECK ((scope = 'device') = (device_id IS NOT NULL))
+);
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttConfig holds the MQTT listener settings, read from the mqtt_*
+// environment variables
+type mqttConfig struct {
+	Broker   string // e.g. tcp://mosquitto:1883; empty disables the listener
+	ClientID string
+	Username string
+	Password string
+	Prefix   string // topics are <prefix>/<device>/<kind>
+	QoS      byte
+}
+
+func mqttConfigFromEnv() (mqttConfig, error) {
+	cfg := mqttConfig{
+		Broker:   os.Getenv("mqtt_broker"),
+		ClientID: os.Getenv("mqtt_client_id"),
+		Username: os.Getenv("mqtt_username"),
+		Password: os.Getenv("mqtt_password"),
+		Prefix:   os.Getenv("mqtt_topic_prefix"),
+		QoS:      1,
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "go.home.api"
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "homeiota"
+	}
+	if v := os.Getenv("mqtt_qos"); v != "" {
+		qos, err := strconv.Atoi(v)
+		if err != nil || qos < 0 || qos > 2 {
+			return cfg, fmt.Errorf("invalid mqtt_qos %q: must be 0, 1 or 2", v)
+		}
+		cfg.QoS = byte(qos)
+	}
+	return cfg, nil
+}
+
+// newMQTTClient creates the paho client used by runMQTT; tests replace it
+// with a fake that needs no broker
+var newMQTTClient = mqtt.NewClient
+
+// runMQTT connects to the broker and subscribes to the reading topics. The
+// client keeps reconnecting in the background, resubscribing each time, until
+// ctx is done; runMQTT then disconnects and returns.
+func runMQTT(ctx context.Context, cfg mqttConfig) {
+	// Messages still being stored at shutdown are allowed to finish
+	msgCtx := context.WithoutCancel(ctx)
+
+	topics := map[string]byte{
+		cfg.Prefix + "/+/temperature": cfg.QoS,
+		cfg.Prefix + "/+/pump":        cfg.QoS,
+		cfg.Prefix + "/+/heartbeat":   cfg.QoS,
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		// A persistent session lets the broker queue QoS 1/2 messages while
+		// the API is down
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.Printf("MQTT connected to %s", cfg.Broker)
+			token := c.SubscribeMultiple(topics, func(_ mqtt.Client, msg mqtt.Message) {
+				handleMQTTMessage(msgCtx, cfg.Prefix, msg.Topic(), msg.Payload())
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("MQTT subscribe failed: %v", token.Error())
+			}
+		})
+
+	client := newMQTTClient(opts)
+	client.Connect()
+	<-ctx.Done()
+	client.Disconnect(250)
+}
+
+// handleMQTTMessage stores the readings of one message. The device comes from
+// the topic; payloads are the JSON bodies accepted by the HTTP endpoints, or a
+// JSON array of them.
+func handleMQTTMessage(ctx context.Context, prefix, topic string, payload []byte) {
+	parts := strings.Split(strings.TrimPrefix(topic, prefix+"/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		log.Printf("MQTT: ignoring message on unexpected topic %q", topic)
+		return
+	}
+	device, kind := parts[0], parts[1]
+
+	var err error
+	switch kind {
+	case "temperature":
+		err = ingestMQTTTemperatures(ctx, device, payload)
+	case "pump":
+		err = ingestMQTTPumpRunTimes(ctx, device, payload)
+	case "heartbeat":
+		err = ingestMQTTHeartbeat(ctx, device, payload)
+	default:
+		err = fmt.Errorf("unknown message kind %q", kind)
+	}
+	if err != nil {
+		log.Printf("MQTT %s: %v", topic, err)
+	}
+}
+
+// decodeMQTTItems decodes a JSON object or array of objects into items. A null
+// payload or array element decodes to a nil item.
+func decodeMQTTItems[T any](payload []byte) ([]*T, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		var items []*T
+		if err := json.Unmarshal(payload, &items); err != nil {
+			return nil, fmt.Errorf("invalid payload: %v", err)
+		}
+		return items, nil
+	}
+	var item *T
+	if err := json.Unmarshal(payload, &item); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	return []*T{item}, nil
+}
+
+func ingestMQTTTemperatures(ctx context.Context, device string, payload []byte) error {
+	items, err := decodeMQTTItems[TemperatureReading](payload)
+	if err != nil {
+		return err
+	}
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	var readings []*TemperatureReading
+	var keys []string
+	for i, reading := range items {
+		if reading == nil {
+			log.Printf("MQTT: dropping temperature reading %d: null", i)
+			continue
+		}
+		// The topic names the device, like a device API key does over HTTP
+		if err := devices.claimTemperature("topic", device, reading); err != nil {
+			log.Printf("MQTT: dropping temperature reading %d: %v", i, err)
+			continue
+		}
+		if err := devices.linkTemperature(reading); err != nil {
+			log.Printf("MQTT: dropping temperature reading %d: %v", i, err)
+			continue
+		}
+		if err := validateTemperature(reading); err != nil {
+			log.Printf("MQTT: dropping temperature reading %d: %v", i, err)
+			continue
+		}
+		readings = append(readings, reading)
+		keys = append(keys, temperatureKey("", reading))
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+	_, err = storeTemperatures(ctx, readings, keys)
+	return err
+}
+
+func ingestMQTTPumpRunTimes(ctx context.Context, device string, payload []byte) error {
+	items, err := decodeMQTTItems[PumpRunTime](payload)
+	if err != nil {
+		return err
+	}
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		return err
+	}
+
+	var runTimes []*PumpRunTime
+	var keys []string
+	for i, rt := range items {
+		if rt == nil {
+			log.Printf("MQTT: dropping pump run time %d: null", i)
+			continue
+		}
+		if rt.DeviceID == "" {
+			rt.DeviceID = device
+		}
+		if rt.DeviceID != device {
+			log.Printf("MQTT: dropping pump run time %d: device_id %q does not match topic", i, rt.DeviceID)
+			continue
+		}
+		if err := devices.linkPumpRunTime(rt); err != nil {
+			log.Printf("MQTT: dropping pump run time %d: %v", i, err)
+			continue
+		}
+		if err := validatePumpRunTime(rt); err != nil {
+			log.Printf("MQTT: dropping pump run time %d: %v", i, err)
+			continue
+		}
+		runTimes = append(runTimes, rt)
+		keys = append(keys, pumpRunTimeKey("", rt))
+	}
+	if len(runTimes) == 0 {
+		return nil
+	}
+	_, err = storePumpRunTimes(ctx, runTimes, keys)
+	return err
+}
+
+// ingestMQTTHeartbeat stores a heartbeat; an empty payload is a heartbeat too
+func ingestMQTTHeartbeat(ctx context.Context, device string, payload []byte) error {
+	var heartbeat DeviceHeartbeat
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, &heartbeat); err != nil {
+			return fmt.Errorf("invalid payload: %v", err)
+		}
+	}
+	if heartbeat.DeviceID == "" {
+		heartbeat.DeviceID = device
+	}
+	if heartbeat.DeviceID != device {
+		return fmt.Errorf("device_id %q does not match topic", heartbeat.DeviceID)
+	}
+	if err := validateTimestamp(heartbeat.Timestamp); err != nil {
+		return err
+	}
+	devices, err := loadDeviceIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if err := devices.linkHeartbeat(&heartbeat); err != nil {
+		return err
+	}
+	return storeHeartbeat(ctx, &heartbeat)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDecodeMQTTItems(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    int // items, -1 for an error
+		nils    int
+	}{
+		{`{"value": 1.5}`, 1, 0},
+		{` [{"value": 1.5}, {"value": 2}] `, 2, 0},
+		{`[null, {"value": 1.5}]`, 2, 1},
+		{`[]`, 0, 0},
+		{`null`, 1, 1},
+		{`[1]`, -1, 0},
+		{`not json`, -1, 0},
+	}
+	for _, tt := range tests {
+		items, err := decodeMQTTItems[TemperatureReading]([]byte(tt.payload))
+		if tt.want < 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.payload, err)
+			continue
+		}
+		nils := 0
+		for _, item := range items {
+			if item == nil {
+				nils++
+			}
+		}
+		if len(items) != tt.want || nils != tt.nils {
+			t.Errorf("%s: got %d items with %d nil, want %d with %d", tt.payload, len(items), nils, tt.want, tt.nils)
+		}
+	}
+}
+
+func TestHandleMQTTMessage(t *testing.T) {
+	s := useMemoryStore(t,
+		Device{ID: "freezer", Type: deviceTypeTemperature, Name: "Freezer", Location: "freezer", ExpectedInterval: 30},
+		Device{ID: "pump", Type: deviceTypePump, Name: "Well pump", Location: "wellpump", ExpectedInterval: 60},
+	)
+	ctx := context.Background()
+
+	// Null items are dropped instead of crashing the listener
+	handleMQTTMessage(ctx, "homeiota", "homeiota/freezer/temperature", []byte(`[null, {"value": -2.5}]`))
+	handleMQTTMessage(ctx, "homeiota", "homeiota/pump/pump", []byte(`[null]`))
+	handleMQTTMessage(ctx, "homeiota", "homeiota/pump/pump", []byte(`null`))
+
+	// A registered device may only write readings for its own location, and
+	// nobody else may write readings for it
+	handleMQTTMessage(ctx, "homeiota", "homeiota/freezer/temperature", []byte(`{"value": 70, "location": "kitchen"}`))
+	handleMQTTMessage(ctx, "homeiota", "homeiota/garage/temperature", []byte(`{"value": 70, "location": "freezer"}`))
+	handleMQTTMessage(ctx, "homeiota", "homeiota/garage/temperature", []byte(`{"value": 70, "device_id": "freezer", "location": "freezer"}`))
+
+	// Unregistered devices may still write readings for unclaimed locations
+	handleMQTTMessage(ctx, "homeiota", "homeiota/garage/temperature", []byte(`{"value": 55, "location": "garage"}`))
+
+	handleMQTTMessage(ctx, "homeiota", "homeiota/pump/pump", []byte(`[{"run_time": 4, "current": 8.1}]`))
+	handleMQTTMessage(ctx, "homeiota", "homeiota/pump/heartbeat", nil)
+
+	if len(s.temperatures) != 2 {
+		t.Fatalf("stored %d readings, want 2: %+v", len(s.temperatures), s.temperatures)
+	}
+	if r := s.temperatures[0]; r.Value != -2.5 || r.Location != "freezer" || r.DeviceID != "freezer" {
+		t.Errorf("first reading = %+v, want -2.5 at freezer from freezer", r)
+	}
+	if r := s.temperatures[1]; r.Value != 55 || r.Location != "garage" || r.DeviceID != "garage" {
+		t.Errorf("second reading = %+v, want 55 at garage from garage", r)
+	}
+	if len(s.runTimes) != 1 || s.runTimes[0].DeviceID != "pump" {
+		t.Errorf("stored pump run times %+v, want one from pump", s.runTimes)
+	}
+	if len(s.heartbeats) != 1 || !s.heartbeats[0].Pump {
+		t.Errorf("stored heartbeats %+v, want one pump heartbeat", s.heartbeats)
+	}
+}
+
+// fakeMQTTClient stands in for the paho client. Connect "connects" by calling
+// the OnConnect handler, as paho does after every successful (re)connection.
+type fakeMQTTClient struct {
+	mqtt.Client // methods runMQTT does not use panic
+
+	opts         *mqtt.ClientOptions
+	mu           sync.Mutex
+	handlers     []mqtt.MessageHandler // one per subscription
+	subscribed   chan map[string]byte
+	disconnected chan struct{}
+}
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	go c.opts.OnConnect(c)
+	return doneToken{}
+}
+
+func (c *fakeMQTTClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	c.handlers = append(c.handlers, callback)
+	c.mu.Unlock()
+	c.subscribed <- filters
+	return doneToken{}
+}
+
+func (c *fakeMQTTClient) Disconnect(uint) { close(c.disconnected) }
+
+// deliver hands a message to the latest subscription
+func (c *fakeMQTTClient) deliver(topic, payload string) {
+	c.mu.Lock()
+	handler := c.handlers[len(c.handlers)-1]
+	c.mu.Unlock()
+	handler(c, fakeMQTTMessage{topic: topic, payload: []byte(payload)})
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+type fakeMQTTMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMQTTMessage) Topic() string   { return m.topic }
+func (m fakeMQTTMessage) Payload() []byte { return m.payload }
+
+func TestRunMQTT(t *testing.T) {
+	s := useMemoryStore(t, Device{ID: "freezer", Type: deviceTypeTemperature, Name: "Freezer", Location: "freezer", ExpectedInterval: 30})
+	client := &fakeMQTTClient{subscribed: make(chan map[string]byte), disconnected: make(chan struct{})}
+	prev := newMQTTClient
+	newMQTTClient = func(opts *mqtt.ClientOptions) mqtt.Client {
+		client.opts = opts
+		return client
+	}
+	t.Cleanup(func() { newMQTTClient = prev })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runMQTT(ctx, mqttConfig{Broker: "tcp://broker:1883", ClientID: "api", Prefix: "home", QoS: 1})
+		close(done)
+	}()
+
+	wantTopics := map[string]byte{"home/+/temperature": 1, "home/+/pump": 1, "home/+/heartbeat": 1}
+	if topics := <-client.subscribed; !maps.Equal(topics, wantTopics) {
+		t.Errorf("subscribed to %v, want %v", topics, wantTopics)
+	}
+	if client.opts.CleanSession || !client.opts.AutoReconnect || client.opts.ClientID != "api" {
+		t.Errorf("options clean session %v, auto reconnect %v, client ID %q; want a persistent session that reconnects as api",
+			client.opts.CleanSession, client.opts.AutoReconnect, client.opts.ClientID)
+	}
+	client.deliver("home/freezer/temperature", `{"value": -2.5}`)
+
+	// After the connection drops, paho reconnects and runs OnConnect again,
+	// which must subscribe again for messages to keep arriving
+	client.opts.OnConnectionLost(client, errors.New("EOF"))
+	go client.opts.OnConnect(client)
+	if topics := <-client.subscribed; !maps.Equal(topics, wantTopics) {
+		t.Errorf("resubscribed to %v, want %v", topics, wantTopics)
+	}
+	client.deliver("home/freezer/temperature", `{"value": -3}`)
+
+	if len(s.temperatures) != 2 || s.temperatures[0].DeviceID != "freezer" || s.temperatures[1].Value != -3 {
+		t.Errorf("stored %+v, want both readings of freezer", s.temperatures)
+	}
+
+	cancel()
+	select {
+	case <-client.disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("runMQTT did not disconnect when its context was cancelled")
+	}
+	<-done
+}
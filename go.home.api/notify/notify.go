@@ -0,0 +1,140 @@
+// Package notify subscribes to the PostgreSQL notifications go.home.api sends
+// for every row it stores, so other services can react to new data without
+// polling.
+//
+//	sub, err := notify.Subscribe(ctx, connStr, notify.ChannelTemperature, notify.ChannelPump)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer sub.Close()
+//	for n := range sub.C {
+//		if n.Reconnected {
+//			// notifications may have been missed while disconnected
+//			continue
+//		}
+//		var reading struct {
+//			Value    float64 `json:"value"`
+//			Location string  `json:"location"`
+//		}
+//		if err := n.Decode(&reading); err != nil {
+//			log.Println(err)
+//		}
+//	}
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channels go.home.api notifies on. The payload is the stored row as JSON,
+// in the same shape the API returns it.
+const (
+	ChannelTemperature = "homeiota_temperature" // temperature readings
+	ChannelPump        = "homeiota_pump"        // pump run time samples
+	ChannelHeartbeat   = "homeiota_heartbeat"   // device heartbeats
+)
+
+const (
+	minReconnectInterval = 10 * time.Second
+	maxReconnectInterval = time.Minute
+	pingInterval         = 90 * time.Second // checks idle connections
+)
+
+// Notification is one notification received from PostgreSQL
+type Notification struct {
+	Channel string
+	Payload json.RawMessage
+
+	// Reconnected is set, with no channel or payload, after the connection
+	// was re-established; notifications sent in the meantime are lost
+	Reconnected bool
+}
+
+// Decode unmarshals the payload into v
+func (n Notification) Decode(v interface{}) error {
+	if n.Reconnected {
+		return errors.New("notify: reconnect notification has no payload")
+	}
+	return json.Unmarshal(n.Payload, v)
+}
+
+// Subscriber receives the notifications of a set of channels
+type Subscriber struct {
+	// C delivers the notifications. It is closed once the subscriber is
+	// closed or its context is done.
+	C <-chan Notification
+
+	listener *pq.Listener
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// Subscribe opens a dedicated connection with the lib/pq connection string
+// connStr and listens on channels. The connection is re-established
+// automatically if it drops.
+func Subscribe(ctx context.Context, connStr string, channels ...string) (*Subscriber, error) {
+	if len(channels) == 0 {
+		return nil, errors.New("notify: no channels given")
+	}
+
+	listener := pq.NewListener(connStr, minReconnectInterval, maxReconnectInterval, nil)
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("notify: listen on %s: %w", channel, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan Notification, 64)
+	s := &Subscriber{C: c, listener: listener, cancel: cancel, done: make(chan struct{})}
+	go s.run(ctx, c)
+	return s, nil
+}
+
+func (s *Subscriber) run(ctx context.Context, c chan<- Notification) {
+	defer close(s.done)
+	defer close(c)
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		var n Notification
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			// A failed ping makes the listener reconnect
+			go s.listener.Ping()
+			continue
+		case pn, ok := <-s.listener.Notify:
+			if !ok {
+				return
+			}
+			if pn == nil {
+				n.Reconnected = true
+			} else {
+				n.Channel, n.Payload = pn.Channel, json.RawMessage(pn.Extra)
+			}
+		}
+
+		select {
+		case c <- n:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops listening and closes the connection
+func (s *Subscriber) Close() error {
+	s.cancel()
+	<-s.done
+	return s.listener.Close()
+}
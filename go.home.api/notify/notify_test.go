@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// reading is a temperature reading in the shape go.home.api notifies it
+type reading struct {
+	ID        int       `json:"id"`
+	Value     float64   `json:"value"`
+	Location  string    `json:"location"`
+	Timestamp time.Time `json:"timestamp"`
+	Humidity  *float64  `json:"humidity,omitempty"`
+}
+
+// receive waits for the next notification
+func receive(t *testing.T, c <-chan Notification) Notification {
+	t.Helper()
+	select {
+	case n, ok := <-c:
+		if !ok {
+			t.Fatal("C was closed")
+		}
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	return Notification{}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	notify := make(chan *pq.Notification)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan Notification)
+	s := &Subscriber{C: c, listener: &pq.Listener{Notify: notify}, cancel: cancel, done: make(chan struct{})}
+	go s.run(ctx, c)
+
+	humidity := 45.5
+	sent := reading{ID: 7, Value: -2.5, Location: "freezer", Timestamp: time.Date(2026, 3, 4, 10, 0, 0, 500, time.UTC), Humidity: &humidity}
+	payload, _ := json.Marshal(sent)
+	notify <- &pq.Notification{Channel: ChannelTemperature, Extra: string(payload)}
+
+	n := receive(t, s.C)
+	var got reading
+	if err := n.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if n.Channel != ChannelTemperature || n.Reconnected || got.ID != sent.ID || got.Value != sent.Value || got.Location != sent.Location ||
+		!got.Timestamp.Equal(sent.Timestamp) || got.Humidity == nil || *got.Humidity != humidity {
+		t.Errorf("got %+v on %s, want %+v on %s", got, n.Channel, sent, ChannelTemperature)
+	}
+
+	// pq sends nil after re-establishing the connection
+	notify <- nil
+	if n := receive(t, s.C); !n.Reconnected || n.Decode(&got) == nil {
+		t.Errorf("got %+v, want a reconnect notification that cannot be decoded", n)
+	}
+
+	close(notify)
+	if _, ok := <-s.C; ok {
+		t.Error("C is still open after the listener closed")
+	}
+}
+
+// TestSubscribe listens on a real database, given by the lib/pq connection
+// string in notify_test_db, e.g.
+//
+//	notify_test_db="host=localhost user=postgres password=postgres sslmode=disable" go test ./notify
+func TestSubscribe(t *testing.T) {
+	connStr := os.Getenv("notify_test_db")
+	if connStr == "" {
+		t.Skip("notify_test_db is not set")
+	}
+	ctx := context.Background()
+	sub, err := Subscribe(ctx, connStr, ChannelTemperature, ChannelHeartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Notifications on other channels are not delivered
+	for _, notification := range []struct{ channel, payload string }{
+		{ChannelPump, `{"id": 1}`},
+		{ChannelTemperature, `{"id": 2, "value": -2.5, "location": "freezer"}`},
+	} {
+		if _, err := db.ExecContext(ctx, "SELECT pg_notify($1, $2)", notification.channel, notification.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := receive(t, sub.C)
+	var got reading
+	if err := n.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if n.Channel != ChannelTemperature || got.ID != 2 || got.Location != "freezer" {
+		t.Errorf("got %+v on %s, want reading 2 on %s", got, n.Channel, ChannelTemperature)
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, ok := <-sub.C; ok {
+		t.Error("C is still open after Close")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// openAPISpec is the OpenAPI 3 document describing the API, served at
+// /openapi.json and used to validate requests
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+const maxValidatedResponse = 1 << 20 // larger responses are not checked against the spec
+
+var (
+	openAPIRouter     routers.Router
+	validateResponses bool // check responses against the spec too (validate_responses=true)
+)
+
+// NDJSON batch bodies are validated as arrays of their lines
+func init() {
+	for _, contentType := range []string{"application/x-ndjson", "application/ndjson", "application/jsonl"} {
+		openapi3filter.RegisterBodyDecoder(contentType, ndjsonBodyDecoder)
+	}
+}
+
+func ndjsonBodyDecoder(body io.Reader, _ http.Header, _ *openapi3.SchemaRef, _ openapi3filter.EncodingFn) (any, error) {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	items := []any{}
+	for {
+		var item any
+		if err := dec.Decode(&item); err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+		}
+		items = append(items, item)
+	}
+}
+
+// loadOpenAPI parses and checks the embedded document and builds the router
+// used to find the operation of a request
+func loadOpenAPI() error {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return fmt.Errorf("failed to parse openapi.json: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return fmt.Errorf("invalid openapi.json: %w", err)
+	}
+	openAPIRouter, err = gorillamux.NewRouter(doc)
+	return err
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// validateRequests rejects requests that do not match the OpenAPI document
+// with a 400 listing the offending fields. Requests for paths or methods the
+// document does not describe are left to the mux.
+func validateRequests(next http.Handler) http.Handler {
+	options := &openapi3filter.Options{
+		MultiError:                 true,
+		ExcludeReadOnlyValidations: true, // ids and derived fields sent back by clients are ignored
+		AuthenticationFunc:         openapi3filter.NoopAuthenticationFunc,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := openAPIRouter.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The handlers decode bodies as JSON whatever the content type says
+		if r.ContentLength != 0 && r.Header.Get("Content-Type") == "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    options,
+		}
+		// Batch endpoints report invalid items in their results instead of
+		// rejecting the whole body
+		if body := route.Operation.RequestBody; body != nil && body.Value.Extensions["x-per-item-validation"] == true {
+			opts := *options
+			opts.ExcludeRequestBody = true
+			input.Options = &opts
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			message, fields := requestErrorFields(err)
+			writeError(w, message, http.StatusBadRequest, fields...)
+			return
+		}
+
+		if !validateResponses {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseCapture{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		rec.validate(input)
+	})
+}
+
+// requestErrorFields turns a validation error into a summary and field errors
+func requestErrorFields(err error) (string, []FieldError) {
+	var fields []FieldError
+	message := "Request does not match the API specification"
+	for _, e := range flattenErrors(err) {
+		var re *openapi3filter.RequestError
+		if !errors.As(e, &re) {
+			fields = append(fields, FieldError{Field: "request", Message: e.Error()})
+			continue
+		}
+		switch {
+		case re.Parameter != nil:
+			for _, inner := range flattenErrors(re.Err) {
+				fields = append(fields, FieldError{Field: re.Parameter.Name, Message: parameterMessage(re, inner)})
+			}
+		case re.Err == nil:
+			// e.g. an unsupported content type, which is not about a field
+			message = "Invalid request body: " + re.Reason
+		default:
+			for _, inner := range flattenErrors(re.Err) {
+				fields = append(fields, bodyFieldError(inner))
+			}
+		}
+	}
+	if len(fields) == 1 {
+		message = fields[0].Field + " " + fields[0].Message
+	}
+	return message, fields
+}
+
+// flattenErrors expands nested MultiErrors
+func flattenErrors(err error) []error {
+	// Not errors.As, which would look through a RequestError to its causes
+	me, ok := err.(openapi3.MultiError)
+	if !ok {
+		if err == nil {
+			return nil
+		}
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range me {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
+
+func parameterMessage(re *openapi3filter.RequestError, err error) string {
+	var se *openapi3.SchemaError
+	switch {
+	case err == nil:
+		return strings.TrimPrefix(re.Reason, "value ")
+	case errors.Is(err, openapi3filter.ErrInvalidRequired):
+		return "is required"
+	case errors.As(err, &se):
+		return schemaMessage(se)
+	}
+	var pe *openapi3filter.ParseError
+	if errors.As(err, &pe) && re.Parameter.Schema != nil && re.Parameter.Schema.Value.Type != nil {
+		return "must be " + jsonTypeName(re.Parameter.Schema.Value.Type.Slice()[0])
+	}
+	return "is invalid"
+}
+
+// bodyFieldError names the body field a schema error is about, dotted from
+// its JSON pointer
+func bodyFieldError(err error) FieldError {
+	var se *openapi3.SchemaError
+	if !errors.As(err, &se) {
+		if errors.Is(err, openapi3filter.ErrInvalidRequired) {
+			return FieldError{Field: "body", Message: "is required"}
+		}
+		return FieldError{Field: "body", Message: "must be valid JSON"}
+	}
+	message := schemaMessage(se)
+	pointer := se.JSONPointer()
+	switch se.SchemaField {
+	case "required":
+		// The pointer already ends in the missing property
+		message = "is required"
+	case "properties":
+		// An unknown property: the pointer ends in the object and the reason
+		// names the property
+		quoted, ok := strings.CutSuffix(strings.TrimPrefix(se.Reason, "property "), " is unsupported")
+		if name, err := strconv.Unquote(quoted); ok && err == nil {
+			pointer = append(pointer, name)
+			message = "is not a known field"
+		}
+	}
+	field := strings.Join(pointer, ".")
+	if field == "" {
+		field = "body"
+	}
+	return FieldError{Field: field, Message: message}
+}
+
+// schemaMessage phrases a schema error so it reads after the field name
+func schemaMessage(se *openapi3.SchemaError) string {
+	schema := se.Schema
+	switch {
+	case schema == nil:
+	case se.SchemaField == "enum":
+		var values []string
+		for _, v := range schema.Enum {
+			values = append(values, fmt.Sprint(v))
+		}
+		return "must be one of " + strings.Join(values, ", ")
+	case se.SchemaField == "format" && schema.Format == "date-time":
+		return "must be an RFC3339 timestamp"
+	case se.SchemaField == "format":
+		return "must be a valid " + schema.Format
+	case se.SchemaField == "pattern":
+		return "must match " + schema.Pattern
+	case se.SchemaField == "minLength" && schema.MinLength == 1:
+		return "must not be empty"
+	}
+	message := se.Reason
+	for _, prefix := range []string{"value ", "number ", "string "} {
+		message = strings.TrimPrefix(message, prefix)
+	}
+	return message
+}
+
+// responseCapture copies a JSON response as it is written so it can be
+// checked against the spec afterwards
+type responseCapture struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	if c.code == 0 {
+		c.code = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+	if c.body.Len()+len(b) > maxValidatedResponse {
+		c.truncated = true
+	} else if !c.truncated {
+		c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// validate logs responses that do not match the spec. Non-JSON and oversized
+// responses are skipped.
+func (c *responseCapture) validate(input *openapi3filter.RequestValidationInput) {
+	mediaType, _, _ := mime.ParseMediaType(c.Header().Get("Content-Type"))
+	if c.truncated || c.code == 0 || mediaType != "application/json" {
+		return
+	}
+	err := openapi3filter.ValidateResponse(input.Request.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 c.code,
+		Header:                 c.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(c.body.Bytes())),
+		Options:                &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+	})
+	if err != nil {
+		log.Printf("Response to %s %s does not match the API specification: %v", input.Request.Method, input.Request.URL.Path, err)
+	}
+}
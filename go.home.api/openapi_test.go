@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+var loadOpenAPIOnce sync.Once
+
+// openAPIHandler serves the temperature endpoints behind the request
+// validation, as the server does
+func openAPIHandler(t *testing.T) http.Handler {
+	t.Helper()
+	var err error
+	loadOpenAPIOnce.Do(func() { err = loadOpenAPI() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tempmon", handleTemperatures)
+	mux.HandleFunc("/tempmon/batch", handleTemperatureBatch)
+	return validateRequests(mux)
+}
+
+func TestValidateRequests(t *testing.T) {
+	s := useMemoryStore(t)
+	handler := openAPIHandler(t)
+
+	for _, tc := range []struct {
+		name, method, target, body string
+		want                       ErrorResponse
+	}{
+		{
+			name: "unknown field", method: http.MethodPost, target: "/tempmon",
+			body: `{"value": 1, "location": "freezer", "colour": "blue"}`,
+			want: ErrorResponse{Error: "colour is not a known field", Fields: []FieldError{{"colour", "is not a known field"}}},
+		},
+		{
+			name: "wrong type", method: http.MethodPost, target: "/tempmon",
+			body: `{"value": "cold", "location": "freezer"}`,
+			want: ErrorResponse{Error: "value must be a number", Fields: []FieldError{{"value", "must be a number"}}},
+		},
+		{
+			name: "missing required field", method: http.MethodPost, target: "/tempmon",
+			body: `{"location": "freezer"}`,
+			want: ErrorResponse{Error: "value is required", Fields: []FieldError{{"value", "is required"}}},
+		},
+		{
+			name: "several problems", method: http.MethodPost, target: "/tempmon",
+			body: `{"value": "cold", "humidity": 120}`,
+			want: ErrorResponse{Error: "Request does not match the API specification", Fields: []FieldError{
+				{"value", "must be a number"}, {"humidity", "must be at most 100"}}},
+		},
+		{
+			name: "query parameter", method: http.MethodGet, target: "/tempmon?limit=0",
+			want: ErrorResponse{Error: "limit must be at least 1", Fields: []FieldError{{"limit", "must be at least 1"}}},
+		},
+		{
+			name: "invalid JSON", method: http.MethodPost, target: "/tempmon", body: `{"value": `,
+			want: ErrorResponse{Error: "body must be valid JSON", Fields: []FieldError{{"body", "must be valid JSON"}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(handler, tc.method, tc.target, tc.body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("%s %s = %d, want 400: %s", tc.method, tc.target, w.Code, w.Body)
+			}
+			var got ErrorResponse
+			decodeBody(t, w, &got)
+			tc.want.Status = http.StatusBadRequest
+			if got.Error != tc.want.Error || got.Status != tc.want.Status || len(got.Fields) != len(tc.want.Fields) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+			for _, want := range tc.want.Fields {
+				found := false
+				for _, field := range got.Fields {
+					found = found || field == want
+				}
+				if !found {
+					t.Errorf("fields %+v lack %+v", got.Fields, want)
+				}
+			}
+		})
+	}
+	if len(s.temperatures) != 0 {
+		t.Errorf("stored %d invalid readings", len(s.temperatures))
+	}
+
+	// Batch bodies skip the validation of the body, so one invalid item does
+	// not reject the others; the handler reports it in the results
+	w := serve(handler, http.MethodPost, "/tempmon/batch", `[{"value": "cold", "location": "freezer"}, {"value": 1, "location": "freezer"}]`)
+	var batch BatchResponse
+	decodeBody(t, w, &batch)
+	if w.Code != http.StatusOK || batch.Inserted != 1 || batch.Failed != 1 || len(batch.Results[0].Fields) != 1 || batch.Results[0].Fields[0].Field != "0.value" {
+		t.Errorf("batch with an invalid item = %d %+v, want 200 with item 0 failed on 0.value", w.Code, batch)
+	}
+	// The parameters of batch requests are still validated
+	if w := serve(handler, http.MethodPost, "/tempmon/batch", `[]`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty batch = %d, want 400", w.Code)
+	}
+
+	if w := serve(handler, http.MethodPost, "/tempmon", `{"value": 1, "location": "freezer", "id": 7}`); w.Code != http.StatusCreated {
+		t.Errorf("a read-only id sent back = %d, want 201: %s", w.Code, w.Body)
+	}
+}
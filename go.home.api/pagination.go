@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 1000  // rows returned when no limit is given
+	maxPageLimit     = 10000 // upper bound for the limit query parameter
+)
+
+// pageCursor marks the last row of a page. Rows are ordered by (timestamp, id)
+// so the pair is unique and stable even when readings share a timestamp.
+type pageCursor struct {
+	Timestamp time.Time
+	ID        int
+}
+
+// Page is the body of a list response
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"` // Cursor of the next page, absent on the last one
+}
+
+// pageParams holds the time range, ordering and cursor of a list request
+type pageParams struct {
+	From  time.Time // inclusive, zero means unbounded
+	To    time.Time // exclusive, zero means unbounded
+	Limit int
+	Desc  bool
+	After *pageCursor // continue after this row, nil for the first page
+}
+
+// encode returns the opaque string handed to clients in the next link
+func (c pageCursor) encode() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	tsStr, idStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	ts, err := time.Parse(time.RFC3339Nano, tsStr)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &pageCursor{Timestamp: ts, ID: id}, nil
+}
+
+// parseTimeRange reads the optional from/to RFC3339 query parameters
+func parseTimeRange(q url.Values) (from, to time.Time, err error) {
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, fieldErrorf("from", "must be an RFC3339 timestamp")
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return from, to, fieldErrorf("to", "must be an RFC3339 timestamp")
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fieldErrorf("from", "must be before to")
+	}
+	return from, to, nil
+}
+
+// parsePageParams reads from, to, limit, order and cursor from the query string
+func parsePageParams(q url.Values) (pageParams, error) {
+	p := pageParams{Limit: defaultPageLimit}
+
+	var err error
+	if p.From, p.To, err = parseTimeRange(q); err != nil {
+		return p, err
+	}
+
+	if s := q.Get("limit"); s != "" {
+		p.Limit, err = strconv.Atoi(s)
+		if err != nil || p.Limit < 1 || p.Limit > maxPageLimit {
+			return p, fieldErrorf("limit", "must be between 1 and %d", maxPageLimit)
+		}
+	}
+
+	// Newest rows come first unless asked otherwise
+	switch q.Get("order") {
+	case "", "desc":
+		p.Desc = true
+	case "asc":
+	default:
+		return p, fieldErrorf("order", "must be asc or desc")
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		if p.After, err = decodeCursor(s); err != nil {
+			return p, fieldErrorf("cursor", "is invalid")
+		}
+	}
+	return p, nil
+}
+
+// clause appends the range and cursor conditions to conds and returns the
+// WHERE/ORDER BY/LIMIT tail of the query along with the extended args.
+// One extra row is requested so the caller can tell whether a next page exists.
+func (p pageParams) clause(conds []string, args []interface{}) (string, []interface{}) {
+	return p.clauseOn("timestamp", conds, args)
+}
+
+// clauseOn is clause for tables whose time column is not named timestamp
+func (p pageParams) clauseOn(column string, conds []string, args []interface{}) (string, []interface{}) {
+	if !p.From.IsZero() {
+		args = append(args, p.From)
+		conds = append(conds, fmt.Sprintf("%s >= $%d", column, len(args)))
+	}
+	if !p.To.IsZero() {
+		args = append(args, p.To)
+		conds = append(conds, fmt.Sprintf("%s < $%d", column, len(args)))
+	}
+	op, dir := ">", "ASC"
+	if p.Desc {
+		op, dir = "<", "DESC"
+	}
+	if p.After != nil {
+		args = append(args, p.After.Timestamp, p.After.ID)
+		conds = append(conds, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, op, len(args)-1, len(args)))
+	}
+
+	var sb strings.Builder
+	if len(conds) > 0 {
+		sb.WriteString(" WHERE " + strings.Join(conds, " AND "))
+	}
+	fmt.Fprintf(&sb, " ORDER BY %s %s, id %s LIMIT %d", column, dir, dir, p.Limit+1)
+	return sb.String(), args
+}
+
+// setNextLink advertises the following page in a Link header, keeping every
+// other query parameter of the current request.
+func setNextLink(w http.ResponseWriter, r *http.Request, c pageCursor) {
+	q := r.URL.Query()
+	q.Set("cursor", c.encode())
+	next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+}
+
+// writePage sends rows as a Page. The store returns one row more than the
+// limit to detect a next page, which is then offered both in the body and in
+// a Link header; cursor gives the position of a row.
+func writePage[T any](w http.ResponseWriter, r *http.Request, p pageParams, rows []T, cursor func(T) pageCursor) {
+	body := Page[T]{Items: rows}
+	if body.Items == nil {
+		body.Items = []T{}
+	}
+	if len(rows) > p.Limit {
+		body.Items = rows[:p.Limit]
+		next := cursor(body.Items[p.Limit-1])
+		body.NextCursor = next.encode()
+		setNextLink(w, r, next)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-home-api/notify"
+)
+
+// pgStore is the Store backed by the TimescaleDB database
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(db *sql.DB) *pgStore {
+	return &pgStore{db: db}
+}
+
+func (s *pgStore) ListTemperatures(ctx context.Context, filter readingFilter, page pageParams) ([]TemperatureReading, error) {
+	// Use a prepared statement to prevent SQL injection
+	query := "SELECT id, value, location, timestamp, humidity, dew_point, COALESCE(device_id, '') FROM temperatures"
+	var conds []string
+	var args []interface{}
+	if filter.Location != "" {
+		args = append(args, filter.Location)
+		conds = append(conds, "location = $1") // Use $1 for prepared statement arguments in PostgreSQL
+	}
+	if filter.DeviceID != "" {
+		args = append(args, filter.DeviceID)
+		conds = append(conds, fmt.Sprintf("device_id = $%d", len(args)))
+	}
+	tail, args := page.clause(conds, args)
+	query += tail
+
+	stmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := []TemperatureReading{}
+	for rows.Next() {
+		var reading TemperatureReading
+		if err := scanTemperature(rows, &reading); err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading)
+	}
+	return readings, rows.Err()
+}
+
+func scanTemperature(row interface{ Scan(...interface{}) error }, reading *TemperatureReading) error {
+	var humidity, dewPoint sql.NullFloat64
+	err := row.Scan(&reading.ID, &reading.Value, &reading.Location, &reading.Timestamp, &humidity, &dewPoint, &reading.DeviceID)
+	reading.Humidity, reading.DewPoint = nullFloat(humidity), nullFloat(dewPoint)
+	return err
+}
+
+func (s *pgStore) GetTemperature(ctx context.Context, id int) (TemperatureReading, error) {
+	var reading TemperatureReading
+	row := s.db.QueryRowContext(ctx, "SELECT id, value, location, timestamp, humidity, dew_point, COALESCE(device_id, '') FROM temperatures WHERE id = $1", id)
+	err := scanTemperature(row, &reading)
+	if err == sql.ErrNoRows {
+		return reading, errNotFound
+	}
+	return reading, err
+}
+
+func (s *pgStore) DeleteTemperature(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM temperatures WHERE id = $1", id)
+	return err
+}
+
+// InsertTemperatures runs ingestTemperatures in a transaction of its own
+func (s *pgStore) InsertTemperatures(ctx context.Context, readings []*TemperatureReading, keys []string) (replayed []bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if replayed, err = ingestTemperatures(ctx, tx, readings, keys); err != nil {
+		return nil, err
+	}
+	return replayed, tx.Commit()
+}
+
+func (s *pgStore) ListPumpRunTimes(ctx context.Context, filter readingFilter, page pageParams) ([]PumpRunTime, error) {
+	// Use a prepared statement
+	query := "SELECT id, run_time, current, low_current, timestamp, COALESCE(device_id, '') FROM pump_run_times"
+	var conds []string
+	var args []interface{}
+	if filter.DeviceID != "" {
+		args = append(args, filter.DeviceID)
+		conds = append(conds, "device_id = $1")
+	}
+	tail, args := page.clause(conds, args)
+	query += tail
+
+	stmt, err := s.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runTimes := []PumpRunTime{}
+	for rows.Next() {
+		var rt PumpRunTime
+		if err := rows.Scan(&rt.ID, &rt.RunTime, &rt.Current, &rt.LowCurrent, &rt.Timestamp, &rt.DeviceID); err != nil {
+			return nil, err
+		}
+		runTimes = append(runTimes, rt)
+	}
+	return runTimes, rows.Err()
+}
+
+func (s *pgStore) GetPumpRunTime(ctx context.Context, id int) (PumpRunTime, error) {
+	var rt PumpRunTime
+	err := s.db.QueryRowContext(ctx, "SELECT id, run_time, current, low_current, timestamp, COALESCE(device_id, '') FROM pump_run_times WHERE id = $1", id).
+		Scan(&rt.ID, &rt.RunTime, &rt.Current, &rt.LowCurrent, &rt.Timestamp, &rt.DeviceID)
+	if err == sql.ErrNoRows {
+		return rt, errNotFound
+	}
+	return rt, err
+}
+
+func (s *pgStore) DeletePumpRunTime(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM pump_run_times WHERE id = $1", id)
+	return err
+}
+
+// InsertPumpRunTimes runs ingestPumpRunTimes in a transaction of its own
+func (s *pgStore) InsertPumpRunTimes(ctx context.Context, runTimes []*PumpRunTime, keys []string) (replayed []bool, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if replayed, err = ingestPumpRunTimes(ctx, tx, runTimes, keys); err != nil {
+		return nil, err
+	}
+	return replayed, tx.Commit()
+}
+
+func (s *pgStore) InsertHeartbeat(ctx context.Context, heartbeat *DeviceHeartbeat) error {
+	heartbeat.Timestamp = timestampOrNow(heartbeat.Timestamp, time.Now())
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, "INSERT INTO device_heartbeats (device_id, pump, timestamp) VALUES ($1, $2, $3) RETURNING id",
+		heartbeat.DeviceID, heartbeat.Pump, heartbeat.Timestamp).Scan(&heartbeat.ID)
+	if err != nil {
+		return err
+	}
+	if err := notifyRows(ctx, tx, notify.ChannelHeartbeat, []*DeviceHeartbeat{heartbeat}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) ActiveDevices(ctx context.Context) ([]Device, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+deviceColumns+" FROM devices WHERE decommissioned_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		if err := scanDevice(rows, &d); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *pgStore) ListDevices(ctx context.Context, filter deviceFilter) ([]Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices"
+	var conds []string
+	var args []interface{}
+	if !filter.IncludeDecommissioned {
+		conds = append(conds, "decommissioned_at IS NULL")
+	}
+	if filter.Type != "" {
+		args = append(args, filter.Type)
+		conds = append(conds, fmt.Sprintf("type = $%d", len(args)))
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := scanDevice(rows, &d); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *pgStore) GetDevice(ctx context.Context, id string) (Device, error) {
+	var d Device
+	err := scanDevice(s.db.QueryRowContext(ctx, "SELECT "+deviceColumns+" FROM devices WHERE id = $1", id), &d)
+	if err == sql.ErrNoRows {
+		return d, errNotFound
+	}
+	return d, err
+}
+
+func (s *pgStore) CreateDevice(ctx context.Context, d *Device) error {
+	row := s.db.QueryRowContext(ctx, `
+		INSERT INTO devices (id, type, name, location, firmware_version, expected_interval_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+deviceColumns,
+		d.ID, d.Type, d.Name, nullString(d.Location), nullString(d.FirmwareVersion), d.ExpectedInterval)
+	err := scanDevice(row, d)
+	if isUniqueViolation(err) {
+		return errConflict
+	}
+	return err
+}
+
+// UpdateDevice locks the device row for the duration of apply
+func (s *pgStore) UpdateDevice(ctx context.Context, id string, apply func(d *Device) error) (Device, error) {
+	var d Device
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+
+	err = scanDevice(tx.QueryRowContext(ctx, "SELECT "+deviceColumns+" FROM devices WHERE id = $1 FOR UPDATE", id), &d)
+	if err == sql.ErrNoRows {
+		return d, errNotFound
+	} else if err != nil {
+		return d, err
+	}
+	if err := apply(&d); err != nil {
+		return d, err
+	}
+
+	row := tx.QueryRowContext(ctx, `
+		UPDATE devices SET type = $2, name = $3, location = $4, firmware_version = $5,
+			expected_interval_seconds = $6, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+deviceColumns,
+		d.ID, d.Type, d.Name, nullString(d.Location), nullString(d.FirmwareVersion), d.ExpectedInterval)
+	if err := scanDevice(row, &d); err != nil {
+		if isUniqueViolation(err) {
+			return d, errConflict
+		}
+		return d, err
+	}
+	return d, tx.Commit()
+}
+
+func (s *pgStore) DecommissionDevice(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE devices SET decommissioned_at = COALESCE(decommissioned_at, NOW()), updated_at = NOW() WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) InsertAPIKey(ctx context.Context, k *APIKey, hash string) error {
+	return scanAPIKey(s.db.QueryRowContext(ctx, `
+		INSERT INTO api_keys (name, key_hash, prefix, scope, device_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+apiKeyColumns,
+		k.Name, hash, k.Prefix, k.Scope, nullString(k.DeviceID)), k)
+}
+
+func (s *pgStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := scanAPIKey(rows, &k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *pgStore) RevokeAPIKey(ctx context.Context, id int) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE api_keys SET revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) APIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var k APIKey
+	err := scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", hash), &k)
+	if err == sql.ErrNoRows {
+		return k, errNotFound
+	}
+	return k, err
+}
+
+func (s *pgStore) TouchAPIKey(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", id)
+	return err
+}
+
+// AggregateTemperatures rolls buckets of whole hours or days up from the
+// continuous aggregates, widening the range to whole hours or days. Averages
+// are then weighted by the number of readings behind each rolled up bucket.
+func (s *pgStore) AggregateTemperatures(ctx context.Context, q aggregateQuery) ([]TemperatureAggregate, error) {
+	query := `
+		SELECT time_bucket($1::interval, t.timestamp), t.location,
+			MIN(t.value), MAX(t.value), AVG(t.value), COUNT(*),
+			MIN(t.humidity), MAX(t.humidity), AVG(t.humidity), AVG(t.dew_point)
+		FROM temperatures t
+		WHERE t.timestamp >= $2 AND t.timestamp < $3`
+	from, to := q.From, q.To
+	if rollup, unit := aggregateRollup(q.Bucket); rollup != "" {
+		from, to = from.Truncate(unit), to.Add(unit-1).Truncate(unit)
+		query = fmt.Sprintf(`
+			SELECT time_bucket($1::interval, t.bucket), t.location,
+				MIN(t.min), MAX(t.max), SUM(t.avg * t.count) / SUM(t.count), SUM(t.count),
+				MIN(h.min_humidity), MAX(h.max_humidity),
+				SUM(h.avg_humidity * h.count) / NULLIF(SUM(h.count), 0),
+				SUM(h.avg_dew_point * h.dew_point_count) / NULLIF(SUM(h.dew_point_count), 0)
+			FROM temperatures_%[1]s t
+			LEFT JOIN temperatures_humidity_%[1]s h ON h.bucket = t.bucket AND h.location = t.location
+			WHERE t.bucket >= $2 AND t.bucket < $3`, rollup)
+	}
+	args := []interface{}{intervalArg(q.Bucket), from, to}
+	if q.Location != "" {
+		query += " AND t.location = $4"
+		args = append(args, q.Location)
+	}
+	query += " GROUP BY 1, 2 ORDER BY 1, 2"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []TemperatureAggregate{}
+	for rows.Next() {
+		var a TemperatureAggregate
+		var minHumidity, maxHumidity, avgHumidity, avgDewPoint sql.NullFloat64
+		if err := rows.Scan(&a.Bucket, &a.Location, &a.Min, &a.Max, &a.Avg, &a.Count, &minHumidity, &maxHumidity, &avgHumidity, &avgDewPoint); err != nil {
+			return nil, err
+		}
+		a.MinHumidity, a.MaxHumidity = nullFloat(minHumidity), nullFloat(maxHumidity)
+		a.AvgHumidity, a.AvgDewPoint = nullFloat(avgHumidity), nullFloat(avgDewPoint)
+		aggregates = append(aggregates, a)
+	}
+	return aggregates, rows.Err()
+}
+
+// AggregatePumpRunTimes uses the continuous aggregates like
+// AggregateTemperatures does
+func (s *pgStore) AggregatePumpRunTimes(ctx context.Context, q aggregateQuery) ([]PumpAggregate, error) {
+	query := `
+		SELECT time_bucket($1::interval, timestamp),
+			MIN(current), MAX(current), AVG(current), MAX(run_time),
+			COUNT(*) FILTER (WHERE low_current), COUNT(*)
+		FROM pump_run_times
+		WHERE timestamp >= $2 AND timestamp < $3
+		GROUP BY 1 ORDER BY 1`
+	from, to := q.From, q.To
+	if rollup, unit := aggregateRollup(q.Bucket); rollup != "" {
+		from, to = from.Truncate(unit), to.Add(unit-1).Truncate(unit)
+		query = fmt.Sprintf(`
+			SELECT time_bucket($1::interval, bucket),
+				MIN(min_current), MAX(max_current), SUM(avg_current * count) / SUM(count), MAX(max_run_time),
+				SUM(low_current_count), SUM(count)
+			FROM pump_run_times_%s
+			WHERE bucket >= $2 AND bucket < $3
+			GROUP BY 1 ORDER BY 1`, rollup)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, intervalArg(q.Bucket), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []PumpAggregate{}
+	for rows.Next() {
+		var a PumpAggregate
+		if err := rows.Scan(&a.Bucket, &a.MinCurrent, &a.MaxCurrent, &a.AvgCurrent, &a.MaxRunTime, &a.LowCurrentCount, &a.Count); err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, a)
+	}
+	return aggregates, rows.Err()
+}
+
+// sqlCursor is the rowCursor over the rows of a query
+type sqlCursor[T any] struct {
+	*sql.Rows
+	scan func(rows *sql.Rows, row *T) error
+}
+
+func (c sqlCursor[T]) Scan(row *T) error { return c.scan(c.Rows, row) }
+
+// exportConds returns the time range and device conditions of an export
+func exportConds(p exportParams, conds []string, args []interface{}) ([]string, []interface{}) {
+	if !p.From.IsZero() {
+		args = append(args, p.From)
+		conds = append(conds, fmt.Sprintf("timestamp >= $%d", len(args)))
+	}
+	if !p.To.IsZero() {
+		args = append(args, p.To)
+		conds = append(conds, fmt.Sprintf("timestamp < $%d", len(args)))
+	}
+	if p.DeviceID != "" {
+		args = append(args, p.DeviceID)
+		conds = append(conds, fmt.Sprintf("device_id = $%d", len(args)))
+	}
+	return conds, args
+}
+
+func (s *pgStore) ExportTemperatures(ctx context.Context, p exportParams) (rowCursor[temperatureExportRow], error) {
+	var conds []string
+	var args []interface{}
+	if p.Location != "" {
+		args = append(args, p.Location)
+		conds = append(conds, "location = $1")
+	}
+	conds, args = exportConds(p, conds, args)
+	query := "SELECT id, timestamp, location, value, humidity, dew_point, COALESCE(device_id, '') FROM temperatures"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY timestamp, id"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlCursor[temperatureExportRow]{rows, func(rows *sql.Rows, row *temperatureExportRow) error {
+		var humidity, dewPoint sql.NullFloat64
+		err := rows.Scan(&row.ID, &row.Timestamp, &row.Location, &row.Value, &humidity, &dewPoint, &row.DeviceID)
+		row.Humidity, row.DewPoint = nullFloat(humidity), nullFloat(dewPoint)
+		return err
+	}}, nil
+}
+
+func (s *pgStore) ExportPumpRunTimes(ctx context.Context, p exportParams) (rowCursor[pumpExportRow], error) {
+	conds, args := exportConds(p, nil, nil)
+	query := "SELECT id, timestamp, run_time, current, low_current, COALESCE(device_id, '') FROM pump_run_times"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY timestamp, id"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlCursor[pumpExportRow]{rows, func(rows *sql.Rows, row *pumpExportRow) error {
+		return rows.Scan(&row.ID, &row.Timestamp, &row.RunTime, &row.Current, &row.LowCurrent, &row.DeviceID)
+	}}, nil
+}
+
+func (s *pgStore) ListPumpCycles(ctx context.Context, filter cycleFilter, page pageParams) ([]PumpCycle, error) {
+	query := `SELECT id, COALESCE(device_id, ''), start_time, end_time, duration_seconds, sample_count,
+		avg_current, peak_current, min_current, low_current, low_current_samples FROM pump_cycles`
+	var conds []string
+	var args []interface{}
+	if filter.DeviceID != "" {
+		args = append(args, filter.DeviceID)
+		conds = append(conds, "device_id = $1")
+	}
+	if filter.LowCurrent {
+		conds = append(conds, "low_current")
+	}
+	tail, args := page.clauseOn("start_time", conds, args)
+	query += tail
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cycles := []PumpCycle{}
+	for rows.Next() {
+		var c PumpCycle
+		if err := rows.Scan(&c.ID, &c.DeviceID, &c.Start, &c.End, &c.DurationSeconds, &c.SampleCount,
+			&c.AvgCurrent, &c.PeakCurrent, &c.MinCurrent, &c.LowCurrent, &c.LowCurrentSamples); err != nil {
+			return nil, err
+		}
+		cycles = append(cycles, c)
+	}
+	return cycles, rows.Err()
+}
+
+// PumpStats counts cycles towards the period in which they started
+// PumpStats splits the samples into cycles like the sessionizer does, rather
+// than reading pump_cycles, which only has a cycle once it has ended and the
+// sessionizer has run. A cycle still running at to counts up to to.
+func (s *pgStore) PumpStats(ctx context.Context, q statsQuery) ([]PumpStats, error) {
+	query := `
+		WITH marked AS (
+			SELECT COALESCE(device_id, '') AS device, id, timestamp, run_time, low_current,
+				CASE WHEN run_time >= LAG(run_time) OVER w AND timestamp - LAG(timestamp) OVER w <= $3::float8 * interval '1 second'
+					THEN 0 ELSE 1 END AS starts
+			FROM pump_run_times
+			WHERE timestamp >= $4 AND timestamp < $5 AND ($6 = '' OR device_id = $6)
+			WINDOW w AS (PARTITION BY COALESCE(device_id, '') ORDER BY timestamp, id)
+		), numbered AS (
+			SELECT *, SUM(starts) OVER (PARTITION BY device ORDER BY timestamp, id) AS cycle FROM marked
+		), cycles AS (
+			SELECT start_time, ROUND(EXTRACT(EPOCH FROM end_time - start_time))::int AS duration_seconds, low_current_samples
+			FROM (
+				SELECT (array_agg(timestamp - run_time * interval '1 second' ORDER BY timestamp, id))[1] AS start_time,
+					MAX(timestamp) AS end_time, COUNT(*) FILTER (WHERE low_current) AS low_current_samples
+				FROM numbered
+				GROUP BY device, cycle
+			) c
+		)
+		SELECT date_trunc($1, start_time AT TIME ZONE $2) AT TIME ZONE $2 AS period,
+			COUNT(*), SUM(duration_seconds), ROUND(AVG(duration_seconds), 1), MAX(duration_seconds), SUM(low_current_samples)
+		FROM cycles
+		WHERE start_time >= $4
+		GROUP BY 1 ORDER BY 1`
+
+	rows, err := s.db.QueryContext(ctx, query, q.Period, q.Location.String(), pumpCycleGap.Seconds(), q.From, q.To, q.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []PumpStats{}
+	for rows.Next() {
+		var st PumpStats
+		if err := rows.Scan(&st.Period, &st.Cycles, &st.TotalRunSeconds, &st.AvgCycleSeconds, &st.LongestCycleSeconds, &st.LowCurrentSamples); err != nil {
+			return nil, err
+		}
+		st.Period = st.Period.In(q.Location)
+		stats = append(stats, st)
+	}
+	return stats, rows.Err()
+}
+
+// DeviceActivity matches temperature readings stored before the registry
+// existed, which have no device_id, by location
+func (s *pgStore) DeviceActivity(ctx context.Context) ([]DeviceStatus, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT d.id, d.type, d.name, COALESCE(d.location, ''), d.expected_interval_seconds,
+			hb.timestamp, COALESCE(t.timestamp, p.timestamp), COALESCE(t.value, p.current)
+		FROM devices d
+		LEFT JOIN LATERAL (
+			SELECT h.timestamp FROM device_heartbeats h
+			WHERE h.device_id = d.id
+			ORDER BY h.timestamp DESC LIMIT 1
+		) hb ON true
+		LEFT JOIN LATERAL (
+			SELECT t.timestamp, t.value FROM temperatures t
+			WHERE d.type = 'temperature'
+				AND (t.device_id = d.id OR (t.device_id IS NULL AND t.location = d.location))
+			ORDER BY t.timestamp DESC LIMIT 1
+		) t ON true
+		LEFT JOIN LATERAL (
+			SELECT p.timestamp, p.current FROM pump_run_times p
+			WHERE d.type = 'pump' AND p.device_id = d.id
+			ORDER BY p.timestamp DESC LIMIT 1
+		) p ON true
+		WHERE d.decommissioned_at IS NULL
+		ORDER BY d.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []DeviceStatus{}
+	for rows.Next() {
+		var st DeviceStatus
+		var heartbeat, reading sql.NullTime
+		var value sql.NullFloat64
+		if err := rows.Scan(&st.ID, &st.Type, &st.Name, &st.Location, &st.ExpectedInterval, &heartbeat, &reading, &value); err != nil {
+			return nil, err
+		}
+		st.LastHeartbeat, st.LastReading, st.LastValue = nullTime(heartbeat), nullTime(reading), nullFloat(value)
+		statuses = append(statuses, st)
+	}
+	return statuses, rows.Err()
+}
+
+func (s *pgStore) LatestTemperatures(ctx context.Context, since time.Time) ([]TemperatureReading, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (location) id, value, location, timestamp, humidity, dew_point, COALESCE(device_id, '')
+		FROM temperatures
+		WHERE timestamp >= $1
+		ORDER BY location, timestamp DESC`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := []TemperatureReading{}
+	for rows.Next() {
+		var reading TemperatureReading
+		if err := scanTemperature(rows, &reading); err != nil {
+			return nil, err
+		}
+		readings = append(readings, reading)
+	}
+	return readings, rows.Err()
+}
+
+func (s *pgStore) LatestPumpRunTimes(ctx context.Context, since time.Time) ([]PumpRunTime, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (COALESCE(device_id, '')) id, run_time, current, low_current, timestamp, COALESCE(device_id, '')
+		FROM pump_run_times
+		WHERE timestamp >= $1
+		ORDER BY COALESCE(device_id, ''), timestamp DESC`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runTimes := []PumpRunTime{}
+	for rows.Next() {
+		var rt PumpRunTime
+		if err := rows.Scan(&rt.ID, &rt.RunTime, &rt.Current, &rt.LowCurrent, &rt.Timestamp, &rt.DeviceID); err != nil {
+			return nil, err
+		}
+		runTimes = append(runTimes, rt)
+	}
+	return runTimes, rows.Err()
+}
+
+func (s *pgStore) LatestHeartbeats(ctx context.Context, since time.Time) ([]DeviceHeartbeat, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT d.id, h.timestamp
+		FROM devices d
+		CROSS JOIN LATERAL (
+			SELECT timestamp FROM device_heartbeats
+			WHERE device_id = d.id
+			ORDER BY timestamp DESC LIMIT 1
+		) h
+		WHERE d.decommissioned_at IS NULL
+		UNION ALL
+		SELECT device_id, MAX(timestamp)
+		FROM device_heartbeats
+		WHERE timestamp >= $1
+			AND device_id NOT IN (SELECT id FROM devices)
+		GROUP BY device_id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	heartbeats := []DeviceHeartbeat{}
+	for rows.Next() {
+		var heartbeat DeviceHeartbeat
+		if err := rows.Scan(&heartbeat.DeviceID, &heartbeat.Timestamp); err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, heartbeat)
+	}
+	return heartbeats, rows.Err()
+}
+
+func (s *pgStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *pgStore) SchemaVersion(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, s.db)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tablePolicy describes the retention and compression defaults of a hypertable
+// or continuous aggregate. Both can be overridden with the <table>_retention
+// and <table>_compress_after environment variables; "off" disables the policy.
+type tablePolicy struct {
+	Table         string
+	View          bool   // a continuous aggregate rather than a hypertable
+	SegmentBy     string // compression segmentby column, empty for none
+	Retention     string // drop chunks older than this
+	CompressAfter string // compress chunks older than this
+}
+
+var tablePolicies = []tablePolicy{
+	{Table: "temperatures", SegmentBy: "location", CompressAfter: "7d"},
+	// Pump samples are kept long enough for /pumpmon/stats, which reads them,
+	// to cover its 12 months and compare them with the year before
+	{Table: "pump_run_times", Retention: "730d", CompressAfter: "7d"},
+	{Table: "pump_run_times_critical", Retention: "730d", CompressAfter: "7d"},
+	{Table: "device_heartbeats", Retention: "30d", CompressAfter: "7d"},
+
+	// The continuous aggregates outlive the readings they were built from. Their
+	// chunks are compressed well after the refresh policies stop updating them.
+	{Table: "temperatures_hourly", View: true, CompressAfter: "30d"},
+	{Table: "temperatures_daily", View: true, CompressAfter: "30d"},
+	{Table: "temperatures_humidity_hourly", View: true, CompressAfter: "30d"},
+	{Table: "temperatures_humidity_daily", View: true, CompressAfter: "30d"},
+	{Table: "pump_run_times_hourly", View: true, CompressAfter: "30d"},
+	{Table: "pump_run_times_daily", View: true, CompressAfter: "30d"},
+}
+
+// parseDayDuration accepts Go durations (90m, 12h) plus a day suffix (1d, 30d)
+func parseDayDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// policySetting returns the configured interval for a table setting, or ""
+// when the policy is disabled.
+func policySetting(table, setting, fallback string) (string, error) {
+	value, ok := os.LookupEnv(table + "_" + setting)
+	if !ok {
+		value = fallback
+	}
+	if value == "" || value == "off" {
+		return "", nil
+	}
+	d, err := parseDayDuration(value)
+	if err != nil || d <= 0 {
+		return "", fmt.Errorf("%s_%s: invalid duration %q", table, setting, value)
+	}
+	return intervalArg(d), nil
+}
+
+// applyTablePolicies brings the retention and compression policies of every
+// hypertable and continuous aggregate in line with the configuration. Policies are replaced on each
+// start so that changed settings take effect.
+func applyTablePolicies(ctx context.Context) error {
+	for _, p := range tablePolicies {
+		retention, err := policySetting(p.Table, "retention", p.Retention)
+		if err != nil {
+			return err
+		}
+		compressAfter, err := policySetting(p.Table, "compress_after", p.CompressAfter)
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.ExecContext(ctx, `SELECT remove_retention_policy($1::regclass, if_exists => true)`, p.Table); err != nil {
+			return fmt.Errorf("remove retention policy on %s: %w", p.Table, err)
+		}
+		if retention != "" {
+			if _, err := db.ExecContext(ctx, `SELECT add_retention_policy($1::regclass, $2::interval)`, p.Table, retention); err != nil {
+				return fmt.Errorf("add retention policy on %s: %w", p.Table, err)
+			}
+		}
+
+		if _, err := db.ExecContext(ctx, `SELECT remove_compression_policy($1::regclass, if_exists => true)`, p.Table); err != nil {
+			return fmt.Errorf("remove compression policy on %s: %w", p.Table, err)
+		}
+		if compressAfter != "" {
+			if err := enableCompression(ctx, p); err != nil {
+				return err
+			}
+			if _, err := db.ExecContext(ctx, `SELECT add_compression_policy($1::regclass, $2::interval)`, p.Table, compressAfter); err != nil {
+				return fmt.Errorf("add compression policy on %s: %w", p.Table, err)
+			}
+		}
+
+		log.Printf("Policies for %s: retention=%q compress_after=%q", p.Table, retention, compressAfter)
+	}
+	return nil
+}
+
+// enableCompression turns on native compression for a hypertable or continuous
+// aggregate. The settings cannot be changed once chunks are compressed, so it
+// is only done once.
+func enableCompression(ctx context.Context, p tablePolicy) error {
+	check := `SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_name = $1`
+	if p.View {
+		check = `SELECT compression_enabled FROM timescaledb_information.continuous_aggregates WHERE view_name = $1`
+	}
+	var enabled bool
+	if err := db.QueryRowContext(ctx, check, p.Table).Scan(&enabled); err != nil {
+		return fmt.Errorf("check compression on %s: %w", p.Table, err)
+	}
+	if enabled {
+		return nil
+	}
+
+	// Continuous aggregates are compressed by their group by columns
+	alter := fmt.Sprintf("ALTER MATERIALIZED VIEW %s SET (timescaledb.compress = true)", p.Table)
+	if !p.View {
+		settings := "timescaledb.compress, timescaledb.compress_orderby = 'timestamp DESC'"
+		if p.SegmentBy != "" {
+			settings += fmt.Sprintf(", timescaledb.compress_segmentby = '%s'", p.SegmentBy)
+		}
+		alter = fmt.Sprintf("ALTER TABLE %s SET (%s)", p.Table, settings)
+	}
+	if _, err := db.ExecContext(ctx, alter); err != nil {
+		return fmt.Errorf("enable compression on %s: %w", p.Table, err)
+	}
+	return nil
+}
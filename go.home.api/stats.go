@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// statsPeriods maps the period parameter to the number of periods returned
+// when from is not given
+var statsPeriods = map[string]int{
+	"day":   30,
+	"week":  12,
+	"month": 12,
+}
+
+// PumpStats summarizes the pump cycles that started in one period
+type PumpStats struct {
+	Period              time.Time `json:"period"`                // Start of the period
+	Cycles              int       `json:"cycles"`                // Number of pump cycles
+	TotalRunSeconds     int       `json:"total_run_seconds"`     // Sum of cycle lengths
+	AvgCycleSeconds     float64   `json:"avg_cycle_seconds"`     // Average cycle length
+	LongestCycleSeconds int       `json:"longest_cycle_seconds"` // Longest cycle
+	LowCurrentSamples   int       `json:"low_current_samples"`   // Samples flagged as low current
+}
+
+// statsQuery selects the periods summarized by /pumpmon/stats
+type statsQuery struct {
+	Period   string // day, week or month
+	Location *time.Location
+	From, To time.Time
+	DeviceID string
+}
+
+// periodStart returns the start of the period containing t, matching
+// PostgreSQL's date_trunc (weeks start on Monday)
+func periodStart(period string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch period {
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// addPeriods moves t by n periods
+func addPeriods(period string, t time.Time, n int) time.Time {
+	switch period {
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month":
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(0, 0, n)
+	}
+}
+
+// parseStatsParams reads period, tz, from, to and device_id. The range
+// defaults to the last statsPeriods[period] periods, including the current one.
+func parseStatsParams(q url.Values) (statsQuery, error) {
+	sq := statsQuery{Period: q.Get("period"), Location: time.UTC, DeviceID: q.Get("device_id")}
+	if sq.Period == "" {
+		sq.Period = "day"
+	}
+	count, ok := statsPeriods[sq.Period]
+	if !ok {
+		return sq, errors.New("invalid period: must be day, week or month")
+	}
+
+	var err error
+	if tz := q.Get("tz"); tz != "" {
+		if sq.Location, err = time.LoadLocation(tz); err != nil {
+			return sq, fmt.Errorf("invalid tz %q", tz)
+		}
+	}
+
+	if sq.From, sq.To, err = parseTimeRange(q); err != nil {
+		return sq, err
+	}
+	if sq.To.IsZero() {
+		sq.To = time.Now()
+	}
+	if sq.From.IsZero() {
+		sq.From = addPeriods(sq.Period, periodStart(sq.Period, sq.To.In(sq.Location)), 1-count)
+	}
+	if !sq.From.Before(sq.To) {
+		return sq, errors.New("from must be before to")
+	}
+	return sq, nil
+}
+
+func handlePumpStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseStatsParams(r.URL.Query())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	ctx := context.Background()
+
+	stats, err := store.PumpStats(ctx, q)
+	if err != nil {
+		writeError(w, "Failed to compute pump statistics", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
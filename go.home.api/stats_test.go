@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pumpRun returns the samples the pump monitor posts every 2 seconds while
+// the pump runs for the given seconds from start
+func pumpRun(deviceID string, start time.Time, seconds int) []PumpRunTime {
+	var samples []PumpRunTime
+	for t := 2; t <= seconds; t += 2 {
+		samples = append(samples, PumpRunTime{RunTime: t, Current: 7, DeviceID: deviceID, Timestamp: start.Add(time.Duration(t) * time.Second)})
+	}
+	return samples
+}
+
+func TestPumpStats(t *testing.T) {
+	s := useMemoryStore(t)
+	// 02:00 UTC on March 5th is still March 4th in New York
+	for _, run := range [][]PumpRunTime{
+		pumpRun("pump", time.Date(2026, 3, 4, 15, 0, 0, 0, time.UTC), 60),
+		pumpRun("pump", time.Date(2026, 3, 5, 2, 0, 0, 0, time.UTC), 120),
+		pumpRun("pump", time.Date(2026, 3, 5, 15, 0, 0, 0, time.UTC), 30),
+	} {
+		s.runTimes = append(s.runTimes, run...)
+	}
+	s.runTimes[40].LowCurrent, s.runTimes[41].LowCurrent = true, true
+	for i := range s.runTimes {
+		s.runTimes[i].ID = i + 1
+	}
+	handler := http.HandlerFunc(handlePumpStats)
+
+	for _, tc := range []struct {
+		tz     string
+		cycles []int
+	}{
+		{"UTC", []int{1, 2}},
+		{"America/New_York", []int{2, 1}},
+	} {
+		w := serve(handler, http.MethodGet, "/pumpmon/stats?from=2026-03-01T00:00:00Z&to=2026-03-08T00:00:00Z&tz="+tc.tz, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /pumpmon/stats = %d: %s", w.Code, w.Body)
+		}
+		var stats []PumpStats
+		decodeBody(t, w, &stats)
+		if len(stats) != 2 || stats[0].Cycles != tc.cycles[0] || stats[1].Cycles != tc.cycles[1] {
+			t.Errorf("tz=%s: got %+v, want cycles per day %v", tc.tz, stats, tc.cycles)
+			continue
+		}
+		loc, _ := time.LoadLocation(tc.tz)
+		if want := time.Date(2026, 3, 4, 0, 0, 0, 0, loc); !stats[0].Period.Equal(want) {
+			t.Errorf("tz=%s: first period %s, want %s", tc.tz, stats[0].Period, want)
+		}
+	}
+
+	var stats []PumpStats
+	decodeBody(t, serve(handler, http.MethodGet, "/pumpmon/stats?period=week&from=2026-03-01T00:00:00Z&to=2026-03-08T00:00:00Z", ""), &stats)
+	if len(stats) != 1 || stats[0].Cycles != 3 || stats[0].TotalRunSeconds != 210 || stats[0].AvgCycleSeconds != 70 ||
+		stats[0].LongestCycleSeconds != 120 || stats[0].LowCurrentSamples != 2 {
+		t.Errorf("period=week returned %+v, want one week of 3 cycles", stats)
+	}
+
+	// The cycle running at to is counted up to to, without waiting for the
+	// sessionizer to store it
+	decodeBody(t, serve(handler, http.MethodGet, "/pumpmon/stats?from=2026-03-05T00:00:00Z&to=2026-03-05T15:00:21Z", ""), &stats)
+	if len(stats) != 1 || stats[0].Cycles != 2 || stats[0].LongestCycleSeconds != 120 || stats[0].TotalRunSeconds != 140 {
+		t.Errorf("range ending mid-cycle returned %+v, want 2 cycles over 140s", stats)
+	}
+
+	// A cycle that started before from is left out, even with samples in range
+	decodeBody(t, serve(handler, http.MethodGet, "/pumpmon/stats?from=2026-03-05T02:00:30Z&to=2026-03-06T00:00:00Z", ""), &stats)
+	if len(stats) != 1 || stats[0].Cycles != 1 || stats[0].TotalRunSeconds != 30 {
+		t.Errorf("range starting mid-cycle returned %+v, want only the 30s cycle", stats)
+	}
+
+	for _, target := range []string{"/pumpmon/stats?period=year", "/pumpmon/stats?tz=Nowhere/Else"} {
+		if w := serve(handler, http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, w.Code)
+		}
+	}
+}
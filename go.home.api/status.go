@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Device states reported by /devices/status
+const (
+	stateOnline  = "online"
+	stateStale   = "stale"
+	stateOffline = "offline"
+	stateUnknown = "unknown"
+)
+
+const (
+	// A device is online while it was seen within onlineIntervals expected
+	// intervals, stale up to staleIntervals, and offline after that
+	onlineIntervals = 2
+	staleIntervals  = 10
+
+	// defaultExpectedInterval applies to locations without a registered device
+	defaultExpectedInterval = 60
+
+	// locationStatusWindow bounds the search for locations that have no
+	// registered device
+	locationStatusWindow = 7 * 24 * time.Hour
+)
+
+// DeviceStatus is the last known activity of a registered device
+type DeviceStatus struct {
+	ID               string     `json:"id"`
+	Type             string     `json:"type"`
+	Name             string     `json:"name"`
+	Location         string     `json:"location,omitempty"`
+	ExpectedInterval int        `json:"expected_interval_seconds"`
+	LastHeartbeat    *time.Time `json:"last_heartbeat,omitempty"` // Newest heartbeat
+	LastReading      *time.Time `json:"last_reading,omitempty"`   // Newest temperature reading or pump sample
+	LastValue        *float64   `json:"last_value,omitempty"`     // Temperature in Fahrenheit, or pump current in amps
+	LastSeen         *time.Time `json:"last_seen,omitempty"`      // Newer of last_heartbeat and last_reading
+	SecondsSinceSeen *int64     `json:"seconds_since_seen,omitempty"`
+	State            string     `json:"state"` // online, stale, offline or unknown
+}
+
+// LocationStatus is the last temperature reading at a location
+type LocationStatus struct {
+	Location         string     `json:"location"`
+	DeviceID         string     `json:"device_id,omitempty"` // Active temperature device at the location
+	ExpectedInterval int        `json:"expected_interval_seconds"`
+	LastReading      *time.Time `json:"last_reading,omitempty"`
+	LastValue        *float64   `json:"last_value,omitempty"`    // Temperature in Fahrenheit
+	LastHumidity     *float64   `json:"last_humidity,omitempty"` // Relative humidity in percent
+	SecondsSinceSeen *int64     `json:"seconds_since_seen,omitempty"`
+	State            string     `json:"state"`
+}
+
+// StatusResponse is returned by GET /devices/status
+type StatusResponse struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Devices     []DeviceStatus   `json:"devices"`
+	Locations   []LocationStatus `json:"locations"`
+}
+
+// deviceState classifies a device by the time since it was last seen
+func deviceState(lastSeen *time.Time, expectedInterval int, now time.Time) (string, *int64) {
+	if lastSeen == nil {
+		return stateUnknown, nil
+	}
+	age := now.Sub(*lastSeen)
+	seconds := int64(age.Seconds())
+	if seconds < 0 {
+		seconds = 0
+	}
+	interval := time.Duration(expectedInterval) * time.Second
+	switch {
+	case age <= onlineIntervals*interval:
+		return stateOnline, &seconds
+	case age <= staleIntervals*interval:
+		return stateStale, &seconds
+	default:
+		return stateOffline, &seconds
+	}
+}
+
+// nullTime converts a nullable column to an optional JSON timestamp
+func nullTime(n sql.NullTime) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Time
+}
+
+func handleDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := context.Background()
+	now := time.Now()
+
+	devices, err := deviceStatuses(ctx, now)
+	if err != nil {
+		writeError(w, "Failed to fetch device status", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	locations, err := locationStatuses(ctx, now, devices)
+	if err != nil {
+		writeError(w, "Failed to fetch location status", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatusResponse{GeneratedAt: now, Devices: devices, Locations: locations})
+}
+
+// deviceStatuses returns the newest heartbeat and reading of every active
+// device, with the state they put it in
+func deviceStatuses(ctx context.Context, now time.Time) ([]DeviceStatus, error) {
+	statuses, err := store.DeviceActivity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range statuses {
+		s := &statuses[i]
+		s.LastSeen = s.LastHeartbeat
+		if s.LastReading != nil && (s.LastSeen == nil || s.LastReading.After(*s.LastSeen)) {
+			s.LastSeen = s.LastReading
+		}
+		s.State, s.SecondsSinceSeen = deviceState(s.LastSeen, s.ExpectedInterval, now)
+	}
+	return statuses, nil
+}
+
+// locationStatuses returns the newest reading of every location that has an
+// active temperature device or reported within locationStatusWindow
+func locationStatuses(ctx context.Context, now time.Time, devices []DeviceStatus) ([]LocationStatus, error) {
+	byLocation := map[string]*LocationStatus{}
+
+	readings, err := store.LatestTemperatures(ctx, now.Add(-locationStatusWindow))
+	if err != nil {
+		return nil, err
+	}
+	for _, reading := range readings {
+		s := LocationStatus{Location: reading.Location, ExpectedInterval: defaultExpectedInterval}
+		s.LastReading, s.LastValue, s.LastHumidity = &reading.Timestamp, &reading.Value, reading.Humidity
+		byLocation[s.Location] = &s
+	}
+
+	// Registered devices supply the expected interval, and their locations
+	// are listed with their last reading even when they have gone quiet
+	for _, d := range devices {
+		if d.Type != deviceTypeTemperature || d.Location == "" {
+			continue
+		}
+		s, ok := byLocation[d.Location]
+		if !ok {
+			s = &LocationStatus{Location: d.Location, LastReading: d.LastReading, LastValue: d.LastValue}
+			byLocation[d.Location] = s
+		}
+		s.DeviceID, s.ExpectedInterval = d.ID, d.ExpectedInterval
+	}
+
+	statuses := make([]LocationStatus, 0, len(byLocation))
+	for _, s := range byLocation {
+		s.State, s.SecondsSinceSeen = deviceState(s.LastReading, s.ExpectedInterval, now)
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Location < statuses[j].Location })
+	return statuses, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeviceStatus(t *testing.T) {
+	now := time.Now()
+	retired := now.Add(-time.Hour)
+	s := useMemoryStore(t,
+		Device{ID: "freezer", Type: deviceTypeTemperature, Location: "freezer", ExpectedInterval: 60},
+		Device{ID: "pump", Type: deviceTypePump, Location: "wellpump", ExpectedInterval: 60},
+		Device{ID: "quiet", Type: deviceTypeTemperature, Location: "attic", ExpectedInterval: 60},
+		Device{ID: "old", Type: deviceTypeTemperature, Location: "shed", ExpectedInterval: 60, DecommissionedAt: &retired},
+	)
+	s.temperatures = []TemperatureReading{
+		{ID: 1, Value: 5, Location: "freezer", DeviceID: "freezer", Timestamp: now.Add(-30 * time.Second)},
+		{ID: 2, Value: 70, Location: "porch", Timestamp: now.Add(-time.Hour)},              // no device, stale by default interval
+		{ID: 3, Value: 71, Location: "basement", Timestamp: now.Add(-30 * 24 * time.Hour)}, // outside the window
+	}
+	s.heartbeats = []DeviceHeartbeat{{DeviceID: "pump", Timestamp: now.Add(-5 * time.Minute)}}
+
+	w := serve(http.HandlerFunc(handleDeviceStatus), http.MethodGet, "/devices/status", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /devices/status = %d: %s", w.Code, w.Body)
+	}
+	var status StatusResponse
+	decodeBody(t, w, &status)
+
+	devices := map[string]string{}
+	for _, d := range status.Devices {
+		devices[d.ID] = d.State
+	}
+	for id, want := range map[string]string{"freezer": stateOnline, "pump": stateStale, "quiet": stateUnknown} {
+		if devices[id] != want {
+			t.Errorf("device %s is %q, want %q", id, devices[id], want)
+		}
+	}
+	if _, ok := devices["old"]; ok || len(devices) != 3 {
+		t.Errorf("got devices %v, want the three active ones", devices)
+	}
+
+	locations := map[string]LocationStatus{}
+	for _, l := range status.Locations {
+		locations[l.Location] = l
+	}
+	if l := locations["freezer"]; l.DeviceID != "freezer" || l.State != stateOnline || l.LastValue == nil || *l.LastValue != 5 {
+		t.Errorf("freezer location = %+v, want online at 5 from device freezer", l)
+	}
+	if l := locations["porch"]; l.State != stateOffline || l.ExpectedInterval != defaultExpectedInterval {
+		t.Errorf("porch location = %+v, want offline with the default interval", l)
+	}
+	if l, ok := locations["attic"]; !ok || l.State != stateUnknown {
+		t.Errorf("attic location = %+v, want listed as unknown for its quiet device", l)
+	}
+	if _, ok := locations["basement"]; ok {
+		t.Error("basement is listed, but its only reading is outside the window")
+	}
+}
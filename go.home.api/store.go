@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Store persists temperature readings, pump run times, heartbeats, the device
+// registry and API keys. The handlers use the package level store: pgStore in
+// production, or memStore, which needs no database, for handler tests.
+type Store interface {
+	// ListTemperatures returns the readings matching filter in page order.
+	// Up to page.Limit+1 readings are returned so callers can tell whether
+	// there is a next page.
+	ListTemperatures(ctx context.Context, filter readingFilter, page pageParams) ([]TemperatureReading, error)
+	// GetTemperature returns errNotFound for unknown IDs
+	GetTemperature(ctx context.Context, id int) (TemperatureReading, error)
+	// DeleteTemperature succeeds for unknown IDs as well
+	DeleteTemperature(ctx context.Context, id int) error
+	// InsertTemperatures stores the readings whose idempotency key (if any)
+	// is new and fills in their IDs, timestamps and dew points. The others
+	// are filled in from the reading stored first and reported as replayed.
+	InsertTemperatures(ctx context.Context, readings []*TemperatureReading, keys []string) (replayed []bool, err error)
+
+	ListPumpRunTimes(ctx context.Context, filter readingFilter, page pageParams) ([]PumpRunTime, error)
+	GetPumpRunTime(ctx context.Context, id int) (PumpRunTime, error)
+	DeletePumpRunTime(ctx context.Context, id int) error
+	InsertPumpRunTimes(ctx context.Context, runTimes []*PumpRunTime, keys []string) (replayed []bool, err error)
+
+	// InsertHeartbeat stores a heartbeat and fills in its ID and timestamp
+	InsertHeartbeat(ctx context.Context, heartbeat *DeviceHeartbeat) error
+
+	// ActiveDevices returns the registered devices that are not
+	// decommissioned, which readings are linked to
+	ActiveDevices(ctx context.Context) ([]Device, error)
+	// ListDevices returns the devices matching filter ordered by ID
+	ListDevices(ctx context.Context, filter deviceFilter) ([]Device, error)
+	// GetDevice returns errNotFound for unknown IDs
+	GetDevice(ctx context.Context, id string) (Device, error)
+	// CreateDevice registers d and fills in its timestamps. It returns
+	// errConflict if the ID is taken, or if an active device of the same
+	// type is already at d's location.
+	CreateDevice(ctx context.Context, d *Device) error
+	// UpdateDevice calls apply on the stored device, with other updates of
+	// it held off, and stores the result unless apply returns an error. It
+	// returns errNotFound for unknown IDs and errConflict like CreateDevice.
+	UpdateDevice(ctx context.Context, id string, apply func(d *Device) error) (Device, error)
+	// DecommissionDevice retires a device, keeping the time it was first
+	// retired. It returns errNotFound for unknown IDs.
+	DecommissionDevice(ctx context.Context, id string) error
+
+	// InsertAPIKey stores k under the hash of its secret and fills in its ID
+	// and creation time
+	InsertAPIKey(ctx context.Context, k *APIKey, hash string) error
+	// ListAPIKeys returns all keys, revoked ones included, ordered by ID
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey returns errNotFound for unknown IDs
+	RevokeAPIKey(ctx context.Context, id int) error
+	// APIKeyByHash returns the unrevoked key stored under hash, or errNotFound
+	APIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	// TouchAPIKey records that the key was just used
+	TouchAPIKey(ctx context.Context, id int) error
+
+	// AggregateTemperatures rolls the readings in q's range up into buckets,
+	// ordered by bucket and location
+	AggregateTemperatures(ctx context.Context, q aggregateQuery) ([]TemperatureAggregate, error)
+	// AggregatePumpRunTimes rolls the samples in q's range up into buckets
+	AggregatePumpRunTimes(ctx context.Context, q aggregateQuery) ([]PumpAggregate, error)
+
+	// ExportTemperatures returns the readings matching p ordered by
+	// timestamp and ID. The caller closes the cursor.
+	ExportTemperatures(ctx context.Context, p exportParams) (rowCursor[temperatureExportRow], error)
+	ExportPumpRunTimes(ctx context.Context, p exportParams) (rowCursor[pumpExportRow], error)
+
+	// ListPumpCycles returns the cycles matching filter in page order of
+	// their start, up to page.Limit+1 like ListTemperatures
+	ListPumpCycles(ctx context.Context, filter cycleFilter, page pageParams) ([]PumpCycle, error)
+	// PumpStats summarizes the pump per period of q, ordered by period
+	PumpStats(ctx context.Context, q statsQuery) ([]PumpStats, error)
+
+	// DeviceActivity returns every active device, ordered by ID, with its
+	// newest heartbeat, reading and reading value. State is left to the caller.
+	DeviceActivity(ctx context.Context) ([]DeviceStatus, error)
+	// LatestTemperatures returns the newest reading of every location that
+	// reported since the given time
+	LatestTemperatures(ctx context.Context, since time.Time) ([]TemperatureReading, error)
+	// LatestPumpRunTimes returns the newest sample of every pump that
+	// reported since the given time
+	LatestPumpRunTimes(ctx context.Context, since time.Time) ([]PumpRunTime, error)
+	// LatestHeartbeats returns the newest heartbeat of every active
+	// registered device, however old, and of unregistered devices since the
+	// given time
+	LatestHeartbeats(ctx context.Context, since time.Time) ([]DeviceHeartbeat, error)
+
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+	// SchemaVersion returns the highest applied migration
+	SchemaVersion(ctx context.Context) (int, error)
+}
+
+// readingFilter narrows a list of readings; empty fields match everything
+type readingFilter struct {
+	Location string // temperatures only
+	DeviceID string
+}
+
+// deviceFilter narrows a list of devices; an empty Type matches every type
+type deviceFilter struct {
+	Type                  string
+	IncludeDecommissioned bool
+}
+
+// cycleFilter narrows a list of pump cycles
+type cycleFilter struct {
+	DeviceID   string
+	LowCurrent bool // only cycles with a low current sample
+}
+
+// rowCursor iterates over rows like sql.Rows does
+type rowCursor[T any] interface {
+	Next() bool
+	Scan(row *T) error
+	Err() error
+	Close() error
+}
+
+// errNotFound is returned by Store lookups of unknown rows
+var errNotFound = errors.New("not found")
+
+// errConflict is returned by Store writes that break a uniqueness rule
+var errConflict = errors.New("conflict")
+
+var store Store
+
+// storeTemperatures stores readings and publishes the new ones to /stream
+// clients
+func storeTemperatures(ctx context.Context, readings []*TemperatureReading, keys []string) (replayed []bool, err error) {
+	if replayed, err = store.InsertTemperatures(ctx, readings, keys); err != nil {
+		return nil, err
+	}
+	for i, reading := range readings {
+		if !replayed[i] {
+			hub.publish(eventTemperature, reading.Location, reading.DeviceID, reading)
+		}
+	}
+	return replayed, nil
+}
+
+// storePumpRunTimes stores pump samples and publishes the new ones to /stream
+// clients
+func storePumpRunTimes(ctx context.Context, runTimes []*PumpRunTime, keys []string) (replayed []bool, err error) {
+	if replayed, err = store.InsertPumpRunTimes(ctx, runTimes, keys); err != nil {
+		return nil, err
+	}
+	for i, rt := range runTimes {
+		if !replayed[i] {
+			hub.publish(eventPump, "", rt.DeviceID, rt)
+		}
+	}
+	return replayed, nil
+}
+
+// storeHeartbeat stores a heartbeat and publishes it to /stream clients
+func storeHeartbeat(ctx context.Context, heartbeat *DeviceHeartbeat) error {
+	if err := store.InsertHeartbeat(ctx, heartbeat); err != nil {
+		return err
+	}
+	hub.publish(eventHeartbeat, "", heartbeat.DeviceID, heartbeat)
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamBacklog      = 1000             // events kept for clients resuming with Last-Event-ID
+	streamBuffer       = 256              // events queued per client before it is dropped
+	streamPingInterval = 15 * time.Second // keeps proxies from closing idle streams
+	streamRetry        = 3000             // reconnect delay suggested to clients, in milliseconds
+)
+
+// Stream event types
+const (
+	eventTemperature = "temperature"
+	eventPump        = "pump"
+	eventHeartbeat   = "heartbeat"
+)
+
+// streamEvent is one stored row as sent to /stream clients
+type streamEvent struct {
+	Seq      uint64
+	Type     string
+	Location string
+	DeviceID string
+	Data     []byte // JSON of the row
+}
+
+// streamHub fans new rows out to the connected /stream clients and keeps a
+// backlog for clients that reconnect. Event IDs are "<epoch>-<seq>", where
+// the epoch changes on every start so IDs from an earlier process are not
+// mistaken for current ones.
+type streamHub struct {
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64
+	backlog []streamEvent // ring buffer of the last streamBacklog events
+	clients map[chan streamEvent]struct{}
+}
+
+var hub = &streamHub{
+	epoch:   strconv.FormatInt(time.Now().Unix(), 36),
+	clients: map[chan streamEvent]struct{}{},
+}
+
+func (h *streamHub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// publish sends a stored row to the clients
+func (h *streamHub) publish(typ, location, deviceID string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", typ, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	ev := streamEvent{Seq: h.seq, Type: typ, Location: location, DeviceID: deviceID, Data: data}
+	if len(h.backlog) < streamBacklog {
+		h.backlog = append(h.backlog, ev)
+	} else {
+		h.backlog[(h.seq-1)%streamBacklog] = ev
+	}
+
+	for ch := range h.clients {
+		select {
+		case ch <- ev:
+		default:
+			// The client is too slow; closing its channel ends the response
+			// and it resumes from the backlog when it reconnects
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a client. It returns the backlog events after
+// lastEventID, and resumed=false when that ID is unknown or too old to
+// resume from.
+func (h *streamHub) subscribe(lastEventID string) (ch chan streamEvent, missed []streamEvent, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch = make(chan streamEvent, streamBuffer)
+	h.clients[ch] = struct{}{}
+
+	if lastEventID == "" {
+		return ch, nil, true
+	}
+	epoch, seqStr, _ := strings.Cut(lastEventID, "-")
+	last, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || epoch != h.epoch || last > h.seq {
+		return ch, nil, false
+	}
+	oldest := h.seq - uint64(len(h.backlog)) + 1
+	if last+1 < oldest {
+		return ch, nil, false
+	}
+	for seq := last + 1; seq <= h.seq; seq++ {
+		missed = append(missed, h.backlog[(seq-1)%streamBacklog])
+	}
+	return ch, missed, true
+}
+
+func (h *streamHub) unsubscribe(ch chan streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[ch]; ok {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// close ends the streams of all clients, as the server shuts down
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+// streamFilter selects the events a client asked for; empty fields match all
+type streamFilter struct {
+	Types     map[string]bool
+	Locations map[string]bool
+	Devices   map[string]bool
+}
+
+func setOf(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := map[string]bool{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part != "" {
+				set[part] = true
+			}
+		}
+	}
+	return set
+}
+
+func (f streamFilter) match(ev streamEvent) bool {
+	return (f.Types == nil || f.Types[ev.Type]) &&
+		(f.Locations == nil || f.Locations[ev.Location]) &&
+		(f.Devices == nil || f.Devices[ev.DeviceID])
+}
+
+// handleStream serves new readings as Server-Sent Events. Filters: type
+// (temperature, pump, heartbeat), location and device_id, each repeatable or
+// comma separated.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := streamFilter{
+		Types:     setOf(q["type"]),
+		Locations: setOf(q["location"]),
+		Devices:   setOf(q["device_id"]),
+	}
+	for typ := range filter.Types {
+		if typ != eventTemperature && typ != eventPump && typ != eventHeartbeat {
+			writeError(w, "invalid type: must be temperature, pump or heartbeat", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Streams stay open indefinitely
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = q.Get("last_event_id")
+	}
+	ch, missed, resumed := hub.subscribe(lastEventID)
+	defer hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+	if !resumed {
+		// Tell the client to reload, since events were missed
+		fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+	}
+
+	write := func(ev streamEvent) error {
+		if !filter.match(ev) {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", hub.eventID(ev.Seq), ev.Type, ev.Data)
+		return err
+	}
+	for _, ev := range missed {
+		if err := write(ev); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
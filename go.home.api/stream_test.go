@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useHub points the package level hub at a new one for the duration of the test
+func useHub(t *testing.T) *streamHub {
+	t.Helper()
+	h := &streamHub{epoch: "test", clients: map[chan streamEvent]struct{}{}}
+	prev := hub
+	hub = h
+	t.Cleanup(func() { hub = prev })
+	return h
+}
+
+func TestStreamHubFanOut(t *testing.T) {
+	h := useHub(t)
+	a, _, _ := h.subscribe("")
+	b, _, _ := h.subscribe("")
+	h.publish(eventTemperature, "freezer", "freezer", map[string]float64{"value": -2.5})
+
+	for _, ch := range []chan streamEvent{a, b} {
+		select {
+		case ev := <-ch:
+			if ev.Seq != 1 || ev.Type != eventTemperature || string(ev.Data) != `{"value":-2.5}` {
+				t.Errorf("got event %+v", ev)
+			}
+		default:
+			t.Error("a client did not get the event")
+		}
+	}
+
+	h.unsubscribe(a)
+	h.publish(eventPump, "", "pump", nil)
+	if _, ok := <-a; ok {
+		t.Error("an unsubscribed client got an event")
+	}
+	if ev := <-b; ev.Seq != 2 {
+		t.Errorf("got event %d, want 2", ev.Seq)
+	}
+}
+
+func TestStreamHubReplay(t *testing.T) {
+	h := useHub(t)
+	for i := 0; i < streamBacklog+100; i++ {
+		h.publish(eventHeartbeat, "", "pump", i)
+	}
+
+	for _, tc := range []struct {
+		lastEventID string
+		missed      int
+		resumed     bool
+	}{
+		{"", 0, true},
+		{h.eventID(1050), 50, true},
+		{h.eventID(101), 999, true},  // the oldest event in the backlog follows it
+		{h.eventID(100), 1000, true}, // the whole backlog
+		{h.eventID(99), 0, false},    // the event after it was dropped
+		{h.eventID(1100), 0, true},   // up to date
+		{h.eventID(1101), 0, false},  // from the future
+		{"earlier-1050", 0, false},   // from an earlier process
+		{"not an id", 0, false},
+	} {
+		ch, missed, resumed := h.subscribe(tc.lastEventID)
+		h.unsubscribe(ch)
+		if len(missed) != tc.missed || resumed != tc.resumed {
+			t.Errorf("subscribe(%q) = %d events, resumed %v; want %d, %v", tc.lastEventID, len(missed), resumed, tc.missed, tc.resumed)
+			continue
+		}
+		// The events come back in order, ending with the newest
+		for i, ev := range missed {
+			if want := h.seq - uint64(len(missed)-1-i); ev.Seq != want {
+				t.Errorf("subscribe(%q): event %d has seq %d, want %d", tc.lastEventID, i, ev.Seq, want)
+				break
+			}
+		}
+	}
+}
+
+func TestStreamHubDropsSlowClients(t *testing.T) {
+	h := useHub(t)
+	slow, _, _ := h.subscribe("")
+	fast, _, _ := h.subscribe("")
+
+	for i := 0; i <= streamBuffer; i++ {
+		h.publish(eventHeartbeat, "", "pump", i)
+		<-fast
+	}
+	if _, ok := h.clients[slow]; ok {
+		t.Fatal("the slow client is still subscribed")
+	}
+	if _, ok := h.clients[fast]; !ok {
+		t.Fatal("the fast client was dropped")
+	}
+	// The slow client gets what was queued, then its channel is closed
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != streamBuffer {
+		t.Errorf("slow client got %d events before being dropped, want %d", n, streamBuffer)
+	}
+	h.unsubscribe(slow) // the handler still unsubscribes; it must not close twice
+}
+
+func TestStreamHubClose(t *testing.T) {
+	h := useHub(t)
+	a, _, _ := h.subscribe("")
+	b, _, _ := h.subscribe("")
+	h.close()
+	for _, ch := range []chan streamEvent{a, b} {
+		if _, ok := <-ch; ok {
+			t.Error("a client channel is still open after close")
+		}
+	}
+	if len(h.clients) != 0 {
+		t.Errorf("%d clients left after close", len(h.clients))
+	}
+}
+
+// readEvent reads one Server-Sent Event, skipping comments and the retry field
+func readEvent(t *testing.T, r *bufio.Reader) (id, event, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	h := useHub(t)
+	h.publish(eventTemperature, "freezer", "freezer", map[string]float64{"value": 1})
+	h.publish(eventPump, "", "pump", map[string]float64{"current": 8})
+	h.publish(eventTemperature, "garage", "garage", map[string]float64{"value": 2})
+
+	server := httptest.NewServer(http.HandlerFunc(handleStream))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"?type=temperature", nil)
+	req.Header.Set("Last-Event-ID", h.eventID(1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(resp.Body)
+
+	// The missed temperature event is replayed; the pump event is filtered out
+	if id, event, data := readEvent(t, body); id != h.eventID(3) || event != eventTemperature || data != `{"value":2}` {
+		t.Errorf("replayed %s %s %s, want event 3", id, event, data)
+	}
+
+	// The client subscribed before the replay was sent, so live events follow
+	h.publish(eventHeartbeat, "", "pump", nil)
+	h.publish(eventTemperature, "freezer", "freezer", map[string]float64{"value": 3})
+	if id, _, data := readEvent(t, body); id != h.eventID(5) || data != `{"value":3}` {
+		t.Errorf("got live event %s %s, want event 5", id, data)
+	}
+
+	// Shutting down ends the stream
+	h.close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stream is still open after the hub closed")
+	}
+
+	// Resuming from an unknown ID asks the client to reload
+	req.Header.Set("Last-Event-ID", "earlier-1")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if _, event, _ := readEvent(t, bufio.NewReader(resp2.Body)); event != "reset" {
+		t.Errorf("got %s event for an unknown Last-Event-ID, want reset", event)
+	}
+}
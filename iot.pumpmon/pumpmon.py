@@ -12,10 +12,12 @@ wifi.radio.tx_power = 13
 # Constants
 SLACK_URL = os.getenv("slack_key")
 GOHOMEAPIBASE = os.getenv("gohomeapi_key")
+GOHOMEAPI_TOKEN = os.getenv("gohomeapi_token")
 WIFISSID = os.getenv("wifi_ssid")
 WIFIPASS = os.getenv("wifi_pass")
 GOHOMEAPI = f"{GOHOMEAPIBASE}/pumpmon"
 GOHOMEHEARTBEAT = f"{GOHOMEAPIBASE}/heartbeat"
+GOHOMEHEADERS = {"Authorization": f"Bearer {GOHOMEAPI_TOKEN}"} if GOHOMEAPI_TOKEN else {}
 
 analog_pin = analogio.AnalogIn(board.A1)
 pixel = neopixel.NeoPixel(board.NEOPIXEL, 1)
@@ -64,7 +66,7 @@ def send_gohomeapi_data(wifi, https, runtime, current, isLow):
             "current": current,
             "low_current": isLow
         }
-        response = https.post(GOHOMEAPI, json=payload)
+        response = https.post(GOHOMEAPI, json=payload, headers=GOHOMEHEADERS)
         print(f"GoHomeAPI response code: {response.status_code}")
         blink(1, color=(0, 255, 0))
     except Exception as e:
@@ -78,7 +80,7 @@ def send_heartbeat(wifi, https):
         payload = {
             "device_id": "pump"
         }
-        response = https.post(GOHOMEHEARTBEAT, json=payload)
+        response = https.post(GOHOMEHEARTBEAT, json=payload, headers=GOHOMEHEADERS)
         print(f"Heartbeat response code: {response.status_code}")
         blink(2, color=(255, 0, 255))
     except Exception as e:
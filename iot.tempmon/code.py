@@ -13,9 +13,11 @@ wifi.radio.tx_power = 13
 # Constants
 SLACK_URL = os.getenv("slack_key")
 GOHOMEAPIBASE = os.getenv("gohomeapi_key")
+GOHOMEAPI_TOKEN = os.getenv("gohomeapi_token")
 WIFISSID = os.getenv("wifi_ssid")
 WIFIPASS = os.getenv("wifi_pass")
 GOHOMEAPI = f"{GOHOMEAPIBASE}/tempmon"
+GOHOMEHEADERS = {"Authorization": f"Bearer {GOHOMEAPI_TOKEN}"} if GOHOMEAPI_TOKEN else {}
 TEMP_MON_LOCATION = os.getenv("TEMP_MON_LOCATION", "tempmon")
 MEASURE_INTERVAL = 30  # seconds
 
@@ -70,13 +72,15 @@ def send_slack_message(message):
     except Exception as e:
         print(f"Error sending Slack message: {e}")
 
-def send_gohomeapi_data(temp):
+def send_gohomeapi_data(temp, humidity=None):
     try:
         payload = {
             "value": temp,
             "location": TEMP_MON_LOCATION
         }
-        response = https.post(GOHOMEAPI, json=payload)
+        if humidity is not None:
+            payload["humidity"] = humidity
+        response = https.post(GOHOMEAPI, json=payload, headers=GOHOMEHEADERS)
         print(f"GoHomeAPI response code: {response.status_code}")
         if pixel:
             #blink teal for GoHomeAPI 
@@ -85,20 +89,26 @@ def send_gohomeapi_data(temp):
         print(f"Error sending GoHomeAPI data: {e}")
 
 def readTemp():
+    tempF, rh = readMeasurements()
+    return tempF
+
+def readMeasurements():
     try:
         temp, rh = sht.measurements
         tempF = (temp * 1.8) + 32
-        return tempF
+        return tempF, rh
     except Exception as e:
         print(f"Error reading temperature: {e}")
-        return None
+        return None, None
 
 # send a startup message to Slack - include the current temperature, ip address, and signal strength
 send_slack_message(f"Starting up {TEMP_MON_LOCATION} temperature monitor: {readTemp():.2f} F ip: {wifi.radio.ipv4_address} signal: {wifi.radio.ap_info.rssi} dBm")
 while True:
-    tempF = readTemp()
-    send_gohomeapi_data(tempF)
-    print(f"temp: {tempF:.2f} F")
+    tempF, rh = readMeasurements()
+    send_gohomeapi_data(tempF, rh)
+    # sensors without humidity, or a failed read, report rh as None
+    humidity = f" humidity: {rh:.1f} %" if rh is not None else ""
+    print(f"temp: {tempF:.2f} F{humidity}")
     if matrix:
         matrix.fill(0)
         matrix.print(f"{tempF:05.1f}")
@@ -0,0 +1,2 @@
+-- AlterTable
+ALTER TABLE "AlertPreference" ADD COLUMN     "humidityThreshold" DOUBLE PRECISION;
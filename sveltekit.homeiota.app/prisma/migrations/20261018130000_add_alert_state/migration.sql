@@ -0,0 +1,15 @@
+-- CreateTable
+CREATE TABLE "alert_state" (
+    "userId" TEXT NOT NULL,
+    "location" TEXT NOT NULL,
+    "kind" TEXT NOT NULL,
+    "state" TEXT NOT NULL,
+    "value" DOUBLE PRECISION,
+    "since" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "notifiedAt" TIMESTAMP(3),
+
+    CONSTRAINT "alert_state_pkey" PRIMARY KEY ("userId","location","kind")
+);
+
+-- AddForeignKey
+ALTER TABLE "alert_state" ADD CONSTRAINT "alert_state_userId_fkey" FOREIGN KEY ("userId") REFERENCES "User"("id") ON DELETE RESTRICT ON UPDATE CASCADE;
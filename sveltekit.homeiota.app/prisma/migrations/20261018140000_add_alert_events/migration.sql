@@ -0,0 +1,28 @@
+-- CreateTable
+CREATE TABLE "alert_events" (
+    "id" SERIAL NOT NULL,
+    "userId" TEXT NOT NULL,
+    "location" TEXT NOT NULL,
+    "kind" TEXT NOT NULL,
+    "state" TEXT NOT NULL,
+    "value" DOUBLE PRECISION,
+    "threshold" DOUBLE PRECISION,
+    "title" TEXT NOT NULL,
+    "message" TEXT NOT NULL,
+    "channel" TEXT NOT NULL,
+    "status" TEXT NOT NULL,
+    "error" TEXT,
+    "createdAt" TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    "deliveredAt" TIMESTAMP(3),
+
+    CONSTRAINT "alert_events_pkey" PRIMARY KEY ("id")
+);
+
+-- CreateIndex
+CREATE INDEX "alert_events_location_createdAt_idx" ON "alert_events"("location", "createdAt");
+
+-- CreateIndex
+CREATE INDEX "alert_events_userId_createdAt_idx" ON "alert_events"("userId", "createdAt");
+
+-- AddForeignKey
+ALTER TABLE "alert_events" ADD CONSTRAINT "alert_events_userId_fkey" FOREIGN KEY ("userId") REFERENCES "User"("id") ON DELETE RESTRICT ON UPDATE CASCADE;
@@ -0,0 +1,6 @@
+-- AlterTable
+ALTER TABLE "AlertPreference" ADD COLUMN     "channels" TEXT[] DEFAULT ARRAY['gotify']::TEXT[];
+
+-- AlterTable
+ALTER TABLE "User" ADD COLUMN     "slackWebhookUrl" TEXT,
+ADD COLUMN     "webhookUrl" TEXT;
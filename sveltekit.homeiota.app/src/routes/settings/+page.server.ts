@@ -47,13 +47,23 @@ export const actions: Actions = {
     let name = '';
     let email = '';
     let gotifyToken = '';
-    let uiAlertPreferences: { name: string; threshold: number; enabled: boolean; offlineThreshold?: number }[] = [];
+    let slackWebhookUrl = '';
+    let webhookUrl = '';
+    let phone = '';
+    let uiAlertPreferences: { name: string; threshold: number; enabled: boolean; offlineThreshold?: number; humidityThreshold?: number | null; channels?: string[] }[] = [];
 
     // Always use formData
     const data = await request.formData();
     name = data.get('name') as string;
     email = data.get('email') as string;
     gotifyToken = data.get('gotifyToken') as string;
+    slackWebhookUrl = data.get('slackWebhookUrl') as string;
+    webhookUrl = data.get('webhookUrl') as string;
+    // SMS gateways expect E.164 numbers, e.g. +15551234567
+    phone = ((data.get('phone') as string) ?? '').replace(/[\s().-]/g, '');
+    if (phone && !/^\+[1-9]\d{6,14}$/.test(phone)) {
+      return fail(400, { error: 'Phone number must include the country code, e.g. +15551234567' });
+    }
     const sensorsJson = data.get('uiAlertPreferences');
     uiAlertPreferences = sensorsJson ? JSON.parse(sensorsJson as string) : [];
 
@@ -65,7 +75,10 @@ export const actions: Actions = {
           data: {
             name,
             email,
-            gotifyToken
+            gotifyToken,
+            slackWebhookUrl: slackWebhookUrl || null,
+            webhookUrl: webhookUrl || null,
+            phone: phone || null
           }
         });
       }
@@ -83,14 +96,18 @@ export const actions: Actions = {
             update: {
               threshold: sensor.threshold,
               enabled: sensor.enabled,
-              offlineThreshold: sensor.offlineThreshold ?? null
+              offlineThreshold: sensor.offlineThreshold ?? null,
+              humidityThreshold: sensor.humidityThreshold ?? null,
+              channels: sensor.channels ?? ['gotify']
             },
             create: {
               userId: session.user.id,
               location: sensor.name,
               threshold: sensor.threshold,
               enabled: sensor.enabled,
-              offlineThreshold: sensor.offlineThreshold ?? null
+              offlineThreshold: sensor.offlineThreshold ?? null,
+              humidityThreshold: sensor.humidityThreshold ?? null,
+              channels: sensor.channels ?? ['gotify']
             }
           });
         }